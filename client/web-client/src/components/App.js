@@ -18,7 +18,8 @@ const App = props => {
       <h2 className="tableHeader">Your Files</h2>
 
       <FileList files={props.fileArray} 
-                downloadHandler={props.handlers.handleDownloadRequest}/>
+                downloadHandler={props.handlers.handleDownloadRequest}
+                deleteHandler={props.handlers.handleDeleteRequest}/>
 
       {/* Some status indicators for the demo */}
       <div className="INDICATOR INDICATOR_UP"></div>
@@ -3,6 +3,21 @@ import React, { Component } from 'react';
 import App from './App';
 
 import WebSocketPlus from '../libs/wsplus';
+import {
+  encodeFrame,
+  decodeFrame,
+  FRAME_UPLOAD_CHUNK,
+  FRAME_PART,
+  FRAME_PART_RESPONSE,
+  FRAME_FILE_RESPONSE
+} from '../libs/frame';
+import {
+  deriveKeys,
+  sealFile,
+  openFile,
+  bytes2base64,
+  base642bytes
+} from '../libs/envelope';
 
 // HELPERS
 
@@ -31,8 +46,24 @@ function saveFileFromArrayBuffer(fullName, buf) {
   link.click();
 }
 
+function hex2ab(hex) {
+  const bytes = new Uint8Array(hex.length / 2);
+  for (let i = 0; i < bytes.length; i++) {
+    bytes[i] = parseInt(hex.substr(i * 2, 2), 16);
+  }
+  return bytes.buffer;
+}
+
+function ab2hex(buf) {
+  return Array.from(new Uint8Array(buf))
+    .map(b => ("0" + b.toString(16)).slice(-2))
+    .join("");
+}
+
 // MAIN APP
 
+const PROTOCOL_VERSION = 6;
+
 const PART_STORE = {};
 
 class AppContainer extends Component {
@@ -40,18 +71,54 @@ class AppContainer extends Component {
     fileArray: []
   }
 
-  _blobMetaJSON = {}
+  _nextRequestId = 1
+
+  // Chunked uploads waiting for "uploadStarted", keyed by request ID, then by upload ID
+  _pendingUploads = {}
+  _uploads = {}
+
+  // Frames of downloads still streaming in, keyed by request ID
+  _downloads = {}
+
+  // Key wrapping the keys of the files we seal, derived from the password and never sent
+  _wrappingKey = null
 
   componentDidMount = () => {
     this._ws = new WebSocketPlus("ws://54.197.38.216:8080/websockets");
     this._ws.onOpen = () => {
-      this._ws.sendJSON({
-        type: "registration",
-        userMeta: {
-          name: window.username ? window.username : "DEFAULT",
-          pass: window.password ? window.password : "DEFAULT"
-        }
-      })
+      const name = window.username ? window.username : "DEFAULT"
+
+      // Reconnect with the session token from the last password login rather than the password
+      const token = localStorage.getItem("sessionToken")
+      const key = localStorage.getItem("sessionKey")
+      if (token && key && !window.password && localStorage.getItem("sessionUser") === name) {
+        this._wrappingKey = base642bytes(key)
+        this._ws.sendJSON({
+          type: "login",
+          version: PROTOCOL_VERSION,
+          userMeta: {
+            name: name
+          },
+          token: token
+        })
+        return
+      }
+
+      // The server only ever sees a secret derived from the password, not the password itself
+      deriveKeys(name, window.password ? window.password : "DEFAULT")
+        .then(keys => {
+          this._wrappingKey = keys.wrappingKey
+          this._ws.sendJSON({
+            type: window.registering ? "register" : "login",
+            version: PROTOCOL_VERSION,
+            userMeta: {
+              name: name,
+              pass: keys.pass
+            },
+            // Ask for a session token to reconnect with
+            remember: true
+          })
+        })
     }
 
     this._ws.onMessage = evt => {
@@ -64,6 +131,64 @@ class AppContainer extends Component {
         console.log("Got JSON!", JSON.parse(data));
 
         switch (json.type) {
+          /* Protocol */
+          case "registered":
+          case "loggedIn":
+            console.log("Logged in, speaking protocol version", json.version)
+
+            if (json.token) {
+              localStorage.setItem("sessionToken", json.token)
+              localStorage.setItem("sessionUser", window.username ? window.username : "DEFAULT")
+              localStorage.setItem("sessionKey", bytes2base64(this._wrappingKey))
+            }
+            break;
+          case "loggedOut":
+            console.log("Logged out session", json.tokenId)
+
+            localStorage.removeItem("sessionToken")
+            localStorage.removeItem("sessionUser")
+            localStorage.removeItem("sessionKey")
+            break;
+          case "error":
+            console.log("Server couldn't handle our", json.inReplyTo, "message:", json.code, json.message)
+            break;
+          case "uploadStarted":
+            console.log("Upload", json.uploadId, "started, sending", json.chunks, "chunks")
+
+            this.$handleUploadStarted(json)
+            break;
+          case "uploadStatus":
+            console.log("Upload", json.uploadId, "has chunks", json.received)
+
+            this.$handleUploadStatus(json)
+            break;
+          case "downloadComplete":
+            console.log("Download of", json.fileMeta.name, "complete,", json.size, "bytes")
+
+            this.$handleDownloadComplete(json)
+            break;
+          case "deleted":
+            console.log("Deleted", json.fileMeta.name)
+
+            // Deleting one version is followed by a fresh fileList
+            if (!json.fileMeta.version) {
+              this.setState({
+                fileArray: this.state.fileArray.filter(f => f.name !== json.fileMeta.name)
+              })
+            }
+            break;
+          case "versions":
+            console.log("Versions of", json.fileMeta.name, json.versions)
+            break;
+          case "restored":
+            console.log("Restored", json.fileMeta.name, "as version", json.fileMeta.version)
+            break;
+          case "uploadCommitted":
+            console.log("Upload", json.uploadId, "committed")
+
+            delete this._uploads[json.uploadId]
+            break;
+
           /* User comms */
           case "fileList":
             console.log("Got list of files",  json["files"].map(x => x.fileMeta))
@@ -73,22 +198,22 @@ class AppContainer extends Component {
             })
 
             break;
-          case "response":
-            console.log("Got File meta, next message must be the file blob");
-
-            this._blobMetaJSON = json
-            break;
 
             /* User-as-storage comms */
-          case "part":
-            console.log("Got Part meta, next message must be a part blob")
-
-            this._blobMetaJSON = json
-            break;
           case "request":
             console.log("Got part request")
 
-            this.$handlePartRequest(json["fileMeta"]["name"])
+            this.$handlePartRequest(json["fileMeta"]["name"], json["requestId"])
+            break;
+          case "challenge":
+            console.log("Got proof-of-storage challenge")
+
+            this.$handleChallenge(json)
+            break;
+          case "deletePart":
+            console.log("Deleting part", json.fileMeta.name)
+
+            delete PART_STORE[json.fileMeta.name]
             break;
 
         }
@@ -96,35 +221,144 @@ class AppContainer extends Component {
         console.log("Got Data Blob!", data);
 
         file2ab(data)
-          .then(ab => {
-            if (this._blobMetaJSON.type === "response") {
-              console.log("Received file arraybuffer: ", ab);
+          .then(decodeFrame)
+          .then(frame => {
+            if (frame.type === FRAME_FILE_RESPONSE) {
+              console.log("Received", frame.payload.byteLength, "bytes of", frame.name, "at", frame.offset);
 
-              saveFileFromArrayBuffer(this._blobMetaJSON["fileMeta"]["name"], ab);
+              const download = this._downloads[frame.requestId] || []
+              download.push(frame)
+              this._downloads[frame.requestId] = download
 
-            } else if (this._blobMetaJSON.type === "part") {
+            } else if (frame.type === FRAME_PART) {
               console.log("Storing part in PARTS");
 
-              PART_STORE[this._blobMetaJSON["fileMeta"]["name"]] = ab;
+              PART_STORE[frame.name] = frame.payload;
 
               console.log(PART_STORE);
+
+              // Let the server know we hold the part, so the upload it belongs to can be saved
+              this._ws.sendJSON({
+                type: "partStored",
+                requestId: frame.requestId,
+                fileMeta: {
+                  name: frame.name
+                }
+              })
             }
           })
+          .catch(err => console.log("Dropped bad frame:", err))
       }
 
     }
   }
 
-  $handlePartRequest = fileName => {
+  // Answer with a frame echoing the request ID and carrying the part's bytes.
+  // An empty payload tells the server we don't have the part so it can ask someone else.
+  $handlePartRequest = (fileName, requestId) => {
     console.log("PARTS " + PART_STORE + " Finding part " + fileName)
 
-    if (PART_STORE[fileName] !== null) {
-      console.log("Do we have it? " + PART_STORE[fileName])
-
-      this._ws.sendBuffer(PART_STORE[fileName])
+    let part = PART_STORE[fileName]
+    if (part) {
+      console.log("Do we have it? " + part)
     } else {
       console.log("No such part exists")
+      part = new ArrayBuffer(0)
     }
+
+    encodeFrame({
+        type: FRAME_PART_RESPONSE,
+        requestId: requestId,
+        name: fileName,
+        payload: part
+      })
+      .then(this._ws.sendBuffer)
+  }
+
+  // Prove we still store a part by answering HMAC-SHA256(nonce, part[offset:offset+length])
+  $handleChallenge = json => {
+    const part = PART_STORE[json["fileMeta"]["name"]]
+    if (!part) {
+      console.log("No such part exists")
+      return
+    }
+
+    const range = part.slice(json.offset, json.offset + json.length)
+    window.crypto.subtle.importKey("raw", hex2ab(json.nonce), {
+        name: "HMAC",
+        hash: "SHA-256"
+      }, false, ["sign"])
+      .then(key => window.crypto.subtle.sign("HMAC", key, range))
+      .then(mac => {
+        this._ws.sendJSON({
+          type: "challengeResponse",
+          challengeId: json.challengeId,
+          mac: ab2hex(mac)
+        })
+      })
+  }
+
+  // Send every chunk of a freshly started upload
+  $handleUploadStarted = json => {
+    const upload = this._pendingUploads[json.requestId]
+    if (!upload) {
+      console.log("No pending upload for request", json.requestId)
+      return
+    }
+    delete this._pendingUploads[json.requestId]
+
+    upload.id = json.uploadId
+    upload.chunkSize = json.chunkSize
+    this._uploads[upload.id] = upload
+
+    const all = Array.from({ length: json.chunks }, (_, i) => i)
+    this.$sendChunks(upload, all)
+  }
+
+  // Resume an upload by resending the chunks the server doesn't have
+  $handleUploadStatus = json => {
+    const upload = this._uploads[json.uploadId]
+    if (!upload) {
+      return
+    }
+
+    const received = new Set(json.received || [])
+    const missing = Array.from({ length: json.chunks }, (_, i) => i)
+      .filter(i => !received.has(i))
+    this.$sendChunks(upload, missing)
+  }
+
+  // Send the given chunks of upload as frames, then ask the server to commit it
+  $sendChunks = (upload, indexes) => {
+    Promise.all(indexes.map(i => {
+        const offset = i * upload.chunkSize
+        return encodeFrame({
+            type: FRAME_UPLOAD_CHUNK,
+            name: upload.id,
+            offset: offset,
+            payload: upload.ab.slice(offset, offset + upload.chunkSize)
+          })
+          .then(this._ws.sendBuffer)
+      }))
+      .then(() => {
+        this._ws.sendJSON({
+          type: "uploadCommit",
+          uploadId: upload.id
+        })
+      })
+  }
+
+  // Put a streamed download back together, open it and save it
+  $handleDownloadComplete = json => {
+    const frames = this._downloads[json.requestId] || []
+    delete this._downloads[json.requestId]
+
+    const buf = new Uint8Array(json.size)
+    frames.forEach(frame => buf.set(new Uint8Array(frame.payload), frame.offset))
+
+    openFile(buf.buffer, json.fileMeta.wrappedKey, this._wrappingKey)
+      .then(plain => saveFileFromArrayBuffer(json.fileMeta.name, plain))
+      .catch(err => console.log("Couldn't open", json.fileMeta.name, ":", err))
   }
 
   handleDownloadRequest = (fileName) => {
@@ -132,6 +366,7 @@ class AppContainer extends Component {
 
     this._ws.sendJSON({
       type: "request",
+      requestId: this._nextRequestId++,
       "fileMeta": {
         name: fileName,
         dateModified: ""
@@ -139,36 +374,54 @@ class AppContainer extends Component {
     })
   }
 
+  handleDeleteRequest = (fileName) => {
+    console.log("Deleting:", fileName);
+
+    this._ws.sendJSON({
+      type: "delete",
+      "fileMeta": {
+        name: fileName
+      }
+    })
+  }
+
   handleFileUpload = evt => {
     const files = evt.target.files; // FileList object
 
     Object.keys(files)
       .map(key => files[key])
       .forEach(f => {
-        file2ab(f).then(ab => {
-          console.log(escape(f.name));
-
-          this._ws.sendJSON({
-            type: "file",
-            fileMeta: {
-              "name": escape(f.name),
-              "dateModified": f.lastModifiedDate.getTime().toString()
-            }
-          });
-          this._ws.sendBuffer(ab);
-
-          // update file-list
-
-          const newFileArray = this.state.fileArray;
-          newFileArray.push({
-            name:escape(f.name),
-            lastModified: (f.lastModifiedDate.getTime() / 1000).toString()
-          })
+        file2ab(f)
+          .then(ab => sealFile(ab, this._wrappingKey))
+          .then(({ sealed, wrappedKey }) => {
+            console.log(escape(f.name));
+
+            // Only the sealed file and its wrapped key leave the browser
+            const requestId = this._nextRequestId++;
+            this._pendingUploads[requestId] = { ab: sealed };
+            this._ws.sendJSON({
+              type: "uploadInit",
+              requestId: requestId,
+              size: sealed.byteLength,
+              fileMeta: {
+                "name": escape(f.name),
+                "dateModified": f.lastModifiedDate.getTime().toString(),
+                "wrappedKey": wrappedKey
+              }
+            });
+
+            // update file-list
+
+            const newFileArray = this.state.fileArray;
+            newFileArray.push({
+              name:escape(f.name),
+              lastModified: (f.lastModifiedDate.getTime() / 1000).toString()
+            })
 
-          this.setState({
-            fileArray: newFileArray
+            this.setState({
+              fileArray: newFileArray
+            })
           })
-        })
       })
   }
 
@@ -176,6 +429,7 @@ class AppContainer extends Component {
   _handlers = {
     handleFileUpload: this.handleFileUpload.bind(this),
     handleDownloadRequest: this.handleDownloadRequest.bind(this),
+    handleDeleteRequest: this.handleDeleteRequest.bind(this),
   }
 
   /* beautify preserve:start */
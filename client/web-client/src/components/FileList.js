@@ -20,6 +20,10 @@ const FileList = props => {
           <div className="file__download">
               {dateString}
           </div>
+          <div className="file__delete"
+               onClick={evt => { evt.stopPropagation(); props.deleteHandler(file.name) }}>
+              Delete
+          </div>
         </div>
       </a>
     )
@@ -36,6 +40,8 @@ const FileList = props => {
         <div className="file__download">
           Date Modified
         </div>
+        <div className="file__delete">
+        </div>
       </div>
       {Files}
     </div>
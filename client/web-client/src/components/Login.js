@@ -4,6 +4,12 @@ class Login extends Component {
   state = {}
 
   handleLogin = () => {
+    window.registering = false;
+    this.props.history.push('/dashboard');
+  }
+
+  handleRegister = () => {
+    window.registering = true;
     this.props.history.push('/dashboard');
   }
 
@@ -42,6 +48,12 @@ class Login extends Component {
             Login
           </button>
 
+          <button onClick={this.handleRegister}
+                  type="submit"
+                  className="loginButton">
+            Register
+          </button>
+
         </div>
       </div>
     )
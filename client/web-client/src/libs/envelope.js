@@ -0,0 +1,136 @@
+// Files are sealed here before they are uploaded, so neither peers nor the server see them,
+// see server/envelope.go for the formats and key derivation this follows
+
+const SEALED_VERSION = 2;
+const WRAPPED_KEY_VERSION = 3;
+const SEGMENT_SIZE = 64 * 1024;
+const NONCE_SIZE = 12;
+const TAG_SIZE = 16;
+const KEY_ITERATIONS = 600000;
+
+const encoder = new TextEncoder();
+
+function concat(arrays) {
+  const out = new Uint8Array(arrays.reduce((n, a) => n + a.length, 0));
+  arrays.reduce((offset, a) => {
+    out.set(a, offset);
+    return offset + a.length;
+  }, 0);
+  return out;
+}
+
+function ab2hex(buf) {
+  return Array.from(new Uint8Array(buf))
+    .map(b => ("0" + b.toString(16)).slice(-2))
+    .join("");
+}
+
+export function bytes2base64(bytes) {
+  return window.btoa(Array.from(bytes).map(b => String.fromCharCode(b)).join(""));
+}
+
+export function base642bytes(s) {
+  return Uint8Array.from(window.atob(s), c => c.charCodeAt(0));
+}
+
+function aesKey(raw, usage) {
+  return window.crypto.subtle.importKey("raw", raw, "AES-GCM", false, [usage]);
+}
+
+// The nonce of segment i is the File's nonce with i XORed into its last 4 bytes
+function segmentNonce(nonce, i) {
+  const n = nonce.slice();
+  const view = new DataView(n.buffer);
+  view.setUint32(NONCE_SIZE - 4, (view.getUint32(NONCE_SIZE - 4) ^ i) >>> 0);
+  return n;
+}
+
+function segmentAD(final) {
+  return new Uint8Array([SEALED_VERSION, final ? 1 : 0]);
+}
+
+function hkdf(master, info) {
+  return window.crypto.subtle.deriveBits({
+    name: "HKDF",
+    hash: "SHA-256",
+    salt: new Uint8Array(0),
+    info: encoder.encode(info)
+  }, master, 256);
+}
+
+// Resolves to the secret to log in with instead of the password, and the key wrapping file keys
+export function deriveKeys(username, password) {
+  return window.crypto.subtle.importKey("raw", encoder.encode(password), "PBKDF2", false, ["deriveBits"])
+    .then(key => window.crypto.subtle.deriveBits({
+      name: "PBKDF2",
+      hash: "SHA-256",
+      salt: encoder.encode("nfinite.space/" + username),
+      iterations: KEY_ITERATIONS
+    }, key, 256))
+    .then(bits => window.crypto.subtle.importKey("raw", bits, "HKDF", false, ["deriveBits"]))
+    .then(master => Promise.all([hkdf(master, "nfinite.space login"), hkdf(master, "nfinite.space file keys")]))
+    .then(([secret, wrappingKey]) => ({
+      pass: ab2hex(secret),
+      wrappingKey: new Uint8Array(wrappingKey)
+    }))
+}
+
+// Resolves to data sealed under a new file key, and that key wrapped by wrappingKey in base64
+export function sealFile(data, wrappingKey) {
+  const plain = new Uint8Array(data);
+  const fileKey = window.crypto.getRandomValues(new Uint8Array(32));
+  const nonce = window.crypto.getRandomValues(new Uint8Array(NONCE_SIZE));
+  const keyNonce = window.crypto.getRandomValues(new Uint8Array(NONCE_SIZE));
+  // An empty File is one empty final segment
+  const segments = Math.max(1, Math.ceil(plain.length / SEGMENT_SIZE));
+
+  const sealed = aesKey(fileKey, "encrypt")
+    .then(key => Promise.all(Array.from({ length: segments }, (_, i) => window.crypto.subtle.encrypt({
+      name: "AES-GCM",
+      iv: segmentNonce(nonce, i),
+      additionalData: segmentAD(i === segments - 1)
+    }, key, plain.subarray(i * SEGMENT_SIZE, (i + 1) * SEGMENT_SIZE)))))
+    .then(parts => concat([new Uint8Array([SEALED_VERSION]), nonce].concat(parts.map(p => new Uint8Array(p)))));
+
+  const wrappedKey = aesKey(wrappingKey, "encrypt")
+    .then(key => window.crypto.subtle.encrypt({
+      name: "AES-GCM",
+      iv: keyNonce,
+      additionalData: new Uint8Array([WRAPPED_KEY_VERSION])
+    }, key, fileKey))
+    .then(ct => concat([new Uint8Array([WRAPPED_KEY_VERSION]), keyNonce, new Uint8Array(ct)]));
+
+  return Promise.all([sealed, wrappedKey])
+    .then(([sealed, wrappedKey]) => ({
+      sealed: sealed.buffer,
+      wrappedKey: bytes2base64(wrappedKey)
+    }))
+}
+
+// Resolves to the plaintext of a File sealed by sealFile, rejects if it was tampered with or cut short
+export function openFile(sealed, wrappedKey, wrappingKey) {
+  const bytes = new Uint8Array(sealed);
+  const envelope = base642bytes(wrappedKey);
+  if (envelope[0] !== WRAPPED_KEY_VERSION || bytes[0] !== SEALED_VERSION || bytes.length < 1 + NONCE_SIZE + TAG_SIZE) {
+    return Promise.reject(new Error("envelope: unknown version or too short"));
+  }
+
+  const nonce = bytes.slice(1, 1 + NONCE_SIZE);
+  const body = bytes.subarray(1 + NONCE_SIZE);
+  const full = SEGMENT_SIZE + TAG_SIZE;
+  const segments = Math.ceil(body.length / full);
+
+  return aesKey(wrappingKey, "decrypt")
+    .then(key => window.crypto.subtle.decrypt({
+      name: "AES-GCM",
+      iv: envelope.slice(1, 1 + NONCE_SIZE),
+      additionalData: envelope.slice(0, 1)
+    }, key, envelope.subarray(1 + NONCE_SIZE)))
+    .then(fileKey => aesKey(fileKey, "decrypt"))
+    .then(key => Promise.all(Array.from({ length: segments }, (_, i) => window.crypto.subtle.decrypt({
+      name: "AES-GCM",
+      iv: segmentNonce(nonce, i),
+      additionalData: segmentAD(i === segments - 1)
+    }, key, body.subarray(i * full, (i + 1) * full)))))
+    .then(parts => concat(parts.map(p => new Uint8Array(p))).buffer)
+}
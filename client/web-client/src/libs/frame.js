@@ -0,0 +1,88 @@
+// Self-describing binary frames, see server/frame.go for the layout
+
+export const FRAME_FILE_DATA = 1;
+export const FRAME_PART = 2;
+export const FRAME_PART_RESPONSE = 3;
+export const FRAME_FILE_RESPONSE = 4;
+export const FRAME_UPLOAD_CHUNK = 5;
+
+const MAGIC = [0x4e, 0x46]; // "NF"
+const FRAME_VERSION = 1;
+const HEADER_SIZE = 2 + 1 + 1 + 8 + 8 + 8 + 32 + 2;
+
+function setUint64(view, offset, n) {
+  view.setUint32(offset, Math.floor(n / 0x100000000));
+  view.setUint32(offset + 4, n % 0x100000000);
+}
+
+function getUint64(view, offset) {
+  return view.getUint32(offset) * 0x100000000 + view.getUint32(offset + 4);
+}
+
+function sameBytes(a, b) {
+  if (a.length !== b.length) {
+    return false;
+  }
+  return a.every((x, i) => x === b[i]);
+}
+
+// Resolves to an ArrayBuffer holding the frame
+export function encodeFrame({ type, requestId = 0, name = "", offset = 0, payload }) {
+  const nameBytes = new TextEncoder().encode(name);
+  const payloadBytes = new Uint8Array(payload);
+
+  return window.crypto.subtle.digest("SHA-256", payloadBytes)
+    .then(sum => {
+      const buf = new ArrayBuffer(HEADER_SIZE + nameBytes.length + payloadBytes.length);
+      const view = new DataView(buf);
+      const bytes = new Uint8Array(buf);
+
+      bytes.set(MAGIC, 0);
+      view.setUint8(2, FRAME_VERSION);
+      view.setUint8(3, type);
+      setUint64(view, 4, requestId);
+      setUint64(view, 12, offset);
+      setUint64(view, 20, payloadBytes.length);
+      bytes.set(new Uint8Array(sum), 28);
+      view.setUint16(60, nameBytes.length);
+      bytes.set(nameBytes, HEADER_SIZE);
+      bytes.set(payloadBytes, HEADER_SIZE + nameBytes.length);
+
+      return buf;
+    })
+}
+
+// Resolves to the decoded frame, rejects if it is malformed or its checksum doesn't match
+export function decodeFrame(buf) {
+  const view = new DataView(buf);
+  const bytes = new Uint8Array(buf);
+
+  if (buf.byteLength < HEADER_SIZE || !sameBytes(bytes.slice(0, 2), MAGIC)) {
+    return Promise.reject(new Error("frame: bad magic or truncated header"));
+  }
+  if (view.getUint8(2) !== FRAME_VERSION) {
+    return Promise.reject(new Error("frame: unknown frame version"));
+  }
+
+  const length = getUint64(view, 20);
+  const nameLength = view.getUint16(60);
+  if (buf.byteLength !== HEADER_SIZE + nameLength + length) {
+    return Promise.reject(new Error("frame: length doesn't match payload"));
+  }
+
+  const frame = {
+    type: view.getUint8(3),
+    requestId: getUint64(view, 4),
+    offset: getUint64(view, 12),
+    name: new TextDecoder().decode(bytes.slice(HEADER_SIZE, HEADER_SIZE + nameLength)),
+    payload: buf.slice(HEADER_SIZE + nameLength)
+  };
+
+  return window.crypto.subtle.digest("SHA-256", frame.payload)
+    .then(sum => {
+      if (!sameBytes(new Uint8Array(sum), bytes.slice(28, 60))) {
+        throw new Error("frame: checksum mismatch");
+      }
+      return frame;
+    })
+}
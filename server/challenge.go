@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Proof-of-storage flags. Every challengeInterval each connected peer is asked to prove it
+// still holds one of its parts by sending back HMAC-SHA256(nonce, part[start:start+length]).
+var challengeInterval = flag.Duration("challenge-interval", 5*time.Minute, "time between proof-of-storage challenges, 0 to disable them")
+var challengeTimeout = flag.Duration("challenge-timeout", 30*time.Second, "time a peer has to answer a challenge before it counts as failed")
+var challengesPerPart = flag.Int("challenges-per-part", 8, "number of challenges precomputed for each part at shard time")
+var challengeLength = flag.Int("challenge-length", 4096, "maximum number of bytes covered by a challenge")
+
+// Weight the old reliability score keeps on every challenge result
+const reliabilityDecay = 0.9
+
+// Challenge is a precomputed proof-of-storage question about a FilePart
+type Challenge struct {
+	id       int
+	partName string
+	nonce    []byte
+	start    int
+	length   int
+	answer   string // hex HMAC-SHA256 keyed by nonce over the challenged range
+}
+
+// A Challenge that has been sent to a holder and is waiting for an answer
+type pendingChallenge struct {
+	Challenge
+	holder Client
+	sent   time.Time
+}
+
+// Challenges sent to peers keyed by challenge id, shared between the daemon and listen goroutines
+var pending = struct {
+	sync.Mutex
+	challenges map[int]pendingChallenge
+}{challenges: map[int]pendingChallenge{}}
+
+// NewChallenges precomputes n random Challenges over the data of FilePart fp
+func NewChallenges(fp FilePart, n int) []Challenge {
+	if len(fp.data) == 0 {
+		return nil
+	}
+	var challenges []Challenge
+	for i := 0; i < n; i++ {
+		nonce := make([]byte, 32)
+		if _, err := rand.Read(nonce); err != nil {
+			log.Println("challenge nonce:", err)
+			return challenges
+		}
+		start, err := rand.Int(rand.Reader, big.NewInt(int64(len(fp.data))))
+		if err != nil {
+			log.Println("challenge range:", err)
+			return challenges
+		}
+		ch := Challenge{partName: fp.name, nonce: nonce, start: int(start.Int64())}
+		ch.length = len(fp.data) - ch.start
+		if ch.length > *challengeLength {
+			ch.length = *challengeLength
+		}
+		ch.answer = challengeAnswer(nonce, fp.data[ch.start:ch.start+ch.length])
+		challenges = append(challenges, ch)
+	}
+	return challenges
+}
+
+// Computes the expected answer to a challenge over the given bytes
+func challengeAnswer(nonce []byte, data []byte) string {
+	mac := hmac.New(sha256.New, nonce)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Challenges every connected peer every challengeInterval, forever
+func challengeDaemon() {
+	for range time.Tick(*challengeInterval) {
+		expireChallenges()
+		for _, cli := range sessions.Clients() {
+			con := sessionForClient(cli)
+			if con == nil {
+				continue
+			}
+			ch, err := database.TakeChallengeForHolder(cli)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				log.Println("take challenge:", err)
+				continue
+			}
+			sendChallenge(con, cli, ch)
+		}
+	}
+}
+
+// Sends Challenge ch to holder connected over Session c
+func sendChallenge(c *Session, holder Client, ch Challenge) {
+	msg := ChallengeMessage{"challenge", ch.id, FileMeta{Name: ch.partName}, hex.EncodeToString(ch.nonce), ch.start, ch.length}
+	pending.Lock()
+	pending.challenges[ch.id] = pendingChallenge{ch, holder, time.Now()}
+	pending.Unlock()
+	if err := c.WriteJSON(msg); err != nil {
+		log.Println("send challenge:", err)
+	}
+}
+
+// Check a peer's answer to a Challenge sent over Session c
+func handleChallengeResponse(msg ChallengeResponseMessage, c *Session) error {
+	cli, _ := c.Client()
+	pending.Lock()
+	ch, ok := pending.challenges[msg.ChallengeID]
+	// Only the holder's answer settles a challenge, others can't use up someone else's
+	ok = ok && ch.holder.username == cli.username
+	if ok {
+		delete(pending.challenges, msg.ChallengeID)
+	}
+	pending.Unlock()
+	if !ok {
+		return ProtocolError{ErrCodeNotFound, fmt.Errorf("no pending challenge %d for this peer", msg.ChallengeID)}
+	}
+	passed := hmac.Equal([]byte(msg.MAC), []byte(ch.answer))
+	if !passed {
+		log.Println("Peer", ch.holder.username, "failed challenge for part", ch.partName)
+	}
+	return database.RecordChallengeResult(ch.holder, passed)
+}
+
+// Fail every pending Challenge that has gone unanswered for longer than challengeTimeout
+func expireChallenges() {
+	pending.Lock()
+	var expired []pendingChallenge
+	for id, ch := range pending.challenges {
+		if time.Since(ch.sent) > *challengeTimeout {
+			expired = append(expired, ch)
+			delete(pending.challenges, id)
+		}
+	}
+	pending.Unlock()
+	for _, ch := range expired {
+		log.Println("Peer", ch.holder.username, "did not answer challenge for part", ch.partName)
+		if err := database.RecordChallengeResult(ch.holder, false); err != nil {
+			log.Println("record challenge result:", err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withChallengeStore points the store and pending challenges at fresh ones holding clients for the test
+func withChallengeStore(t *testing.T, clients ...Client) *MemoryStore {
+	t.Helper()
+	oldDatabase, oldPending := database, pending.challenges
+	t.Cleanup(func() {
+		database = oldDatabase
+		pending.Lock()
+		pending.challenges = oldPending
+		pending.Unlock()
+	})
+	m := NewMemoryStore()
+	database = m
+	pending.Lock()
+	pending.challenges = map[int]pendingChallenge{}
+	pending.Unlock()
+	for _, c := range clients {
+		if err := m.CreateClient(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+// challengeCounts gets the challenge results m has recorded for the Client with username
+func challengeCounts(t *testing.T, m *MemoryStore, username string) (passed, failed int, reliability float64) {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbC.challengesPassed, dbC.challengesFailed, dbC.reliability
+}
+
+// receiveChallenge sends ch to holder on s and returns the message its peer got
+func receiveChallenge(t *testing.T, s *Session, conn *websocket.Conn, holder Client, ch Challenge) ChallengeMessage {
+	t.Helper()
+	sendChallenge(s, holder, ch)
+	var msg ChallengeMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// answer computes a peer's answer to msg from the part data it holds
+func answer(t *testing.T, msg ChallengeMessage, data []byte) string {
+	t.Helper()
+	nonce, err := hex.DecodeString(msg.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challengeAnswer(nonce, data[msg.Offset:msg.Offset+msg.Length])
+}
+
+func TestNewChallengesInRange(t *testing.T) {
+	oldLength := *challengeLength
+	defer func() { *challengeLength = oldLength }()
+	*challengeLength = 16
+	for _, size := range []int{1, 2, 16, 17, 100} {
+		var fp FilePart
+		fp.name, fp.data = "p", bytes.Repeat([]byte{7}, size)
+		challenges := NewChallenges(fp, 50)
+		if len(challenges) != 50 {
+			t.Fatalf("%d bytes: made %d challenges, want 50", size, len(challenges))
+		}
+		for _, ch := range challenges {
+			if ch.start < 0 || ch.length < 1 || ch.length > *challengeLength || ch.start+ch.length > size {
+				t.Fatalf("%d bytes: challenge covers %d bytes from %d", size, ch.length, ch.start)
+			}
+			if ch.partName != "p" || ch.answer != challengeAnswer(ch.nonce, fp.data[ch.start:ch.start+ch.length]) {
+				t.Errorf("%d bytes: challenge %+v has the wrong part or answer", size, ch)
+			}
+		}
+	}
+	if challenges := NewChallenges(FilePart{}, 5); challenges != nil {
+		t.Errorf("made challenges %v for an empty part", challenges)
+	}
+}
+
+func TestChallengeResponse(t *testing.T) {
+	bob, carol := Client{username: "bob"}, Client{username: "carol"}
+	m := withChallengeStore(t, bob, carol)
+	s, conn := testSession(t, bob)
+	other, _ := testSession(t, carol)
+	var fp FilePart
+	fp.name, fp.data = "p", []byte("the bytes bob holds for the part")
+	challenges := NewChallenges(fp, 2)
+	for i := range challenges {
+		challenges[i].id = i + 1
+	}
+
+	// The right MAC passes
+	msg := receiveChallenge(t, s, conn, bob, challenges[0])
+	if msg.FileMeta.Name != "p" || msg.Offset != challenges[0].start || msg.Length != challenges[0].length {
+		t.Errorf("sent challenge %+v for %+v", msg, challenges[0])
+	}
+	mac := answer(t, msg, fp.data)
+	// Another peer answering doesn't settle it
+	wantCode(t, "another peer's answer", handleChallengeResponse(ChallengeResponseMessage{"challengeResponse", msg.ChallengeID, mac}, other), ErrCodeNotFound)
+	if err := handleChallengeResponse(ChallengeResponseMessage{"challengeResponse", msg.ChallengeID, mac}, s); err != nil {
+		t.Fatal(err)
+	}
+	if passed, failed, _ := challengeCounts(t, m, "bob"); passed != 1 || failed != 0 {
+		t.Errorf("bob passed %d and failed %d challenges, want 1 and 0", passed, failed)
+	}
+	wantCode(t, "answering twice", handleChallengeResponse(ChallengeResponseMessage{"challengeResponse", msg.ChallengeID, mac}, s), ErrCodeNotFound)
+
+	// A MAC over other bytes fails
+	msg = receiveChallenge(t, s, conn, bob, challenges[1])
+	corrupted := append([]byte(nil), fp.data...)
+	corrupted[msg.Offset] ^= 1
+	if err := handleChallengeResponse(ChallengeResponseMessage{"challengeResponse", msg.ChallengeID, answer(t, msg, corrupted)}, s); err != nil {
+		t.Fatal(err)
+	}
+	if passed, failed, _ := challengeCounts(t, m, "bob"); passed != 1 || failed != 1 {
+		t.Errorf("bob passed %d and failed %d challenges, want 1 and 1", passed, failed)
+	}
+	if passed, failed, _ := challengeCounts(t, m, "carol"); passed != 0 || failed != 0 {
+		t.Errorf("carol has %d passed and %d failed challenges, want none", passed, failed)
+	}
+}
+
+func TestChallengeExpiry(t *testing.T) {
+	bob := Client{username: "bob"}
+	m := withChallengeStore(t, bob)
+	s, conn := testSession(t, bob)
+	var fp FilePart
+	fp.name, fp.data = "p", []byte("part")
+	ch := NewChallenges(fp, 1)[0]
+	ch.id = 1
+	msg := receiveChallenge(t, s, conn, bob, ch)
+
+	// Challenges within the timeout are left to be answered
+	expireChallenges()
+	if _, failed, _ := challengeCounts(t, m, "bob"); failed != 0 {
+		t.Fatalf("a fresh challenge was failed")
+	}
+	pending.Lock()
+	p := pending.challenges[ch.id]
+	p.sent = time.Now().Add(-*challengeTimeout - time.Second)
+	pending.challenges[ch.id] = p
+	pending.Unlock()
+	expireChallenges()
+	if passed, failed, _ := challengeCounts(t, m, "bob"); passed != 0 || failed != 1 {
+		t.Errorf("bob passed %d and failed %d challenges, want an expired one failed", passed, failed)
+	}
+	wantCode(t, "answering too late", handleChallengeResponse(ChallengeResponseMessage{"challengeResponse", msg.ChallengeID, answer(t, msg, fp.data)}, s), ErrCodeNotFound)
+}
+
+func TestRecordChallengeResult(t *testing.T) {
+	bob := Client{username: "bob"}
+	m := withChallengeStore(t, bob)
+	// Reliability starts perfect and moves a tenth of the way towards each result
+	want := 1.0
+	for _, passed := range []bool{false, false, true} {
+		if err := m.RecordChallengeResult(bob, passed); err != nil {
+			t.Fatal(err)
+		}
+		want *= reliabilityDecay
+		if passed {
+			want += 1 - reliabilityDecay
+		}
+		if _, _, reliability := challengeCounts(t, m, "bob"); math.Abs(reliability-want) > 1e-9 {
+			t.Errorf("reliability %v, want %v", reliability, want)
+		}
+	}
+	if passed, failed, _ := challengeCounts(t, m, "bob"); passed != 1 || failed != 2 {
+		t.Errorf("bob passed %d and failed %d challenges, want 1 and 2", passed, failed)
+	}
+}
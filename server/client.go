@@ -6,10 +6,11 @@ type Client struct {
 	password string
 }
 
-// ClientFromMetaData creates a new Client from the provided metadata
-func ClientFromMetaData(metadata map[string]interface{}) Client {
-	username := metadata["name"].(string)
-	password := metadata["pass"].(string)
-	password = hash(password)
-	return Client{username, password}
+// ClientFromMetaData creates a new Client from the provided metadata, hashing its password for storage
+func ClientFromMetaData(metadata UserMeta) (Client, error) {
+	passwordHash, err := HashPassword(metadata.Pass)
+	if err != nil {
+		return Client{}, err
+	}
+	return Client{metadata.Name, passwordHash}, nil
 }
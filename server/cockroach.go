@@ -2,39 +2,83 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"time"
+	"unicode/utf8"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 /*
-	nfinite.space uses CockroachDB for a scalable, resilient SQL store. Here are the tables
-	and the corresponding schema along with the relationships.
+	nfinite.space uses CockroachDB for a scalable, resilient SQL store by default. Here are
+	the tables and the corresponding schema along with the relationships. The SQLite store
+	in sqlite.go has the same tables and columns, in the same order. Both are created and
+	evolved by the migrations in migrate.go, which also add indexes and uniqueness on
+	File (ownerId, name, version), FilePart (parentId, fileIndex), FilePart (name) and
+	PartLookup (partId, ownerId).
 
 	Database: nfinite
-	Tables: Client, File, FilePart, PartLookup
+	Tables: Client, File, FilePart, PartLookup, Challenge, SessionToken, PendingDeletion, Directory
 
 	Client: 	id SERIAL
 				username string PRIMARY KEY
-				password string
+				password string  (argon2id hash of the password, or its bare SHA-256 for Clients that haven't logged in since)
+				keySalt BYTES  (salt for deriving the key that wraps the Client's file keys)
+				badParts INT  (number of parts the Client has answered with corrupted data)
+				challengesPassed INT
+				challengesFailed INT
+				reliability FLOAT  (moving average of proof-of-storage challenge results, 1 is perfect)
 
 	File: 		id SERIAL PRIMARY KEY
 		 		modified INT
 		 		name string
 		  		ownerId INT
+				wrappedKey BYTES  (the File's encryption key, wrapped with the owner's password key)
 
 	FilePart:	id SERIAL PRIMARY KEY
 			 	parentId INT
 				name string
 			  	fileIndex INT  (sequence number of the file part when it was sharded)
+				kind INT  (0 for a data shard, 1 for a parity shard)
+				dataShards INT  (number of data shards the parent was split into)
+				parityShards INT  (number of parity shards generated for the parent)
+				size INT  (length in bytes of the parent before sharding)
+				replicas INT  (number of distinct Clients the part should be stored on)
+				partSize INT  (length in bytes of the part itself)
+				checksum string  (hex SHA-256 of the part's data)
+				stripeSize INT  (length in bytes of each stripe of the parent, 0 if it is a single stripe)
 
 	PartLookup: id SERIAL PRIMARY KEY
 				partId INT
 				ownerId INT  (the ID of the Client storing the part, not the original owner)
 
+	Challenge:	id SERIAL PRIMARY KEY
+				partId INT
+				nonce BYTES  (HMAC key the holder must use)
+				start INT  (offset into the part of the challenged byte range)
+				length INT
+				answer string  (hex HMAC-SHA256 of the range, precomputed at shard time)
+				used BOOL
+
+	SessionToken: id string PRIMARY KEY  (random ID sealed into the token, see token.go)
+				ownerId INT
+				created INT
+				expires INT
+				revoked BOOL
+				passwordKey BYTES  (owner's password key sealed with the token key, NULL once revoked)
+
+	PendingDeletion: id SERIAL PRIMARY KEY
+				holderId INT  (the ID of the Client that should delete the part)
+				partName string  (name of a part of a deleted File)
+
+	Directory:	id SERIAL PRIMARY KEY
+				ownerId INT
+				path string  (directory created with "mkdir", see directories.go)
+
 
-	Relationships:
+	Relationships, enforced by foreign keys that cascade deletes to the referencing rows:
 
     +------+  ownerId  +----+ parentId +--------+
     |Client| <-------- |File| <------  |FilePart|
@@ -45,14 +89,60 @@ import (
          1->many    +----------+  1->many
 */
 
-// Database is a wrapper around the sql.DB object. To be used as a singleton
-type Database struct {
+// SQLStore is a MetadataStore kept in a SQL database. The queries below are written for
+// CockroachDB and Postgres, rebind adapts their placeholders for other databases.
+type SQLStore struct {
 	*sql.DB
+	dialect string // picks the statements of each Migration
+	rebind  func(query string) string
+}
+
+// Exec runs query, rebound for the store's database, without returning any rows
+func (db *SQLStore) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.rebind(query), args...)
+}
+
+// Query runs query, rebound for the store's database, returning its rows
+func (db *SQLStore) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.rebind(query), args...)
+}
+
+// QueryRow runs query, rebound for the store's database, returning at most one row
+func (db *SQLStore) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.rebind(query), args...)
+}
+
+// sqlTx is a transaction on a SQLStore, its queries are rebound like the store's
+type sqlTx struct {
+	*sql.Tx
+	rebind func(query string) string
+}
+
+// begin starts a transaction on the store
+func (db *SQLStore) begin() (sqlTx, error) {
+	tx, err := db.Begin()
+	return sqlTx{tx, db.rebind}, err
+}
+
+// Exec runs query in the transaction without returning any rows
+func (tx sqlTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.rebind(query), args...)
+}
+
+// Query runs query in the transaction, returning its rows
+func (tx sqlTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.rebind(query), args...)
 }
 
-// NewDatabase returns a new Database object. Should only be called once.
-func NewDatabase() Database {
-	db, err := sql.Open("postgres", "postgresql://root@localhost:26257?sslcert=%2Fhome%2Fubuntu%2Fnode1.cert&sslkey=%2Fhome%2Fubuntu%2Fnode1.key&sslmode=verify-full&sslrootcert=%2Fhome%2Fubuntu%2Fca.cert")
+// QueryRow runs query in the transaction, returning at most one row
+func (tx sqlTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.rebind(query), args...)
+}
+
+// NewCockroachStore connects to the CockroachDB or Postgres cluster at dsn, creating the nfinite database if needed.
+// Should only be called once.
+func NewCockroachStore(dsn string) *SQLStore {
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		log.Fatalln("database connection:", err)
 	}
@@ -63,225 +153,1020 @@ func NewDatabase() Database {
 	if _, err := db.Exec("SET DATABASE = nfinite"); err != nil {
 		log.Fatal(err)
 	}
+	return &SQLStore{db, dialectCockroach, func(query string) string { return query }}
+}
 
-	if _, err = db.Exec("CREATE TABLE IF NOT EXISTS PartLookup (id SERIAL PRIMARY KEY, partId INT, ownerId INT);"); err != nil {
-		log.Fatal(err)
+// CreateClient inserts Client c into the store, failing with ErrConflict if its username is taken
+func (db *SQLStore) CreateClient(c Client) error {
+	res, err := db.Exec("INSERT INTO Client (username, password) VALUES ($1, $2) ON CONFLICT (username) DO NOTHING", c.username, c.password)
+	if err != nil {
+		return err
 	}
-
-	if _, err = db.Exec("CREATE TABLE IF NOT EXISTS FilePart (parentId INT, name string, id SERIAL PRIMARY KEY, fileIndex INT);"); err != nil {
-		log.Fatal(err)
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("username %s is taken: %w", c.username, ErrConflict)
 	}
+	return nil
+}
 
-	if _, err = db.Exec("CREATE TABLE IF NOT EXISTS Client (id SERIAL, username string PRIMARY KEY, password string);"); err != nil {
-		log.Fatal(err)
+// LookupClient returns the Client with username along with its password hash
+func (db *SQLStore) LookupClient(username string) (Client, error) {
+	c := Client{username: username}
+	err := db.QueryRow("SELECT password FROM Client WHERE username=$1", username).Scan(&c.password)
+	if err == sql.ErrNoRows {
+		return Client{}, fmt.Errorf("client %s: %w", username, ErrNotFound)
 	}
+	return c, err
+}
 
-	if _, err = db.Exec("CREATE TABLE IF NOT EXISTS File (id SERIAL PRIMARY KEY, modified INT, name string, ownerId INT);"); err != nil {
-		log.Fatal(err)
+// SetPasswordHash replaces the stored password hash of Client c
+func (db *SQLStore) SetPasswordHash(c Client, passwordHash string) error {
+	res, err := db.Exec("UPDATE Client SET password=$1 WHERE username=$2", passwordHash, c.username)
+	return expectRow(res, err, "client "+c.username)
+}
+
+// ClientsFiles returns the current version of every File belonging to the Client c whose name starts with prefix
+func (db *SQLStore) ClientsFiles(prefix string, c Client) ([]File, error) {
+	dbFs, err := db.dbFilesForClient(prefix, c)
+	if err != nil {
+		return nil, err
 	}
-	return Database{db}
+	var files []File
+	for _, dbF := range dbFs {
+		files = append(files, dbF.file())
+	}
+	return files, nil
 }
 
-// AddClient inserts Client c into database db
-func (db *Database) AddClient(c Client) {
-	if _, err := db.Exec("INSERT INTO Client (username, password) VALUES ($1, $2) ON CONFLICT (username) DO NOTHING", c.username, c.password); err != nil {
-		log.Fatalln("insert client:", err)
+// GetFile returns version of Client c's File with name, the current version if version is 0
+func (db *SQLStore) GetFile(name string, version int, c Client) (File, error) {
+	f := File{version: version}
+	f.name = name
+	dbF, err := db.dbFileForClientFile(f, c)
+	if err != nil {
+		return File{}, err
 	}
+	return dbF.file(), nil
 }
 
-// ClientsFiles returns a slice of Files belonging to the Client c
-func (db *Database) ClientsFiles(c Client) []File {
-	dbFs := db.dbFilesForClient(c)
+// FileVersions returns every version of Client c's File with name, newest first
+func (db *SQLStore) FileVersions(name string, c Client) ([]File, error) {
+	dbC, err := db.dbClientForClient(c)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT * FROM File WHERE name=$1 AND ownerId=$2 ORDER BY version DESC", name, dbC.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 	var files []File
-	for _, dbF := range dbFs {
-		f := File{}
-		f.name = dbF.name
-		f.modified = time.Unix(int64(dbF.modified), 0)
-		files = append(files, f)
+	for rows.Next() {
+		dbF, err := NewDbFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, dbF.file())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("file %s: %w", name, ErrNotFound)
 	}
-	return files
+	return files, nil
 }
 
-// GetFile returns a File from the database for a given name and Client c
-func (db *Database) GetFile(name string, c Client) File {
-	f := File{}
-	f.name = name
-	dbF := db.dbFileForClientFile(f, c)
-	f.modified = time.Unix(int64(dbF.modified), 0)
-	return f
+// RestoreVersion makes owner's version f.version of File f the current one, by renumbering it after the newest.
+// Returns the restored File.
+func (db *SQLStore) RestoreVersion(f File, owner Client) (File, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return File{}, err
+	}
+	restored, err := restoreVersion(tx, f, owner)
+	if err != nil {
+		tx.Rollback()
+		return File{}, storeError(err)
+	}
+	return restored, storeError(tx.Commit())
+}
+
+// KeySaltForClient returns the salt for deriving Client c's password key, creating one if c has none yet
+func (db *SQLStore) KeySaltForClient(c Client) ([]byte, error) {
+	dbC, err := db.dbClientForClient(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(dbC.keySalt) > 0 {
+		return dbC.keySalt, nil
+	}
+	salt, err := NewKeySalt()
+	if err != nil {
+		return nil, err
+	}
+	// Only set the salt if nobody beat us to it, then read back whichever one won
+	if _, err := db.Exec("UPDATE Client SET keySalt=$1 WHERE id=$2 AND keySalt IS NULL", salt, dbC.id); err != nil {
+		return nil, err
+	}
+	if dbC, err = db.dbClientForClient(c); err != nil {
+		return nil, err
+	}
+	return dbC.keySalt, nil
 }
 
 // DoesFileExist checks if the File f exists for Client c
-func (db *Database) DoesFileExist(f File, c Client) bool {
-	dbC := db.dbClientForClient(c)
+func (db *SQLStore) DoesFileExist(f File, c Client) (bool, error) {
+	dbC, err := db.dbClientForClient(c)
+	if err != nil {
+		return false, err
+	}
 	var count uint64
 	const countSQL = `
 	SELECT COUNT(id) FROM File WHERE name=$1 AND ownerId=$2`
 	if err := db.QueryRow(countSQL, f.name, dbC.id).Scan(&count); err != nil {
-		log.Println("checking if file saved:", err)
-		return false
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// SaveUpload records File f of owner along with its parts, their holders and challenges in one transaction.
+// Fails with ErrConflict if owner already has that version of f, or if its name is one of owner's
+// directories or runs through one of owner's Files, see checkPath.
+func (db *SQLStore) SaveUpload(f File, owner Client, parts []PlacedPart) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	if err := saveUpload(tx, f, owner, parts); err != nil {
+		tx.Rollback()
+		return storeError(err)
+	}
+	return storeError(tx.Commit())
+}
+
+// DeleteFile removes version f.version of owner's File f, or every version if it is 0, along with
+// their parts and lookups. In the same transaction it queues a PendingDeletion for every Client
+// that held one of the parts. Returns those Clients.
+func (db *SQLStore) DeleteFile(f File, owner Client) ([]Client, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	holders, err := deleteFile(tx, f, owner)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return holders, tx.Commit()
+}
+
+// MakeDirectory creates directory path for owner, failing with ErrConflict if the path is taken
+func (db *SQLStore) MakeDirectory(path string, owner Client) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	if err := makeDirectory(tx, path, owner); err != nil {
+		tx.Rollback()
+		return storeError(err)
+	}
+	return storeError(tx.Commit())
+}
+
+// RemoveDirectory removes owner's directory path made with MakeDirectory, failing with ErrConflict if it isn't empty
+func (db *SQLStore) RemoveDirectory(path string, owner Client) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	if err := removeDirectory(tx, path, owner); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Directories returns the paths starting with prefix of the directories owner made with MakeDirectory
+func (db *SQLStore) Directories(prefix string, owner Client) ([]string, error) {
+	dbC, err := db.dbClientForClient(owner)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT path FROM Directory WHERE ownerId=$1 AND substr(path, 1, $2)=$3", dbC.id, utf8.RuneCountInString(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// Move renames every version of owner's File from, or the directory from and everything under it, to to.
+// Fails with ErrConflict if to is taken.
+func (db *SQLStore) Move(from, to string, owner Client) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	if err := move(tx, from, to, owner); err != nil {
+		tx.Rollback()
+		return storeError(err)
+	}
+	return storeError(tx.Commit())
+}
+
+// PendingDeletions returns the names of the parts Client holder still has to be told to delete
+func (db *SQLStore) PendingDeletions(holder Client) ([]string, error) {
+	const pendingSQL = `
+	SELECT PendingDeletion.partName FROM PendingDeletion
+	JOIN Client ON Client.id = PendingDeletion.holderId
+	WHERE Client.username=$1
+	ORDER BY PendingDeletion.id ASC`
+	rows, err := db.Query(pendingSQL, holder.username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// QueuePendingDeletion records that Client holder has to be told to delete the part called partName
+func (db *SQLStore) QueuePendingDeletion(holder Client, partName string) error {
+	dbC, err := db.dbClientForClient(holder)
+	if err != nil {
+		return err
+	}
+	const queueSQL = `
+	INSERT INTO PendingDeletion (holderId, partName) VALUES ($1, $2)
+	ON CONFLICT (holderId, partName) DO NOTHING`
+	_, err = db.Exec(queueSQL, dbC.id, partName)
+	return err
+}
+
+// ClearPendingDeletion forgets that Client holder has to be told to delete the part called partName
+func (db *SQLStore) ClearPendingDeletion(holder Client, partName string) error {
+	dbC, err := db.dbClientForClient(holder)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM PendingDeletion WHERE holderId=$1 AND partName=$2", dbC.id, partName)
+	return err
+}
+
+// AddPartHolders adds a file part lookup for every storer of the already saved FilePart fp
+func (db *SQLStore) AddPartHolders(fp FilePart, storers ...Client) error {
+	dbFp, err := db.dbFilePartFromFilePart(fp)
+	if err != nil {
+		return err
+	}
+	for _, storer := range storers {
+		dbC, err := db.dbClientForClient(storer)
+		if err != nil {
+			return err
+		}
+		if err := db.savePartLookup(dbFp, dbC); err != nil {
+			return err
+		}
+		if _, err := db.Exec("DELETE FROM PendingDeletion WHERE holderId=$1 AND partName=$2", dbC.id, dbFp.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemovePartHolder deletes the file part lookup saying holder stores the FilePart fp and, in the
+// same transaction, queues a PendingDeletion so holder drops its copy when it is next told
+func (db *SQLStore) RemovePartHolder(fp FilePart, holder Client) error {
+	dbFp, err := db.dbFilePartFromFilePart(fp)
+	if err != nil {
+		return err
+	}
+	dbC, err := db.dbClientForClient(holder)
+	if err != nil {
+		return err
+	}
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM PartLookup WHERE partId=$1 AND ownerId=$2", dbFp.id, dbC.id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		tx.Rollback()
+		return err
+	} else if n > 0 {
+		const queueSQL = `
+		INSERT INTO PendingDeletion (holderId, partName) VALUES ($1, $2)
+		ON CONFLICT (holderId, partName) DO NOTHING`
+		if _, err := tx.Exec(queueSQL, dbC.id, fp.name); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("queue part deletion: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// RecordBadPart counts another corrupted part served by Client c, returning c's new total
+func (db *SQLStore) RecordBadPart(c Client) (int, error) {
+	var badParts int
+	err := db.QueryRow("UPDATE Client SET badParts = badParts + 1 WHERE username=$1 RETURNING badParts", c.username).Scan(&badParts)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("client %s: %w", c.username, ErrNotFound)
 	}
-	return count > 0
+	return badParts, err
 }
 
-// InsertFile inserts File f from Client c into the database
-func (db *Database) InsertFile(f File, c Client) {
-	dbC := db.dbClientForClient(c)
-	db.insertFileForDbClient(f, dbC)
+// InsertSessionToken records a newly issued SessionToken
+func (db *SQLStore) InsertSessionToken(st SessionToken) error {
+	dbC, err := db.dbClientForClient(st.owner)
+	if err != nil {
+		return err
+	}
+	const insertSQL = `
+	INSERT INTO SessionToken (id, ownerId, created, expires, passwordKey) VALUES ($1, $2, $3, $4, $5)`
+	_, err = db.Exec(insertSQL, st.id, dbC.id, st.created.Unix(), st.expires.Unix(), st.key)
+	return storeError(err)
 }
 
-// AddFilePart inserts the FilePart fp for owner and storer. It will also update the file part lookup table.
-func (db *Database) AddFilePart(fp FilePart, owner Client, storer Client) {
-	dbC := db.dbClientForClient(storer)
-	db.insertFilePart(fp, owner, dbC)
-	dbFp := db.dbFilePartFromFilePart(fp)
-	db.savePartLookup(dbFp, dbC)
+// SessionTokenKey gets the sealed password key of Client c's session token with id.
+// Fails with ErrNotFound unless the token is c's and neither revoked nor expired.
+func (db *SQLStore) SessionTokenKey(id string, c Client) ([]byte, error) {
+	const keySQL = `
+	SELECT SessionToken.passwordKey FROM SessionToken
+	JOIN Client ON Client.id = SessionToken.ownerId
+	WHERE SessionToken.id=$1 AND Client.username=$2 AND NOT SessionToken.revoked AND SessionToken.expires > $3`
+	var key []byte
+	err := db.QueryRow(keySQL, id, c.username, time.Now().Unix()).Scan(&key)
+	if err == sql.ErrNoRows || (err == nil && key == nil) {
+		return nil, fmt.Errorf("session token %s: %w", id, ErrNotFound)
+	}
+	return key, err
+}
+
+// ActiveSessionTokens returns Client c's session tokens that are neither revoked nor expired
+func (db *SQLStore) ActiveSessionTokens(c Client) ([]SessionToken, error) {
+	const activeSQL = `
+	SELECT SessionToken.id, SessionToken.created, SessionToken.expires FROM SessionToken
+	JOIN Client ON Client.id = SessionToken.ownerId
+	WHERE Client.username=$1 AND NOT SessionToken.revoked AND SessionToken.expires > $2
+	ORDER BY SessionToken.created ASC`
+	rows, err := db.Query(activeSQL, c.username, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []SessionToken
+	for rows.Next() {
+		var id string
+		var created, expires int64
+		if err := rows.Scan(&id, &created, &expires); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, SessionToken{id, c, time.Unix(created, 0), time.Unix(expires, 0), nil})
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeSessionToken revokes Client c's session token with id and deletes its password key,
+// failing with ErrNotFound if c has no such token
+func (db *SQLStore) RevokeSessionToken(id string, c Client) error {
+	dbC, err := db.dbClientForClient(c)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec("UPDATE SessionToken SET revoked=true, passwordKey=NULL WHERE id=$1 AND ownerId=$2", id, dbC.id)
+	return expectRow(res, err, "session token "+id)
+}
+
+// PurgeSessionTokens deletes every session token revoked or expired by now, returning how many it deleted
+func (db *SQLStore) PurgeSessionTokens(now time.Time) (int, error) {
+	res, err := db.Exec("DELETE FROM SessionToken WHERE revoked OR expires <= $1", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// TakeChallengeForHolder picks an unused Challenge for one of the parts Client c stores and marks it used.
+// Fails with ErrNotFound if there is none left.
+func (db *SQLStore) TakeChallengeForHolder(c Client) (Challenge, error) {
+	const pickSQL = `
+	SELECT Challenge.id, FilePart.name, Challenge.nonce, Challenge.start, Challenge.length, Challenge.answer FROM Challenge
+	JOIN FilePart ON FilePart.id = Challenge.partId
+	JOIN PartLookup ON PartLookup.partId = Challenge.partId
+	JOIN Client ON Client.id = PartLookup.ownerId
+	WHERE Client.username=$1 AND NOT Challenge.used
+	ORDER BY random() LIMIT 1`
+	var ch Challenge
+	err := db.QueryRow(pickSQL, c.username).Scan(&ch.id, &ch.partName, &ch.nonce, &ch.start, &ch.length, &ch.answer)
+	if err == sql.ErrNoRows {
+		return Challenge{}, fmt.Errorf("challenge for %s: %w", c.username, ErrNotFound)
+	} else if err != nil {
+		return Challenge{}, err
+	}
+	if _, err := db.Exec("UPDATE Challenge SET used = true WHERE id=$1", ch.id); err != nil {
+		return Challenge{}, err
+	}
+	return ch, nil
+}
+
+// RecordChallengeResult updates Client c's challenge counts and reliability score
+func (db *SQLStore) RecordChallengeResult(c Client, passed bool) error {
+	const passSQL = `
+	UPDATE Client SET challengesPassed = challengesPassed + 1, reliability = reliability * $2 + (1 - $2) WHERE username=$1`
+	const failSQL = `
+	UPDATE Client SET challengesFailed = challengesFailed + 1, reliability = reliability * $2 WHERE username=$1`
+	query := failSQL
+	if passed {
+		query = passSQL
+	}
+	res, err := db.Exec(query, c.username, reliabilityDecay)
+	return expectRow(res, err, "client "+c.username)
+}
+
+// Clients returns every Client registered with nfinite.space
+func (db *SQLStore) Clients() ([]Client, error) {
+	rows, err := db.Query("SELECT username, password FROM Client")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var clients []Client
+	for rows.Next() {
+		var c Client
+		if err := rows.Scan(&c.username, &c.password); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
 }
 
 // FilePartRequestsForFile returns a slice of FilePartRequests for a given Client c and File f
-func (db *Database) FilePartRequestsForFile(f File, owner Client) []FilePartRequest {
-	dbF := db.dbFileForClientFile(f, owner)
-	dbFParts := db.dbFilePartsForDbFile(dbF)
+func (db *SQLStore) FilePartRequestsForFile(f File, owner Client) ([]FilePartRequest, error) {
+	dbF, err := db.dbFileForClientFile(f, owner)
+	if err != nil {
+		return nil, err
+	}
+	dbFParts, err := db.dbFilePartsForDbFile(dbF)
+	if err != nil {
+		return nil, err
+	}
 	var reqs []FilePartRequest
 	for _, p := range dbFParts {
-		dbOwners := db.dbClientsForDbFilePart(p)
+		dbOwners, err := db.dbClientsForDbFilePart(p)
+		if err != nil {
+			return nil, err
+		}
 		var owners []Client
 		for _, o := range dbOwners {
 			owners = append(owners, Client{o.username, o.password})
 		}
-		fp := FilePart{parent: f, index: p.fileIndex}
+		fp := FilePart{parent: f, index: p.fileIndex, kind: ShardKind(p.kind), coding: p.coding(), replicas: p.replicas, checksum: p.checksum}
 		fp.name = p.name
 		fp.modified = f.modified
 		reqs = append(reqs, FilePartRequest{owners, fp})
 	}
-	return reqs
+	return reqs, nil
+}
+
+// StoredBytesByClient returns how many bytes of other users' parts each Client stores, keyed by username
+func (db *SQLStore) StoredBytesByClient() (map[string]int, error) {
+	const storedSQL = `
+	SELECT Client.username, SUM(FilePart.partSize) FROM PartLookup
+	JOIN FilePart ON FilePart.id = PartLookup.partId
+	JOIN Client ON Client.id = PartLookup.ownerId
+	GROUP BY Client.username`
+	rows, err := db.Query(storedSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stored := map[string]int{}
+	for rows.Next() {
+		var username string
+		var bytes int
+		if err := rows.Scan(&username, &bytes); err != nil {
+			return nil, err
+		}
+		stored[username] = bytes
+	}
+	return stored, rows.Err()
+}
+
+// StorageUsage returns how many bytes of parts Client c has given to and received from its peers, see quota.go
+func (db *SQLStore) StorageUsage(c Client) (StorageUsage, error) {
+	dbC, err := db.dbClientForClient(c)
+	if err != nil {
+		return StorageUsage{}, err
+	}
+	const usageSQL = `
+	SELECT
+		COALESCE(SUM(CASE WHEN PartLookup.ownerId = $1 AND File.ownerId <> $1 THEN FilePart.partSize ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN File.ownerId = $1 THEN FilePart.partSize ELSE 0 END), 0)
+	FROM PartLookup
+	JOIN FilePart ON FilePart.id = PartLookup.partId
+	JOIN File ON File.id = FilePart.parentId
+	WHERE PartLookup.ownerId = $1 OR File.ownerId = $1`
+	var u StorageUsage
+	err = db.QueryRow(usageSQL, dbC.id).Scan(&u.given, &u.received)
+	return u, err
 }
 
 // dbClientForClient gets the saved DbClient for Client c
-func (db *Database) dbClientForClient(c Client) DbClient {
+func (db *SQLStore) dbClientForClient(c Client) (DbClient, error) {
 	rows, err := db.Query("SELECT * FROM Client WHERE username=$1", c.username)
 	if err != nil {
-		log.Fatalln("Unable to get client for username", c.username, ":", err)
+		return DbClient{}, err
 	}
 	defer rows.Close()
 	if !rows.Next() {
-		log.Fatalln("No row for username", c.username)
+		return DbClient{}, notFound(rows, "client "+c.username)
 	}
 	return NewDbClient(rows)
 }
 
 // dbClientForID gets the saved DbClient for the provided ID
-func (db *Database) dbClientForID(id int) DbClient {
+func (db *SQLStore) dbClientForID(id int) (DbClient, error) {
 	rows, err := db.Query("SELECT * FROM Client WHERE id=$1", id)
 	if err != nil {
-		log.Fatalln("Unable to get client for id", id, ":", err)
+		return DbClient{}, err
 	}
 	defer rows.Close()
 	if !rows.Next() {
-		log.Fatalln("No row for id", id)
+		return DbClient{}, notFound(rows, fmt.Sprint("client id ", id))
 	}
 	return NewDbClient(rows)
 }
 
-// insertFilePart inserts relevant metadata about the storing of a FilePart
-func (db *Database) insertFilePart(fp FilePart, owner Client, storer DbClient) {
-	dbF := db.dbFileForClientFile(fp.parent, owner)
-	if _, err := db.Exec("INSERT INTO FilePart (parentId, name, fileIndex) VALUES ($1, $2, $3)", dbF.id, fp.name, fp.index); err != nil {
-		log.Println("save file part:", err)
-	}
-}
-
 // dbFilePartFromFilePath gets the DbFilePart corresponding to the provided FilePart from the database
-func (db *Database) dbFilePartFromFilePart(fp FilePart) DbFilePart {
+func (db *SQLStore) dbFilePartFromFilePart(fp FilePart) (DbFilePart, error) {
 	rows, err := db.Query("SELECT * FROM FilePart WHERE name=$1 AND fileIndex=$2", fp.name, fp.index)
 	if err != nil {
-		log.Fatalln("Unable to get file path for name", fp.name, ":", err)
+		return DbFilePart{}, err
 	}
 	defer rows.Close()
 	if !rows.Next() {
-		log.Fatalln("No row for file path", fp.name)
+		return DbFilePart{}, notFound(rows, fmt.Sprint("file part ", fp.name, " ", fp.index))
 	}
 	return NewDbFilePart(rows)
-
 }
 
 // dbFilePartsForDbFile returns a slice of DbFileParts from the database whose parent File is f
-func (db *Database) dbFilePartsForDbFile(f DbFile) []DbFilePart {
-	var parts []DbFilePart
+func (db *SQLStore) dbFilePartsForDbFile(f DbFile) ([]DbFilePart, error) {
 	rows, err := db.Query("SELECT * FROM FilePart WHERE parentId=$1 ORDER BY fileIndex ASC", f.id)
 	if err != nil {
-		log.Fatalln("Unable to get file part for file id", f.id, ":", err)
+		return nil, err
 	}
 	defer rows.Close()
+	var parts []DbFilePart
 	for rows.Next() {
-		parts = append(parts, NewDbFilePart(rows))
+		p, err := NewDbFilePart(rows)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
 	}
-	return parts
+	return parts, rows.Err()
 }
 
 // savePartLookup inserts a new file part lookup for the many-to-many relationship between Clients and FileParts
-func (db *Database) savePartLookup(dbFp DbFilePart, dbC DbClient) {
-	if _, err := db.Exec("INSERT INTO PartLookup (partId, ownerId) VALUES ($1, $2)", dbFp.id, dbC.id); err != nil {
-		log.Println("save part lookup:", err)
-	}
+func (db *SQLStore) savePartLookup(dbFp DbFilePart, dbC DbClient) error {
+	_, err := db.Exec("INSERT INTO PartLookup (partId, ownerId) VALUES ($1, $2) ON CONFLICT (partId, ownerId) DO NOTHING", dbFp.id, dbC.id)
+	return err
 }
 
 // dbClientsForDbFilePart returns a slice of DbClients that store a particular FilePart
-func (db *Database) dbClientsForDbFilePart(dbFp DbFilePart) []DbClient {
+func (db *SQLStore) dbClientsForDbFilePart(dbFp DbFilePart) ([]DbClient, error) {
 	rows, err := db.Query("SELECT ownerId FROM PartLookup WHERE partId=$1", dbFp.id)
 	if err != nil {
-		log.Fatalln("Unable to get file for name", dbFp.name, ":", err)
+		return nil, err
 	}
-	var dbClients []DbClient
 	ids := []int{}
 	for rows.Next() {
 		var id int
 		if err := rows.Scan(&id); err != nil {
-			log.Println("client from file part lookup:", err)
+			rows.Close()
+			return nil, err
 		}
 		ids = append(ids, id)
 	}
 	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var dbClients []DbClient
 	for _, id := range ids {
-		dbClients = append(dbClients, db.dbClientForID(id))
+		dbC, err := db.dbClientForID(id)
+		if err != nil {
+			return nil, err
+		}
+		dbClients = append(dbClients, dbC)
 	}
-
-	return dbClients
+	return dbClients, nil
 }
 
-// dbFilesForClient gets a slice of all the DbFiles a Client stores with nfinite.space
-func (db *Database) dbFilesForClient(owner Client) []DbFile {
-	dbC := db.dbClientForClient(owner)
-	rows, err := db.Query("SELECT * FROM File WHERE ownerId=$1", dbC.id)
+// dbFilesForClient gets a slice of the current version of every DbFile a Client stores with nfinite.space
+// whose name starts with prefix
+func (db *SQLStore) dbFilesForClient(prefix string, owner Client) ([]DbFile, error) {
+	dbC, err := db.dbClientForClient(owner)
+	if err != nil {
+		return nil, err
+	}
+	const currentSQL = `
+	SELECT * FROM File WHERE ownerId=$1 AND substr(name, 1, $2)=$3
+	AND version = (SELECT MAX(newest.version) FROM File AS newest WHERE newest.ownerId = File.ownerId AND newest.name = File.name)`
+	rows, err := db.Query(currentSQL, dbC.id, utf8.RuneCountInString(prefix), prefix)
 	if err != nil {
-		log.Fatalln("Unable to get file for owner", owner.username, ":", err)
+		return nil, err
 	}
 	defer rows.Close()
 	var dbFiles []DbFile
 	for rows.Next() {
-		dbFiles = append(dbFiles, NewDbFile(rows))
+		dbF, err := NewDbFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		dbFiles = append(dbFiles, dbF)
 	}
-	return dbFiles
-
+	return dbFiles, rows.Err()
 }
 
-// dbFileForClientFile returns the corresponding DbFile for a Client c's File f
-func (db *Database) dbFileForClientFile(f File, c Client) DbFile {
-	dbC := db.dbClientForClient(c)
-	rows, err := db.Query("SELECT * FROM File WHERE name=$1 AND ownerId=$2", f.name, dbC.id)
+// dbFileForClientFile returns the corresponding DbFile for a Client c's File f, its current version if f.version is 0
+func (db *SQLStore) dbFileForClientFile(f File, c Client) (DbFile, error) {
+	dbC, err := db.dbClientForClient(c)
+	if err != nil {
+		return DbFile{}, err
+	}
+	var rows *sql.Rows
+	if f.version == 0 {
+		rows, err = db.Query("SELECT * FROM File WHERE name=$1 AND ownerId=$2 ORDER BY version DESC LIMIT 1", f.name, dbC.id)
+	} else {
+		rows, err = db.Query("SELECT * FROM File WHERE name=$1 AND ownerId=$2 AND version=$3", f.name, dbC.id, f.version)
+	}
 	if err != nil {
-		log.Fatalln("Unable to get file for name", f.name, ":", err)
+		return DbFile{}, err
 	}
 	defer rows.Close()
 	if !rows.Next() {
-		log.Fatalln("No row for file", f.name)
+		return DbFile{}, notFound(rows, fileWhat(f))
 	}
 	return NewDbFile(rows)
 }
 
-// insertFileForDbClient inserts File f into the database for a given DbClient
-func (db *Database) insertFileForDbClient(f File, dbC DbClient) {
-	if _, err := db.Exec("INSERT INTO File (modified, name, ownerId) VALUES ($1, $2, $3)", f.modified.Unix(), f.name, dbC.id); err != nil {
-		log.Println("insert file for db client:", err)
+// fileWhat names File f in errors, with its version if it has one
+func fileWhat(f File) string {
+	if f.version == 0 {
+		return "file " + f.name
+	}
+	return fmt.Sprintf("version %d of file %s", f.version, f.name)
+}
+
+// notFound returns the error of rows that ended before their first row, ErrNotFound if they simply had none
+func notFound(rows *sql.Rows, what string) error {
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s: %w", what, ErrNotFound)
+}
+
+// expectRow checks the result of a statement changing a single row, failing with ErrNotFound if there was none
+func expectRow(res sql.Result, err error, what string) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%s: %w", what, ErrNotFound)
+	}
+	return nil
+}
+
+// storeError wraps err as ErrConflict if the database refused it for breaking a uniqueness constraint
+func storeError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return fmt.Errorf("%v: %w", err, ErrConflict)
+	}
+	if sqliteUniqueViolation(err) {
+		return fmt.Errorf("%v: %w", err, ErrConflict)
+	}
+	return err
+}
+
+// saveUpload inserts the rows of SaveUpload in transaction tx
+func saveUpload(tx sqlTx, f File, owner Client, parts []PlacedPart) error {
+	clientIDs := map[string]int{}
+	clientID := func(c Client) (int, error) {
+		if id, ok := clientIDs[c.username]; ok {
+			return id, nil
+		}
+		var id int
+		err := tx.QueryRow("SELECT id FROM Client WHERE username=$1", c.username).Scan(&id)
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("client %s: %w", c.username, ErrNotFound)
+		} else if err != nil {
+			return 0, err
+		}
+		clientIDs[c.username] = id
+		return id, nil
+	}
+
+	ownerID, err := clientID(owner)
+	if err != nil {
+		return err
+	}
+	if err := checkPath(tx, ownerID, f.name, true); err != nil {
+		return err
+	}
+	var fileID int
+	const fileSQL = `
+	INSERT INTO File (modified, name, ownerId, wrappedKey, version, uploaded) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	if err := tx.QueryRow(fileSQL, f.modified.Unix(), f.name, ownerID, f.wrappedKey, f.version, f.uploaded.Unix()).Scan(&fileID); err != nil {
+		return fmt.Errorf("insert file: %w", err)
+	}
+	for _, p := range parts {
+		fp, c := p.part, p.part.coding
+		var partID int
+		const partSQL = `
+		INSERT INTO FilePart (parentId, name, fileIndex, kind, dataShards, parityShards, size, replicas, partSize, checksum, stripeSize) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`
+		if err := tx.QueryRow(partSQL, fileID, fp.name, fp.index, int(fp.kind), c.dataShards, c.parityShards, c.size, fp.replicas, fp.size, fp.checksum, c.stripeSize).Scan(&partID); err != nil {
+			return fmt.Errorf("insert part %d: %w", fp.index, err)
+		}
+		for _, h := range p.holders {
+			holderID, err := clientID(h)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("INSERT INTO PartLookup (partId, ownerId) VALUES ($1, $2) ON CONFLICT (partId, ownerId) DO NOTHING", partID, holderID); err != nil {
+				return fmt.Errorf("insert part lookup: %w", err)
+			}
+			if _, err := tx.Exec("DELETE FROM PendingDeletion WHERE holderId=$1 AND partName=$2", holderID, fp.name); err != nil {
+				return fmt.Errorf("cancel part deletion: %w", err)
+			}
+		}
+		for _, ch := range p.challenges {
+			const challengeSQL = `
+			INSERT INTO Challenge (partId, nonce, start, length, answer) VALUES ($1, $2, $3, $4, $5)`
+			if _, err := tx.Exec(challengeSQL, partID, ch.nonce, ch.start, ch.length, ch.answer); err != nil {
+				return fmt.Errorf("insert challenge: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteFile deletes the rows of DeleteFile in transaction tx
+func deleteFile(tx sqlTx, f File, owner Client) ([]Client, error) {
+	const fileSQL = `
+	SELECT File.id FROM File
+	JOIN Client ON Client.id = File.ownerId
+	WHERE File.name=$1 AND Client.username=$2 AND (File.version=$3 OR $3=0)`
+	rows, err := tx.Query(fileSQL, f.name, owner.username, f.version)
+	if err != nil {
+		return nil, err
+	}
+	var fileIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fileIDs = append(fileIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(fileIDs) == 0 {
+		return nil, fmt.Errorf("%s: %w", fileWhat(f), ErrNotFound)
+	}
+
+	var holders []Client
+	held := map[string]bool{}
+	for _, fileID := range fileIDs {
+		const queueSQL = `
+		INSERT INTO PendingDeletion (holderId, partName)
+		SELECT DISTINCT PartLookup.ownerId, FilePart.name FROM PartLookup
+		JOIN FilePart ON FilePart.id = PartLookup.partId
+		WHERE FilePart.parentId=$1
+		ON CONFLICT (holderId, partName) DO NOTHING`
+		if _, err := tx.Exec(queueSQL, fileID); err != nil {
+			return nil, fmt.Errorf("queue part deletions: %w", err)
+		}
+		const holdersSQL = `
+		SELECT DISTINCT Client.username FROM PartLookup
+		JOIN FilePart ON FilePart.id = PartLookup.partId
+		JOIN Client ON Client.id = PartLookup.ownerId
+		WHERE FilePart.parentId=$1`
+		rows, err := tx.Query(holdersSQL, fileID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var c Client
+			if err := rows.Scan(&c.username); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if !held[c.username] {
+				held[c.username] = true
+				holders = append(holders, c)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		// The foreign keys cascade to the File's parts, their lookups and challenges
+		if _, err := tx.Exec("DELETE FROM File WHERE id=$1", fileID); err != nil {
+			return nil, fmt.Errorf("delete file: %w", err)
+		}
+	}
+	return holders, nil
+}
+
+// restoreVersion renumbers the File of RestoreVersion in transaction tx
+func restoreVersion(tx sqlTx, f File, owner Client) (File, error) {
+	var ownerID, newest int
+	const newestSQL = `
+	SELECT Client.id, MAX(File.version) FROM File
+	JOIN Client ON Client.id = File.ownerId
+	WHERE File.name=$1 AND Client.username=$2
+	GROUP BY Client.id`
+	err := tx.QueryRow(newestSQL, f.name, owner.username).Scan(&ownerID, &newest)
+	if err == sql.ErrNoRows {
+		return File{}, fmt.Errorf("file %s: %w", f.name, ErrNotFound)
+	} else if err != nil {
+		return File{}, err
+	}
+	now := time.Now()
+	const restoreSQL = `
+	UPDATE File SET version=$1, uploaded=$2 WHERE name=$3 AND ownerId=$4 AND version=$5 AND version<>$6`
+	res, err := tx.Exec(restoreSQL, newest+1, now.Unix(), f.name, ownerID, f.version, newest)
+	if err != nil {
+		return File{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return File{}, err
+	} else if n == 0 && f.version != newest {
+		return File{}, fmt.Errorf("%s: %w", fileWhat(f), ErrNotFound)
+	}
+
+	var dbF DbFile
+	const restoredSQL = `
+	SELECT id, modified, name, ownerId, wrappedKey, version, uploaded FROM File WHERE name=$1 AND ownerId=$2 ORDER BY version DESC LIMIT 1`
+	err = tx.QueryRow(restoredSQL, f.name, ownerID).Scan(&dbF.id, &dbF.modified, &dbF.name, &dbF.ownerID, &dbF.wrappedKey, &dbF.version, &dbF.uploaded)
+	return dbF.file(), err
+}
+
+// ownerID gets the ID of Client c in transaction tx
+func ownerID(tx sqlTx, c Client) (int, error) {
+	var id int
+	err := tx.QueryRow("SELECT id FROM Client WHERE username=$1", c.username).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("client %s: %w", c.username, ErrNotFound)
+	}
+	return id, err
+}
+
+// countUnder counts the Files and made directories of the Client with ownerID under directory dir, in transaction tx
+func countUnder(tx sqlTx, ownerID int, dir string) (int, error) {
+	const underSQL = `
+	SELECT (SELECT COUNT(*) FROM Directory WHERE ownerId=$1 AND substr(path, 1, $2)=$3)
+		+ (SELECT COUNT(*) FROM File WHERE ownerId=$1 AND substr(name, 1, $2)=$3)`
+	var n int
+	err := tx.QueryRow(underSQL, ownerID, utf8.RuneCountInString(dirPrefix(dir)), dirPrefix(dir)).Scan(&n)
+	return n, err
+}
+
+// checkPath fails with ErrConflict if the Client with ownerID can't give path to a new File, or a
+// new directory if isFile is false, in transaction tx. Files can take the path of a File, as a new version.
+func checkPath(tx sqlTx, ownerID int, path string, isFile bool) error {
+	for _, parent := range parentDirs(path) {
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM File WHERE ownerId=$1 AND name=$2", ownerID, parent).Scan(&n); err != nil {
+			return err
+		} else if n > 0 {
+			return fmt.Errorf("%s is a file: %w", parent, ErrConflict)
+		}
+	}
+	var made int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM Directory WHERE ownerId=$1 AND path=$2", ownerID, path).Scan(&made); err != nil {
+		return err
+	}
+	under, err := countUnder(tx, ownerID, path)
+	if err != nil {
+		return err
+	} else if made+under > 0 {
+		return fmt.Errorf("directory %s: %w", path, ErrConflict)
+	}
+	if !isFile {
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM File WHERE ownerId=$1 AND name=$2", ownerID, path).Scan(&n); err != nil {
+			return err
+		} else if n > 0 {
+			return fmt.Errorf("file %s: %w", path, ErrConflict)
+		}
+	}
+	return nil
+}
+
+// makeDirectory inserts the row of MakeDirectory in transaction tx
+func makeDirectory(tx sqlTx, path string, owner Client) error {
+	id, err := ownerID(tx, owner)
+	if err != nil {
+		return err
+	}
+	if err := checkPath(tx, id, path, false); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO Directory (ownerId, path) VALUES ($1, $2)", id, path)
+	return err
+}
+
+// removeDirectory deletes the row of RemoveDirectory in transaction tx
+func removeDirectory(tx sqlTx, path string, owner Client) error {
+	id, err := ownerID(tx, owner)
+	if err != nil {
+		return err
+	}
+	if n, err := countUnder(tx, id, path); err != nil {
+		return err
+	} else if n > 0 {
+		return fmt.Errorf("directory %s isn't empty: %w", path, ErrConflict)
+	}
+	res, err := tx.Exec("DELETE FROM Directory WHERE ownerId=$1 AND path=$2", id, path)
+	return expectRow(res, err, "directory "+path)
+}
+
+// move renames the rows of Move in transaction tx
+func move(tx sqlTx, from, to string, owner Client) error {
+	id, err := ownerID(tx, owner)
+	if err != nil {
+		return err
+	}
+	var files int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM File WHERE ownerId=$1 AND name=$2", id, from).Scan(&files); err != nil {
+		return err
+	}
+	if files > 0 {
+		if err := checkPath(tx, id, to, false); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE File SET name=$1 WHERE ownerId=$2 AND name=$3", to, id, from)
+		return err
+	}
+
+	var made int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM Directory WHERE ownerId=$1 AND path=$2", id, from).Scan(&made); err != nil {
+		return err
+	}
+	under, err := countUnder(tx, id, from)
+	if err != nil {
+		return err
+	} else if made+under == 0 {
+		return fmt.Errorf("file or directory %s: %w", from, ErrNotFound)
+	}
+	if err := checkPath(tx, id, to, false); err != nil {
+		return err
+	}
+	// Everything under from keeps the rest of its path, from the "/" after from on
+	rest := utf8.RuneCountInString(from) + 1
+	const filesSQL = `
+	UPDATE File SET name = $1 || substr(name, $2) WHERE ownerId=$3 AND substr(name, 1, $2)=$4`
+	if _, err := tx.Exec(filesSQL, to, rest, id, dirPrefix(from)); err != nil {
+		return fmt.Errorf("move files: %w", err)
+	}
+	const dirsSQL = `
+	UPDATE Directory SET path = $1 || substr(path, $2) WHERE ownerId=$3 AND (path=$4 OR substr(path, 1, $2)=$5)`
+	if _, err := tx.Exec(dirsSQL, to, rest, id, from, dirPrefix(from)); err != nil {
+		return fmt.Errorf("move directories: %w", err)
 	}
+	return nil
 }
@@ -2,43 +2,65 @@ package main
 
 import (
 	"database/sql"
-	"log"
+	"time"
 )
 
 // DbFile is a database representation of a File
 type DbFile struct {
-	id       int
-	modified int
-	name     string
-	ownerID  string
+	id         int
+	modified   int
+	name       string
+	ownerID    string
+	wrappedKey []byte
+	version    int
+	uploaded   int
 }
 
 // NewDbFile returns a new DbFile for the results found in the provided sql.Rows
-func NewDbFile(r *sql.Rows) DbFile {
-	var id, modified int
+func NewDbFile(r *sql.Rows) (DbFile, error) {
+	var id, modified, version, uploaded int
 	var name, ownerID string
-	if err := r.Scan(&id, &modified, &name, &ownerID); err != nil {
-		log.Println("new db file:", err)
-	}
-	return DbFile{id, modified, name, ownerID}
+	var wrappedKey []byte
+	err := r.Scan(&id, &modified, &name, &ownerID, &wrappedKey, &version, &uploaded)
+	return DbFile{id, modified, name, ownerID, wrappedKey, version, uploaded}, err
+}
+
+// file returns the File the DbFile describes, without its data
+func (dbF DbFile) file() File {
+	f := File{wrappedKey: dbF.wrappedKey, version: dbF.version}
+	f.name = dbF.name
+	f.modified = time.Unix(int64(dbF.modified), 0)
+	f.uploaded = time.Unix(int64(dbF.uploaded), 0)
+	return f
 }
 
 // DbFilePart is a database representation of a FilePart
 type DbFilePart struct {
-	parentID  int
-	name      string
-	id        int
-	fileIndex int
+	parentID     int
+	name         string
+	id           int
+	fileIndex    int
+	kind         int
+	dataShards   int
+	parityShards int
+	size         int
+	replicas     int
+	partSize     int
+	checksum     string
+	stripeSize   int
 }
 
 // NewDbFilePart creates a new DbFilePart from the sql.Rows provided
-func NewDbFilePart(r *sql.Rows) DbFilePart {
-	var parentID, id, fileIndex int
-	var name string
-	if err := r.Scan(&parentID, &name, &id, &fileIndex); err != nil {
-		log.Println("new db file part:", err)
-	}
-	return DbFilePart{parentID, name, id, fileIndex}
+func NewDbFilePart(r *sql.Rows) (DbFilePart, error) {
+	var parentID, id, fileIndex, kind, dataShards, parityShards, size, replicas, partSize, stripeSize int
+	var name, checksum string
+	err := r.Scan(&parentID, &name, &id, &fileIndex, &kind, &dataShards, &parityShards, &size, &replicas, &partSize, &checksum, &stripeSize)
+	return DbFilePart{parentID, name, id, fileIndex, kind, dataShards, parityShards, size, replicas, partSize, checksum, stripeSize}, err
+}
+
+// coding returns the erasure Coding the DbFilePart was sharded with
+func (p DbFilePart) coding() Coding {
+	return Coding{p.dataShards, p.parityShards, p.size, p.stripeSize}
 }
 
 // DbFileLookup represents the many-to-many relationship between FileParts and Clients
@@ -49,12 +71,10 @@ type DbFileLookup struct {
 }
 
 // NewDbFileLookup creates a new DbFileLookup from the sql.Rows provided
-func NewDbFileLookup(r *sql.Rows) DbFileLookup {
+func NewDbFileLookup(r *sql.Rows) (DbFileLookup, error) {
 	var id, parentID, ownerID int
-	if err := r.Scan(&id, &parentID, &ownerID); err != nil {
-		log.Println("new db file lookup:", err)
-	}
-	return DbFileLookup{id, parentID, ownerID}
+	err := r.Scan(&id, &parentID, &ownerID)
+	return DbFileLookup{id, parentID, ownerID}, err
 }
 
 // DbClient is the database representation of a Client
@@ -62,14 +82,21 @@ type DbClient struct {
 	id       int
 	username string
 	password string
+	keySalt  []byte
+	badParts int
+
+	challengesPassed int
+	challengesFailed int
+	reliability      float64
 }
 
 // NewDbClient creates a new DbCLient from the sql.Rows provided
-func NewDbClient(r *sql.Rows) DbClient {
+func NewDbClient(r *sql.Rows) (DbClient, error) {
 	var id int
 	var username, password string
-	if err := r.Scan(&id, &username, &password); err != nil {
-		log.Println("new db client:", err)
-	}
-	return DbClient{id, username, password}
+	var keySalt []byte
+	var badParts, passed, failed int
+	var reliability float64
+	err := r.Scan(&id, &username, &password, &keySalt, &badParts, &passed, &failed, &reliability)
+	return DbClient{id, username, password, keySalt, badParts, passed, failed, reliability}, err
 }
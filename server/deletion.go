@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+/*
+	Deleting a File removes its rows and, in the same transaction, queues a PendingDeletion
+	for every part on every Client holding it. Holders are sent a "deletePart" message for
+	each queued part when the File is deleted if they are connected, otherwise when they
+	next log in. A deletion is only dropped from the queue once it has been sent, so a
+	server restart or a holder going offline doesn't leave parts stored forever.
+	Holders speaking a protocol older than version 4 don't understand "deletePart", their
+	deletions wait until they log in with a newer client. Storing a part on a Client again
+	cancels any deletion of it still queued for that Client. Repair queues a deletion for
+	every offline holder it replaces, and a failed upload for every peer it sent a part to,
+	so peers that come back drop the parts nothing refers to.
+*/
+
+// Handle a "delete" message by deleting the named File of the Client on Session c, or just one version
+// of it if the message names one, and telling its holders to drop its parts.
+// A name that isn't a File is removed as an empty directory, see directories.go.
+func handleDelete(msg DeleteMessage, c *Session) error {
+	cli, _ := c.Client()
+	f := FileFromMetaData(msg.FileMeta)
+	holders, err := database.DeleteFile(f, cli)
+	if errors.Is(err, ErrNotFound) && f.version == 0 {
+		return deleteDirectory(f.name, c)
+	} else if err != nil {
+		return err
+	}
+	log.Println("Client", cli.username, "deleted", fileWhat(f))
+	if err := c.WriteJSON(DeleteMessage{"deleted", FileMeta{Name: f.name, Version: f.version}}); err != nil {
+		log.Println("delete:", err)
+	}
+	if f.version != 0 {
+		// An earlier version may have become the current one
+		sendUsersFileMetaData(c)
+	}
+	sendHoldersPendingDeletions(holders)
+	return nil
+}
+
+// Remove the empty directory path of the Client on Session c, answering like handleDelete
+func deleteDirectory(path string, c *Session) error {
+	cli, _ := c.Client()
+	if err := database.RemoveDirectory(path, cli); err != nil {
+		return err
+	}
+	log.Println("Client", cli.username, "removed directory", path)
+	if err := c.WriteJSON(DeleteMessage{"deleted", FileMeta{Name: path}}); err != nil {
+		log.Println("delete:", err)
+	}
+	sendUsersFileMetaData(c)
+	return nil
+}
+
+// Send the pending deletions of every connected Session of holders
+func sendHoldersPendingDeletions(holders []Client) {
+	for _, h := range holders {
+		for _, s := range sessions.ForClient(h) {
+			sendPendingDeletions(s)
+		}
+	}
+}
+
+// Send the Client on Session s a "deletePart" message for every part it still has to delete
+func sendPendingDeletions(s *Session) {
+	if s.Version() < PartAckProtocolVersion {
+		return
+	}
+	cli, _ := s.Client()
+	names, err := database.PendingDeletions(cli)
+	if err != nil {
+		log.Println("pending deletions:", err)
+		return
+	}
+	for _, name := range names {
+		if err := s.WriteJSON(PartMessage{Type: "deletePart", FileMeta: FileMeta{Name: name}}); err != nil {
+			log.Println("delete part:", err)
+			return
+		}
+		if err := database.ClearPendingDeletion(cli, name); err != nil {
+			log.Println("clear pending deletion:", err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+)
+
+/*
+	An upload's parts are sent, a stripe at a time, to every peer placement picked before
+	anything about the upload is stored. From protocol version 4 the FramePart carries a request ID, which the
+	peer echoes in a "partStored" message once it holds the part. Older peers don't
+	acknowledge, for them a successful send has to do. Only once every part is held is the
+	File recorded, along with its parts, holders and challenges, in one transaction.
+	If any peer fails, or the transaction does, the upload is dropped and a deletion is
+	queued for every peer that got a part, which is told to delete it with a "deletePart"
+	message now or once it is back, see deletion.go.
+*/
+
+// PartAckProtocolVersion is the first protocol version whose peers acknowledge stored parts
+const PartAckProtocolVersion = 4
+
+var deliverParallelism = flag.Int("deliver-parallelism", 8, "maximum number of parts of an upload being sent to peers at once")
+
+// PlacedPart is a FilePart of an upload with the Clients storing it and the Challenges to check them with
+type PlacedPart struct {
+	part       FilePart
+	holders    []Client
+	challenges []Challenge
+}
+
+// A copy of a part on one of its holders
+type partCopy struct {
+	part   FilePart
+	holder Client
+}
+
+// storePart sends fp to Session s and waits up to partTimeout for it to acknowledge storing the part
+func storePart(ctx context.Context, s *Session, fp FilePart) error {
+	if s.Version() < PartAckProtocolVersion {
+		return sendPart(s, fp, 0)
+	}
+	id, ack := s.expect()
+	if err := sendPart(s, fp, id); err != nil {
+		s.cancelRequest(id)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *partTimeout)
+	defer cancel()
+	select {
+	case <-ack:
+		return nil
+	case <-s.Context().Done():
+		s.cancelRequest(id)
+		return errors.New("peer disconnected")
+	case <-ctx.Done():
+		s.cancelRequest(id)
+		return ctx.Err()
+	}
+}
+
+// deliverParts stores every part on each of its holders. If any holder fails, the
+// copies that were stored are deleted again and the first failure is returned.
+func deliverParts(parts []PlacedPart) error {
+	var copies []partCopy
+	for _, p := range parts {
+		for _, h := range p.holders {
+			copies = append(copies, partCopy{p.part, h})
+		}
+	}
+
+	var mu sync.Mutex
+	var stored []partCopy
+	var failure error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *deliverParallelism)
+	for _, pc := range copies {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(pc partCopy) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			s := sessionForClient(pc.holder)
+			err := errors.New("peer disconnected")
+			if s != nil {
+				err = storePart(context.Background(), s, pc.part)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				stored = append(stored, pc)
+			} else if failure == nil {
+				failure = ProtocolError{ErrCodeUnavailable, fmt.Errorf("peer %s didn't store part %d: %v", pc.holder.username, pc.part.index, err)}
+			}
+		}(pc)
+	}
+	wg.Wait()
+
+	if failure != nil {
+		discardCopies(stored)
+	}
+	return failure
+}
+
+// discardParts tells every holder of parts to delete its copy, after the upload they belong to failed
+func discardParts(parts []PlacedPart) {
+	var copies []partCopy
+	for _, p := range parts {
+		for _, h := range p.holders {
+			copies = append(copies, partCopy{p.part, h})
+		}
+	}
+	discardCopies(copies)
+}
+
+// discardCopies queues a deletion for every holder of parts nothing refers to and sends them to the
+// holders that are connected. Holders that are offline, or too old to understand "deletePart", are
+// sent theirs once they log in with a newer client, see deletion.go.
+func discardCopies(copies []partCopy) {
+	var holders []Client
+	queued := map[string]bool{}
+	for _, pc := range copies {
+		if err := database.QueuePendingDeletion(pc.holder, pc.part.name); err != nil {
+			log.Println("queue deletion of orphaned part", pc.part.name, "for", pc.holder.username, ":", err)
+			continue
+		}
+		if !queued[pc.holder.username] {
+			queued[pc.holder.username] = true
+			holders = append(holders, pc.holder)
+		}
+	}
+	sendHoldersPendingDeletions(holders)
+}
+
+// Hand a peer's acknowledgement of a stored part to the storePart waiting on it
+func handlePartStored(msg PartStoredMessage, message []byte, c *Session) error {
+	if !c.deliverTo(msg.RequestID, message) {
+		log.Println("part stored: no outstanding request", msg.RequestID)
+	}
+	return nil
+}
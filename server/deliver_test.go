@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiscardCopiesQueuesDeletions(t *testing.T) {
+	oldDatabase, oldSessions := database, sessions
+	defer func() { database, sessions = oldDatabase, oldSessions }()
+	database, sessions = NewMemoryStore(), NewSessionRegistry()
+
+	offline, old := Client{username: "offline"}, Client{username: "old"}
+	for _, c := range []Client{offline, old} {
+		if err := database.CreateClient(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A peer from before "deletePart" is connected but can't be told yet
+	s := NewSession(nil)
+	sessions.Add(s)
+	sessions.Register(s, old, nil, PartAckProtocolVersion-1, "")
+
+	var copies []partCopy
+	for _, name := range []string{"p0", "p1"} {
+		var fp FilePart
+		fp.name = name
+		copies = append(copies, partCopy{fp, offline}, partCopy{fp, old})
+	}
+	discardCopies(copies)
+	for _, c := range []Client{offline, old} {
+		pending, err := database.PendingDeletions(c)
+		if err != nil || len(pending) != 2 || pending[0] != "p0" || pending[1] != "p1" {
+			t.Errorf("%s has deletions %v, %v queued, want p0 and p1", c.username, pending, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	File names are paths of directory names and a file name joined by "/", like "photos/2016/tree.jpg".
+	Directories exist while they hold a File or another directory, or once they have been created
+	with a "mkdir" message, which records them in the Directory table so they can stay empty
+	until a "delete" message names them.
+	A path can't be both a File and a directory, and no File can sit under a path that is a File.
+	A "move" message renames a File, every version of it, or a directory along with everything under it.
+	Parts are named after a random nonce of the upload that stored them, not after their File,
+	so moving never touches the holders and a File uploaded again under the old name gets parts
+	of its own.
+
+	From protocol version 5 a Session lists one directory at a time. Clients pick it by sending a
+	"fileList" message with its path as the prefix, "" being the top, and get back its Files and
+	subdirectories, or everything under it if they ask for a recursive listing. Later file lists,
+	sent after uploads, deletes and the like, list the same directory. Older clients keep getting
+	every File in one flat list.
+*/
+
+// DirectoryProtocolVersion is the first protocol version whose file lists are listings of one directory
+const DirectoryProtocolVersion = 5
+
+// validatePath checks p is a path a File or directory can be given
+func validatePath(p string) error {
+	if p == "" {
+		return badMessage("path is required")
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." || name == ".." {
+			return badMessage("path %q has an empty, \".\" or \"..\" name in it", p)
+		}
+	}
+	return nil
+}
+
+// parentDirs gets the paths of every directory p is under, outermost first
+func parentDirs(p string) []string {
+	var dirs []string
+	for i := range p {
+		if p[i] == '/' {
+			dirs = append(dirs, p[:i])
+		}
+	}
+	return dirs
+}
+
+// dirPrefix gets the prefix of the paths under directory dir, "" for the top directory
+func dirPrefix(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
+
+// movedPath gets the path p has after moving from to to, p being from itself or under it
+func movedPath(p, from, to string) string {
+	return to + strings.TrimPrefix(p, from)
+}
+
+// listDirectory gets the entries listing directory dir, given the Files and directories under it.
+// Directories are listed first, both in name order.
+func listDirectory(files []File, dirs []string, dir string, recursive bool) []FileListEntry {
+	prefix := dirPrefix(dir)
+	entries := []FileListEntry{}
+	seen := map[string]bool{}
+	addDir := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			entries = append(entries, FileListEntry{FileMeta: FileMeta{Name: p}, Directory: true})
+		}
+	}
+	// addPath lists the directories p is in, and returns whether p itself belongs in the listing
+	addPath := func(p string) bool {
+		if !strings.HasPrefix(p, prefix) {
+			return false
+		}
+		if !recursive {
+			if i := strings.Index(p[len(prefix):], "/"); i >= 0 {
+				addDir(p[:len(prefix)+i])
+				return false
+			}
+			return true
+		}
+		for _, parent := range parentDirs(p) {
+			if len(parent) > len(dir) {
+				addDir(parent)
+			}
+		}
+		return true
+	}
+
+	for _, d := range dirs {
+		if addPath(d) {
+			addDir(d)
+		}
+	}
+	for _, f := range files {
+		if addPath(f.name) {
+			meta := FileMeta{Name: f.name, LastModified: strconv.FormatInt(f.modified.Unix(), 10), Version: f.version}
+			entries = append(entries, FileListEntry{FileMeta: meta})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Directory != entries[j].Directory {
+			return entries[i].Directory
+		}
+		return entries[i].FileMeta.Name < entries[j].FileMeta.Name
+	})
+	return entries
+}
+
+// Handle a "fileList" message by listing the directory it names to the Session c, now and after later changes
+func handleFileList(msg FileListMessage, c *Session) error {
+	if c.Version() < DirectoryProtocolVersion {
+		return ProtocolError{ErrCodeBadMessage, errors.New("fileList: listing a directory needs protocol version 5")}
+	}
+	c.SetListing(msg.Prefix, msg.Recursive)
+	sendUsersFileMetaData(c)
+	return nil
+}
+
+// Handle a "mkdir" message by creating the directory it names for the Client on Session c
+func handleMkdir(msg MkdirMessage, c *Session) error {
+	cli, _ := c.Client()
+	if err := database.MakeDirectory(msg.Path, cli); err != nil {
+		return err
+	}
+	log.Println("Client", cli.username, "created directory", msg.Path)
+	if err := c.WriteJSON(MkdirMessage{"directoryCreated", msg.Path}); err != nil {
+		return err
+	}
+	sendUsersFileMetaData(c)
+	return nil
+}
+
+// Handle a "move" message by renaming the File or directory of the Client on Session c it names
+func handleMove(msg MoveMessage, c *Session) error {
+	cli, _ := c.Client()
+	if err := database.Move(msg.From, msg.To, cli); err != nil {
+		return err
+	}
+	log.Println("Client", cli.username, "moved", msg.From, "to", msg.To)
+	if err := c.WriteJSON(MoveMessage{"moved", msg.From, msg.To}); err != nil {
+		return err
+	}
+	sendUsersFileMetaData(c)
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+)
+
+// Download flags. Downloads are fetched, decrypted and sent stripe by stripe, so a download
+// holds at most downloadWindow+1 stripes in memory however big its File is.
+var downloadWindow = flag.Int("download-window", 2, "number of stripes fetched ahead of the one being sent to a downloader")
+var downloadFrameSize = flag.Int("download-frame-size", 1<<20, "maximum bytes of a file sent in each frame of a download")
+
+// Number of stripes fetchStripe can fetch for the File reqs belongs to
+func stripeCount(reqs []FilePartRequest) int {
+	coding := reqs[0].filePart.coding
+	// Parts stored before erasure coding are plain contiguous slices of the File, one per stripe
+	if coding.dataShards == 0 {
+		return len(reqs)
+	}
+	return coding.stripes()
+}
+
+// Fetch and decode stripe j of the File reqs belongs to
+func fetchStripe(ctx context.Context, reqs []FilePartRequest, j int) ([]byte, error) {
+	coding := reqs[0].filePart.coding
+	if coding.dataShards == 0 {
+		pt, ok := fetchPartFromOwners(ctx, reqs[j])
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, errors.New("no available peers to fetch part from")
+		}
+		return pt.data, nil
+	}
+	sc := coding.stripe(j)
+	shards, err := fetchShards(ctx, stripeRequests(reqs, j), sc)
+	if err != nil {
+		return nil, fmt.Errorf("stripe %d: %v", j, err)
+	}
+	return decodeShards(shards, sc)
+}
+
+// Pick the requests for the parts of stripe j out of reqs
+func stripeRequests(reqs []FilePartRequest, j int) []FilePartRequest {
+	var stripe []FilePartRequest
+	for _, req := range reqs {
+		if req.filePart.coding.stripeOf(req.filePart.index) == j {
+			stripe = append(stripe, req)
+		}
+	}
+	return stripe
+}
+
+// Fetch every stripe of the File reqs belongs to and hand them to emit in order. Up to
+// downloadWindow stripes after the one being emitted are fetched in parallel. Stops at the first error.
+func streamStripes(ctx context.Context, reqs []FilePartRequest, emit func([]byte) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type fetched struct {
+		data []byte
+		err  error
+	}
+	n := stripeCount(reqs)
+	results := make([]chan fetched, n)
+	for j := range results {
+		results[j] = make(chan fetched, 1)
+	}
+	window := make(chan struct{}, *downloadWindow+1)
+	go func() {
+		for j := 0; j < n; j++ {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(j int) {
+				data, err := fetchStripe(ctx, reqs, j)
+				results[j] <- fetched{data, err}
+			}(j)
+		}
+	}()
+
+	for j := 0; j < n; j++ {
+		var r fetched
+		select {
+		case r = <-results[j]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if r.err != nil {
+			return r.err
+		}
+		err := emit(r.data)
+		<-window
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stream owner's File f to the requester on Session c, decrypting each stripe as it arrives and sending
+// it in frames of at most downloadFrameSize bytes, then a "downloadComplete" message.
+// Files sealed before segmented encryption can only be decrypted, and so sent, once they're all fetched.
+// Files sealed by the client are sent as they are, with their wrapped key for the client to open them.
+func streamFile(ctx context.Context, c *Session, f File, reqs []FilePartRequest, requestID uint64) error {
+	meta := FileMeta{Name: f.name}
+	opener := &FileOpener{}
+	if clientWrapped(f.wrappedKey) {
+		meta.WrappedKey = base64.StdEncoding.EncodeToString(f.wrappedKey)
+	} else {
+		var err error
+		if opener, err = NewFileOpener(f.wrappedKey, c.PasswordKey()); err != nil {
+			return fmt.Errorf("decrypt file %s: %v", f.name, err)
+		}
+	}
+	var offset uint64
+	send := func(data []byte) error {
+		for len(data) > 0 {
+			n := len(data)
+			if n > *downloadFrameSize {
+				n = *downloadFrameSize
+			}
+			frame := Frame{Type: FrameFileResponse, RequestID: requestID, Name: f.name, Offset: offset, Payload: data[:n]}
+			if err := c.WriteFrame(frame); err != nil {
+				return err
+			}
+			offset += uint64(n)
+			data = data[n:]
+		}
+		return nil
+	}
+
+	log.Println("Streaming file", f.name)
+	var decryptErr error
+	err := streamStripes(ctx, reqs, func(stripe []byte) error {
+		data, err := opener.Write(stripe)
+		if err != nil {
+			decryptErr = err
+			return err
+		}
+		return send(data)
+	})
+	if decryptErr != nil {
+		return fmt.Errorf("decrypt file %s: %v", f.name, decryptErr)
+	} else if err != nil {
+		return ProtocolError{ErrCodeUnavailable, fmt.Errorf("assemble file %s: %v", f.name, err)}
+	}
+	rest, err := opener.Close()
+	if err != nil {
+		return fmt.Errorf("decrypt file %s: %v", f.name, err)
+	}
+	if err := send(rest); err != nil {
+		return err
+	}
+	return c.WriteJSON(DownloadCompleteMessage{"downloadComplete", requestID, meta, int64(offset)})
+}
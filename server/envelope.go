@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+/*
+	Files are encrypted before they are sharded, so peers only ever store ciphertext.
+
+	Every File gets its own random 256-bit file key, which seals the File's data in
+	segments so it can be decrypted as it streams back from peers:
+
+		sealed file:  version 2 (1 byte) | nonce (12 bytes) | segment 0 | segment 1 | ...
+		segment i:    AES-256-GCM ciphertext and tag of up to segmentSize bytes
+
+	Segment i is sealed under the nonce with i XORed into its last 4 bytes, and the
+	version byte and a final-segment flag as additional data, so segments can't be
+	reordered, dropped or truncated unnoticed. A FileSealer seals a File a segment at a
+	time as its plaintext is read, so an upload never has to be held whole. Files sealed
+	before segmenting are a single version 1 envelope, as below, and can only be opened whole.
+
+	The file key is then wrapped with the owner's password key and saved with the File row:
+
+		wrapped key:  version (1 byte) | nonce (12 bytes) | AES-256-GCM sealed file key and tag
+
+	The password key is derived with argon2id from the owner's password and a random
+	per-Client salt kept in the Client row. It lives in memory while the owner is connected,
+	and sealed with the server's token key in the row of every session token they hold until
+	it is revoked, see token.go. Anyone with both the database and the token key can unwrap
+	the owner's file keys while such a token is active.
+	The version byte is authenticated as additional data in both envelopes.
+
+	Clients speaking protocol version 6 or later seal their Files themselves, so the server
+	never sees their plaintext or file keys. They upload the File already sealed in the
+	segmented format above, with fileMeta.wrappedKey holding its file key wrapped in a
+	version 3 envelope by a key derived from the password on the client, see ClientKeys.
+	The server stores both as they are and hands them back on download for the client to
+	open. Those clients log in with a secret derived alongside that key rather than the
+	password, so the server can't derive the key from anything it is sent.
+
+	Older clients upload plaintext, which the server seals as above with the password key.
+	The server sees their uploads and downloads and holds their password key while they're
+	connected, so their Files are kept from the peers storing the parts, not from the server.
+*/
+
+const envelopeVersion = 1
+
+// ClientSealProtocolVersion is the first protocol version whose clients seal their own Files
+const ClientSealProtocolVersion = 6
+
+// Version of envelopes holding file keys wrapped by the client, and the PBKDF2 iterations
+// its key derivation uses
+const (
+	clientKeyVersion    = 3
+	clientKeyIterations = 600000
+)
+
+// Version of sealed Files and the plaintext bytes in each of their segments
+const (
+	segmentedVersion = 2
+	segmentSize      = 64 * 1024
+)
+
+// argon2id parameters for deriving password keys, as recommended by RFC 9106
+const (
+	keyTime    = 1
+	keyMemory  = 64 * 1024
+	keyThreads = 4
+	keyLength  = 32
+	saltLength = 16
+)
+
+// NewKeySalt returns a random salt for deriving a Client's password key
+func NewKeySalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// PasswordKey derives the key that wraps a Client's file keys from their password and salt
+func PasswordKey(password string, salt []byte) []byte {
+	return argon2.IDKey([]byte(password), salt, keyTime, keyMemory, keyThreads, keyLength)
+}
+
+// ClientKeys is the reference for how clients derive their login secret and the key wrapping their
+// file keys from a Client's name and password. A master key is derived with PBKDF2-HMAC-SHA256 from
+// the password salted with "nfinite.space/" and the name, then split with HKDF-SHA256 into the
+// secret sent as the password, in hex, and the key wrapping. Both are within reach of WebCrypto.
+func ClientKeys(username, password string) (pass string, wrappingKey []byte, err error) {
+	master := pbkdf2.Key([]byte(password), []byte("nfinite.space/"+username), clientKeyIterations, keyLength, sha256.New)
+	secret := make([]byte, keyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("nfinite.space login")), secret); err != nil {
+		return "", nil, err
+	}
+	wrappingKey = make([]byte, keyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("nfinite.space file keys")), wrappingKey); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(secret), wrappingKey, nil
+}
+
+// SealClientFile encrypts data as a client does, under a new file key wrapped by the client's wrappingKey
+func SealClientFile(data []byte, wrappingKey []byte) (sealed []byte, wrappedKey []byte, err error) {
+	fileKey := make([]byte, keyLength)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, nil, err
+	}
+	s, err := newFileSealer(bytes.NewReader(data), int64(len(data)), fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed = make([]byte, s.Size())
+	if _, err := io.ReadFull(s, sealed); err != nil {
+		return nil, nil, err
+	}
+	wrappedKey, err = sealVersion(clientKeyVersion, wrappingKey, fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sealed, wrappedKey, nil
+}
+
+// clientWrapped reports whether wrappedKey was wrapped by the client, so its File is only opened there
+func clientWrapped(wrappedKey []byte) bool {
+	return len(wrappedKey) > 0 && wrappedKey[0] == clientKeyVersion
+}
+
+// checkClientWrappedKey checks wrappedKey is a file key wrapped by a client, as far as the server can tell
+func checkClientWrappedKey(wrappedKey []byte) error {
+	if len(wrappedKey) != 1+12+keyLength+16 || !clientWrapped(wrappedKey) {
+		return errors.New("not a file key wrapped by the client")
+	}
+	return nil
+}
+
+// validSealedSize reports whether size is the length of some File sealed in segments
+func validSealedSize(size int64) bool {
+	body := size - 1 - 12
+	last := body % (segmentSize + 16)
+	return body >= 16 && (last == 0 || last >= 16)
+}
+
+// SealFile encrypts data under a new file key and returns it along with the file key wrapped by passwordKey
+func SealFile(data []byte, passwordKey []byte) (sealed []byte, wrappedKey []byte, err error) {
+	s, wrappedKey, err := NewFileSealer(bytes.NewReader(data), int64(len(data)), passwordKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed = make([]byte, s.Size())
+	if _, err := io.ReadFull(s, sealed); err != nil {
+		return nil, nil, err
+	}
+	return sealed, wrappedKey, nil
+}
+
+// OpenFile unwraps the file key with passwordKey and uses it to decrypt sealed
+func OpenFile(sealed []byte, wrappedKey []byte, passwordKey []byte) ([]byte, error) {
+	o, err := NewFileOpener(wrappedKey, passwordKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := o.Write(sealed)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := o.Close()
+	if err != nil {
+		return nil, err
+	}
+	return append(data, rest...), nil
+}
+
+// FileOpener decrypts a sealed File as its bytes arrive in order, holding back at most
+// a segment. Files sealed before segmenting are buffered and opened whole on Close.
+type FileOpener struct {
+	aead    cipher.AEAD // nil for Files that were never encrypted
+	fileKey []byte
+	version byte
+	nonce   []byte
+	segment uint32
+	buf     []byte
+}
+
+// NewFileOpener unwraps the file key with passwordKey. A nil wrappedKey opens a File
+// stored before encryption, whose bytes are passed through as they are.
+func NewFileOpener(wrappedKey []byte, passwordKey []byte) (*FileOpener, error) {
+	if wrappedKey == nil {
+		return &FileOpener{}, nil
+	}
+	fileKey, err := open(passwordKey, wrappedKey)
+	if err != nil {
+		return nil, errors.New("unwrap file key: " + err.Error())
+	}
+	aead, err := newAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &FileOpener{aead: aead, fileKey: fileKey}, nil
+}
+
+// Write takes the next sealed bytes and returns whatever plaintext they complete
+func (o *FileOpener) Write(p []byte) ([]byte, error) {
+	if o.aead == nil {
+		return p, nil
+	}
+	o.buf = append(o.buf, p...)
+	if o.version == 0 {
+		if len(o.buf) < 1+o.aead.NonceSize() {
+			return nil, nil
+		}
+		o.version = o.buf[0]
+		if o.version == segmentedVersion {
+			o.nonce = append([]byte{}, o.buf[1:1+o.aead.NonceSize()]...)
+			o.buf = o.buf[1+o.aead.NonceSize():]
+		}
+	}
+	if o.version != segmentedVersion {
+		return nil, nil
+	}
+	// Only open a full segment once more bytes follow it, the last one is opened by Close
+	var data []byte
+	sealedSegment := segmentSize + o.aead.Overhead()
+	for len(o.buf) > sealedSegment {
+		plain, err := o.openSegment(o.buf[:sealedSegment], false)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, plain...)
+		o.buf = o.buf[sealedSegment:]
+	}
+	return data, nil
+}
+
+// Close opens the final segment, failing if the File was cut short
+func (o *FileOpener) Close() ([]byte, error) {
+	if o.aead == nil {
+		return nil, nil
+	}
+	switch o.version {
+	case segmentedVersion:
+		return o.openSegment(o.buf, true)
+	case 0:
+		return nil, errors.New("envelope too short")
+	}
+	return open(o.fileKey, o.buf)
+}
+
+// openSegment decrypts the next segment of a segmented File
+func (o *FileOpener) openSegment(sealed []byte, final bool) ([]byte, error) {
+	plain, err := o.aead.Open(nil, segmentNonce(o.nonce, o.segment), sealed, segmentAD(final))
+	if err != nil {
+		return nil, err
+	}
+	o.segment++
+	return plain, nil
+}
+
+// FileSealer encrypts a File of a known size as its plaintext is read, holding at most a segment
+type FileSealer struct {
+	src      io.Reader
+	aead     cipher.AEAD
+	nonce    []byte
+	size     int64 // length of the plaintext
+	segments int64
+	segment  int64  // next segment to seal
+	plain    []byte // buffer for the next segment's plaintext
+	sealed   []byte // buffer for the next segment's ciphertext
+	buf      []byte // sealed bytes not read yet
+}
+
+// NewFileSealer seals the size bytes read from src under a new file key, which it returns wrapped by passwordKey
+func NewFileSealer(src io.Reader, size int64, passwordKey []byte) (*FileSealer, []byte, error) {
+	fileKey := make([]byte, keyLength)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, nil, err
+	}
+	s, err := newFileSealer(src, size, fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrappedKey, err := seal(passwordKey, fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, wrappedKey, nil
+}
+
+// newFileSealer seals the size bytes read from src with AES-256-GCM under key into a segmented envelope
+func newFileSealer(src io.Reader, size int64, key []byte) (*FileSealer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	segments := (size + segmentSize - 1) / segmentSize
+	if segments == 0 {
+		segments = 1 // An empty File is one empty final segment
+	}
+	return &FileSealer{
+		src:      src,
+		aead:     aead,
+		nonce:    nonce,
+		size:     size,
+		segments: segments,
+		plain:    make([]byte, segmentSize),
+		sealed:   make([]byte, 0, segmentSize+aead.Overhead()),
+		buf:      append([]byte{segmentedVersion}, nonce...),
+	}, nil
+}
+
+// Size returns the length of the sealed File
+func (s *FileSealer) Size() int64 {
+	return 1 + int64(len(s.nonce)) + s.size + s.segments*int64(s.aead.Overhead())
+}
+
+// Read fills p with the next sealed bytes, reading and sealing the next segment once the last one is used up
+func (s *FileSealer) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.segment == s.segments {
+			return 0, io.EOF
+		}
+		n := s.size - s.segment*segmentSize
+		if n > segmentSize {
+			n = segmentSize
+		}
+		if _, err := io.ReadFull(s.src, s.plain[:n]); err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		s.buf = s.aead.Seal(s.sealed[:0], segmentNonce(s.nonce, uint32(s.segment)), s.plain[:n], segmentAD(s.segment == s.segments-1))
+		s.segment++
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// segmentNonce derives the nonce of segment i from a File's nonce
+func segmentNonce(nonce []byte, i uint32) []byte {
+	n := append([]byte{}, nonce...)
+	binary.BigEndian.PutUint32(n[len(n)-4:], binary.BigEndian.Uint32(n[len(n)-4:])^i)
+	return n
+}
+
+// segmentAD is the additional data authenticated with a segment
+func segmentAD(final bool) []byte {
+	if final {
+		return []byte{segmentedVersion, 1}
+	}
+	return []byte{segmentedVersion, 0}
+}
+
+// seal encrypts plaintext with AES-256-GCM under key into a versioned envelope
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	return sealVersion(envelopeVersion, key, plaintext)
+}
+
+// sealVersion encrypts plaintext with AES-256-GCM under key into an envelope of the given version
+func sealVersion(version byte, key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 1+aead.NonceSize())
+	header[0] = version
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, header[1:], plaintext, header[:1]), nil
+}
+
+// open decrypts and authenticates an envelope produced by seal, or a file key wrapped by a client
+func open(key []byte, envelope []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope) < 1+aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("envelope too short")
+	}
+	if envelope[0] != envelopeVersion && envelope[0] != clientKeyVersion {
+		return nil, errors.New("unknown envelope version")
+	}
+	nonce := envelope[1 : 1+aead.NonceSize()]
+	return aead.Open(nil, nonce, envelope[1+aead.NonceSize():], envelope[:1])
+}
+
+// newAEAD returns an AES-GCM cipher for key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keyLength {
+		return nil, errors.New("envelope key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	key := make([]byte, keyLength)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testData(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sealedSegment returns where segment i starts in a File sealed by SealFile, and how long a full one is
+func sealedSegment(i int) (int, int) {
+	full := segmentSize + 16
+	return 1 + 12 + i*full, full
+}
+
+func TestSealFileRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 5} {
+		key := testKey(t)
+		data := testData(t, n)
+		sealed, wrappedKey, err := SealFile(data, key)
+		if err != nil {
+			t.Fatalf("%d bytes: seal: %v", n, err)
+		}
+		if n >= 16 && bytes.Contains(sealed, data) {
+			t.Fatalf("%d bytes: sealed file holds the plaintext", n)
+		}
+		opened, err := OpenFile(sealed, wrappedKey, key)
+		if err != nil {
+			t.Fatalf("%d bytes: open: %v", n, err)
+		}
+		if !bytes.Equal(opened, data) {
+			t.Fatalf("%d bytes: opened file differs", n)
+		}
+	}
+}
+
+func TestFileOpenerStreams(t *testing.T) {
+	key := testKey(t)
+	data := testData(t, 2*segmentSize+100)
+	sealed, wrappedKey, err := SealFile(data, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []int{1, 7, 1000, segmentSize + 16, len(sealed)} {
+		o, err := NewFileOpener(wrappedKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opened []byte
+		for i := 0; i < len(sealed); i += step {
+			end := i + step
+			if end > len(sealed) {
+				end = len(sealed)
+			}
+			plain, err := o.Write(sealed[i:end])
+			if err != nil {
+				t.Fatalf("step %d: write: %v", step, err)
+			}
+			opened = append(opened, plain...)
+		}
+		rest, err := o.Close()
+		if err != nil {
+			t.Fatalf("step %d: close: %v", step, err)
+		}
+		if !bytes.Equal(append(opened, rest...), data) {
+			t.Fatalf("step %d: streamed file differs", step)
+		}
+	}
+}
+
+func TestFileSealerStreams(t *testing.T) {
+	key := testKey(t)
+	for _, n := range []int{0, 5, segmentSize, 2*segmentSize + 100} {
+		data := testData(t, n)
+		s, wrappedKey, err := NewFileSealer(bytes.NewReader(data), int64(n), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// read in odd sizes, so reads straddle segments
+		var sealed []byte
+		buf := make([]byte, 1001)
+		for {
+			k, err := s.Read(buf)
+			sealed = append(sealed, buf[:k]...)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%d bytes: read: %v", n, err)
+			}
+		}
+		if int64(len(sealed)) != s.Size() {
+			t.Fatalf("%d bytes: sealed %d bytes, Size says %d", n, len(sealed), s.Size())
+		}
+		opened, err := OpenFile(sealed, wrappedKey, key)
+		if err != nil || !bytes.Equal(opened, data) {
+			t.Fatalf("%d bytes: open: %v", n, err)
+		}
+	}
+}
+
+func TestFileSealerShortSource(t *testing.T) {
+	data := testData(t, segmentSize+10)
+	s, _, err := NewFileSealer(bytes.NewReader(data), int64(len(data)+1), testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(s); err != io.ErrUnexpectedEOF {
+		t.Fatalf("sealing a short source gave %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestOpenFileWrongKey(t *testing.T) {
+	sealed, wrappedKey, err := SealFile(testData(t, 100), testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(sealed, wrappedKey, testKey(t)); err == nil {
+		t.Fatal("opened with the wrong password key")
+	}
+	if _, err := NewFileOpener(wrappedKey, testKey(t)); err == nil {
+		t.Fatal("unwrapped the file key with the wrong password key")
+	}
+}
+
+func TestOpenFileTampered(t *testing.T) {
+	key := testKey(t)
+	sealed, wrappedKey, err := SealFile(testData(t, 3*segmentSize), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, full := sealedSegment(1)
+	third, _ := sealedSegment(2)
+
+	swapped := append([]byte{}, sealed[:second-full]...)
+	swapped = append(swapped, sealed[second:third]...)
+	swapped = append(swapped, sealed[second-full:second]...)
+	swapped = append(swapped, sealed[third:]...)
+
+	flipped := append([]byte{}, sealed...)
+	flipped[second+10] ^= 1
+
+	tests := map[string][]byte{
+		"empty":                 {},
+		"header only":           sealed[:1+12],
+		"final segment dropped": sealed[:third],
+		"cut inside a segment":  sealed[:len(sealed)-5],
+		"segments reordered":    swapped,
+		"bit flipped":           flipped,
+	}
+	for name, tampered := range tests {
+		if _, err := OpenFile(tampered, wrappedKey, key); err == nil {
+			t.Errorf("%s: opened without an error", name)
+		}
+	}
+}
+
+func TestOpenLegacyFiles(t *testing.T) {
+	key := testKey(t)
+	data := testData(t, 1000)
+
+	// Version 1 Files are a single envelope under the file key
+	fileKey := testKey(t)
+	sealed, err := seal(fileKey, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrappedKey, err := seal(key, fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := OpenFile(sealed, wrappedKey, key); err != nil || !bytes.Equal(opened, data) {
+		t.Fatalf("version 1 file: %v", err)
+	}
+
+	// Files stored before encryption have no wrapped key and pass through
+	if opened, err := OpenFile(data, nil, key); err != nil || !bytes.Equal(opened, data) {
+		t.Fatalf("unencrypted file: %v", err)
+	}
+}
+
+func TestClientKeys(t *testing.T) {
+	// Derived by the web client, see client/web-client/src/libs/envelope.js
+	pass, wrappingKey, err := ClientKeys("alice", "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pass != "9a2581aff564ee82de3920887bf32f46911e78eb3c4be61ec7a8f6d8af2fe218" {
+		t.Errorf("login secret %s differs from the web client's", pass)
+	}
+	if hex.EncodeToString(wrappingKey) != "9af09b3006afc70953ba959f683cca918e48fc1946a2e82cf96e676f528f8d19" {
+		t.Errorf("wrapping key %x differs from the web client's", wrappingKey)
+	}
+	if bobPass, bobKey, _ := ClientKeys("bob", "correct horse battery staple"); bobPass == pass || bytes.Equal(bobKey, wrappingKey) {
+		t.Error("another name with the same password derived the same keys")
+	}
+}
+
+func TestOpenWebClientFile(t *testing.T) {
+	_, wrappingKey, err := ClientKeys("alice", "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := hex.DecodeString("02b44d84235d3f321150755eb4f06ef94f9dc6e7320e3e1d135e616e727679439d8505bcffbec5f18a47798065dcd86d0f6f")
+	wrappedKey, _ := base64.StdEncoding.DecodeString("Az0uhrXRzMf94bJWL5YfZ3Rc4lpiCb3fjIPSzKSuBu8qf3Z76tlt0730ohcP1IJ3C9VgnhE5IF2d3B2mWA==")
+	if err := checkClientWrappedKey(wrappedKey); err != nil || !validSealedSize(int64(len(sealed))) {
+		t.Fatalf("web client's upload rejected: %v", err)
+	}
+	if opened, err := OpenFile(sealed, wrappedKey, wrappingKey); err != nil || string(opened) != "sealed in the browser" {
+		t.Errorf("opened %q, %v", opened, err)
+	}
+}
+
+func TestSealClientFile(t *testing.T) {
+	wrappingKey := testKey(t)
+	for _, n := range []int{0, 1, segmentSize, segmentSize + 1, 3*segmentSize + 5} {
+		data := testData(t, n)
+		sealed, wrappedKey, err := SealClientFile(data, wrappingKey)
+		if err != nil {
+			t.Fatalf("%d bytes: seal: %v", n, err)
+		}
+		if err := checkClientWrappedKey(wrappedKey); err != nil {
+			t.Errorf("%d bytes: %v", n, err)
+		}
+		if !validSealedSize(int64(len(sealed))) {
+			t.Errorf("%d bytes: sealed size %d isn't valid", n, len(sealed))
+		}
+		if opened, err := OpenFile(sealed, wrappedKey, wrappingKey); err != nil || !bytes.Equal(opened, data) {
+			t.Fatalf("%d bytes: open: %v", n, err)
+		}
+	}
+
+	// Keys wrapped by the server aren't taken for a client's
+	_, serverWrapped, err := SealFile(nil, wrappingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkClientWrappedKey(serverWrapped); err == nil {
+		t.Error("took a key wrapped by the server for a client's")
+	}
+	full := int64(1 + 12 + segmentSize + 16)
+	for _, size := range []int64{0, 28, full + 1, full + 15} {
+		if validSealedSize(size) {
+			t.Errorf("%d bytes taken for a sealed file", size)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Erasure coding flags. Every File is split into dataShards pieces and padded out
+// with parityShards extra pieces, any dataShards of which are enough to rebuild it.
+var dataShards = flag.Int("data-shards", 4, "number of data shards each file is split into")
+var parityShards = flag.Int("parity-shards", 2, "number of parity shards generated for each file")
+
+// Files bigger than stripeSize are split into stripes that are sharded separately, so a
+// part never holds more than stripeSize/dataShards bytes however big its File is.
+var stripeSize = flag.Int("stripe-size", 16<<20, "bytes of each file sharded together, 0 to shard every file as a single stripe")
+
+// maxShards is the most shards, data and parity together, reedsolomon can code a stripe into
+const maxShards = 256
+
+// checkShardCounts rejects -data-shards and -parity-shards settings no File could be sharded with
+func checkShardCounts(data, parity int) error {
+	if data <= 0 || parity <= 0 {
+		return fmt.Errorf("data and parity shards must both be positive, got %d and %d", data, parity)
+	}
+	if data+parity > maxShards {
+		return fmt.Errorf("%d data and %d parity shards are more than the %d allowed", data, parity, maxShards)
+	}
+	return nil
+}
+
+// ShardKind tells apart FileParts holding original bytes from those holding parity
+type ShardKind int
+
+const (
+	// DataShard is a FilePart holding a slice of the original File
+	DataShard ShardKind = iota
+	// ParityShard is a FilePart holding Reed-Solomon parity for its File
+	ParityShard
+)
+
+func (k ShardKind) String() string {
+	if k == ParityShard {
+		return "parity"
+	}
+	return "data"
+}
+
+// Coding holds the k-of-n parameters a File was sharded with.
+// Part index i of a striped File is shard i%total() of stripe i/total().
+type Coding struct {
+	dataShards   int
+	parityShards int
+	size         int // length of the original data, used to trim shard padding
+	stripeSize   int // length of each stripe but the last, 0 if the File is a single stripe
+}
+
+// NewCoding returns the Coding for data of the given size using the configured shard counts
+func NewCoding(size int) Coding {
+	return Coding{*dataShards, *parityShards, size, *stripeSize}
+}
+
+// NewReplicaCoding returns the Coding for storing data whole as one part per stripe, with no parity
+func NewReplicaCoding(size int) Coding {
+	return Coding{1, 0, size, *stripeSize}
+}
+
+// total is the number of shards, data and parity, each stripe is split into
+func (c Coding) total() int {
+	return c.dataShards + c.parityShards
+}
+
+// stripes is the number of stripes the File is split into
+func (c Coding) stripes() int {
+	if c.stripeSize == 0 || c.size <= c.stripeSize {
+		return 1
+	}
+	return (c.size + c.stripeSize - 1) / c.stripeSize
+}
+
+// stripe returns the Coding of stripe j on its own, whose size is the stripe's length
+func (c Coding) stripe(j int) Coding {
+	if c.stripeSize == 0 {
+		return c
+	}
+	s := c
+	s.size = c.size - j*c.stripeSize
+	if s.size > c.stripeSize {
+		s.size = c.stripeSize
+	}
+	return s
+}
+
+// stripeBounds returns where stripe j starts and ends in the File's data
+func (c Coding) stripeBounds(j int) (int, int) {
+	if c.stripeSize == 0 {
+		return 0, c.size
+	}
+	begin := j * c.stripeSize
+	return begin, begin + c.stripe(j).size
+}
+
+// stripeOf returns the stripe the part at index i belongs to
+func (c Coding) stripeOf(i int) int {
+	if c.stripeSize == 0 || c.total() == 0 {
+		return 0
+	}
+	return i / c.total()
+}
+
+// shardOf returns the position of the part at index i within its stripe
+func (c Coding) shardOf(i int) int {
+	if c.stripeSize == 0 || c.total() == 0 {
+		return i
+	}
+	return i % c.total()
+}
+
+// kindForIndex returns whether the part at index i is a data or parity shard
+func (c Coding) kindForIndex(i int) ShardKind {
+	if c.shardOf(i) < c.dataShards {
+		return DataShard
+	}
+	return ParityShard
+}
+
+// storedSize returns the length of every data and parity shard of every stripe together
+func (c Coding) storedSize() int {
+	total := 0
+	for j := 0; j < c.stripes(); j++ {
+		n := c.stripe(j).size
+		if c.parityShards == 0 {
+			total += n
+			continue
+		}
+		if n == 0 {
+			n = 1 // see encodeShards
+		}
+		total += c.total() * ((n + c.dataShards - 1) / c.dataShards)
+	}
+	return total
+}
+
+// encodeShards splits data into the data and parity shards described by c
+func encodeShards(data []byte, c Coding) ([][]byte, error) {
+	if c.parityShards == 0 {
+		return splitShards(data, c.dataShards), nil
+	}
+	enc, err := reedsolomon.New(c.dataShards, c.parityShards)
+	if err != nil {
+		return nil, err
+	}
+	// Split refuses empty input, so pad it out; size trims it away again on decode
+	if len(data) == 0 {
+		data = []byte{0}
+	}
+	// Split pads shards out into data's spare capacity, which for a stripe is the next stripe
+	data = data[:len(data):len(data)]
+	shards, err := enc.Split(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// decodeShards rebuilds the original data from shards, where missing shards are nil.
+// At least c.dataShards entries must be present.
+func decodeShards(shards [][]byte, c Coding) ([]byte, error) {
+	if c.size == 0 {
+		return []byte{}, nil
+	}
+	if len(shards) != c.total() {
+		return nil, errors.New("decode shards: wrong number of shards for coding")
+	}
+	if c.parityShards == 0 {
+		return joinShards(shards, c.size)
+	}
+	enc, err := reedsolomon.New(c.dataShards, c.parityShards)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := enc.Join(&buf, shards, c.size); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rebuildShards fills in every missing (nil) data and parity shard in place.
+// At least c.dataShards entries must be present.
+func rebuildShards(shards [][]byte, c Coding) error {
+	if c.parityShards == 0 {
+		return errors.New("rebuild shards: no parity to rebuild from")
+	}
+	enc, err := reedsolomon.New(c.dataShards, c.parityShards)
+	if err != nil {
+		return err
+	}
+	return enc.Reconstruct(shards)
+}
+
+// splitShards cuts data into n contiguous pieces without any parity, the last one possibly shorter
+func splitShards(data []byte, n int) [][]byte {
+	per := (len(data) + n - 1) / n
+	shards := make([][]byte, n)
+	for i := range shards {
+		begin, end := i*per, (i+1)*per
+		if begin > len(data) {
+			begin = len(data)
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		shards[i] = data[begin:end]
+	}
+	return shards
+}
+
+// joinShards concatenates unencoded shards back into data of the given size
+func joinShards(shards [][]byte, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for _, shard := range shards {
+		if shard == nil {
+			return nil, errors.New("join shards: missing shard with no parity to rebuild it")
+		}
+		data = append(data, shard...)
+	}
+	if len(data) < size {
+		return nil, errors.New("join shards: shards shorter than original data")
+	}
+	return data[:size], nil
+}
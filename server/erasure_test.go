@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// encodeStripes shards every stripe of data straight out of data, as shardFile does
+func encodeStripes(t *testing.T, data []byte, c Coding) [][][]byte {
+	t.Helper()
+	stripes := make([][][]byte, c.stripes())
+	for j := range stripes {
+		begin, end := c.stripeBounds(j)
+		shards, err := encodeShards(data[begin:end], c.stripe(j))
+		if err != nil {
+			t.Fatalf("stripe %d: %v", j, err)
+		}
+		if len(shards) != c.total() {
+			t.Fatalf("stripe %d: got %d shards, want %d", j, len(shards), c.total())
+		}
+		// keep the shards apart from data, as they would be once sent to peers
+		for i := range shards {
+			shards[i] = append([]byte{}, shards[i]...)
+		}
+		stripes[j] = shards
+	}
+	return stripes
+}
+
+func TestStripedRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	codings := []Coding{
+		{dataShards: 4, parityShards: 2, stripeSize: 1000},
+		{dataShards: 3, parityShards: 2, stripeSize: 1001},
+		{dataShards: 1, parityShards: 0, stripeSize: 1000},
+		{dataShards: 4, parityShards: 0, stripeSize: 999},
+		{dataShards: 4, parityShards: 2},
+	}
+	for _, c := range codings {
+		for _, size := range []int{0, 1, 999, 1000, 1001, 3500, 4003} {
+			c.size = size
+			data := make([]byte, size)
+			rnd.Read(data)
+			want := append([]byte(nil), data...)
+			stripes := encodeStripes(t, data, c)
+			if !bytes.Equal(data, want) {
+				t.Fatalf("%+v: encoding wrote over the data", c)
+			}
+			var got []byte
+			for j, shards := range stripes {
+				// lose as many shards as the parity allows, from a different place in each stripe
+				for k := 0; k < c.parityShards; k++ {
+					shards[(j+k)%len(shards)] = nil
+				}
+				b, err := decodeShards(shards, c.stripe(j))
+				if err != nil {
+					t.Fatalf("%+v: decode stripe %d: %v", c, j, err)
+				}
+				got = append(got, b...)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%+v: round trip of %d bytes came back different", c, size)
+			}
+		}
+	}
+}
+
+func TestStoredSize(t *testing.T) {
+	for _, c := range []Coding{
+		{dataShards: 4, parityShards: 2, stripeSize: 1000},
+		{dataShards: 1, parityShards: 0, stripeSize: 1000},
+		{dataShards: 3, parityShards: 2},
+	} {
+		for _, size := range []int{0, 1, 1000, 2999, 3001} {
+			c.size = size
+			stored := 0
+			for _, shards := range encodeStripes(t, make([]byte, size), c) {
+				for _, shard := range shards {
+					stored += len(shard)
+				}
+			}
+			if c.storedSize() != stored {
+				t.Errorf("%+v: storedSize %d, encoded %d", c, c.storedSize(), stored)
+			}
+		}
+	}
+}
+
+func TestEncodeShardsLeavesSpareCapacity(t *testing.T) {
+	c := Coding{dataShards: 4, parityShards: 2, size: 1001, stripeSize: 1001}
+	buf := bytes.Repeat([]byte{0xAA}, 4096)
+	if _, err := encodeShards(buf[:c.size], c); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range buf[c.size:] {
+		if b != 0xAA {
+			t.Fatalf("byte %d past the data was overwritten", c.size+i)
+		}
+	}
+}
+
+func TestRebuildShards(t *testing.T) {
+	c := Coding{dataShards: 4, parityShards: 2, size: 5000}
+	data := make([]byte, c.size)
+	rand.New(rand.NewSource(2)).Read(data)
+	shards := encodeStripes(t, data, c)[0]
+	want := make([][]byte, len(shards))
+	copy(want, shards)
+	shards[0], shards[5] = nil, nil
+	if err := rebuildShards(shards, c); err != nil {
+		t.Fatal(err)
+	}
+	for i := range shards {
+		if !bytes.Equal(shards[i], want[i]) {
+			t.Errorf("shard %d rebuilt differently", i)
+		}
+	}
+}
+
+func TestCheckShardCounts(t *testing.T) {
+	for _, ok := range [][2]int{{4, 2}, {1, 1}, {128, 128}, {255, 1}} {
+		if err := checkShardCounts(ok[0], ok[1]); err != nil {
+			t.Errorf("%d+%d shards: %v", ok[0], ok[1], err)
+		}
+	}
+	for _, bad := range [][2]int{{0, 2}, {4, 0}, {-1, 2}, {4, -2}, {200, 57}, {256, 1}} {
+		if err := checkShardCounts(bad[0], bad[1]); err == nil {
+			t.Errorf("%d+%d shards were accepted", bad[0], bad[1])
+		}
+	}
+}
@@ -14,14 +14,22 @@ type FileMetaData struct {
 // File is composed of metadata and the raw file's bytes
 type File struct {
 	FileMetaData
-	data []byte
+	data       []byte
+	wrappedKey []byte    // file key sealed with the owner's password key, nil if data isn't encrypted
+	version    int       // numbered from 1 by upload, 0 in lookups means the current version
+	uploaded   time.Time // when the version was uploaded or last restored
 }
 
 // FilePart is a special File that is created from sharding another File
 type FilePart struct {
 	File
-	parent File
-	index  int
+	parent   File
+	index    int
+	kind     ShardKind
+	coding   Coding
+	replicas int    // number of distinct peers the part should be stored on
+	size     int    // length of data, kept once shardFile drops the data after delivering it
+	checksum string // hex SHA-256 of data, empty for parts stored before checksums
 }
 
 //FilePartRequest represents a request for a File Part
@@ -31,9 +39,8 @@ type FilePartRequest struct {
 }
 
 // FileFromMetaData gets the File for the provided metadata
-func FileFromMetaData(metadata map[string]interface{}) File {
-	seconds, _ := strconv.ParseInt(metadata["dateModified"].(string), 10, 64)
-	dateMod := time.Unix(seconds/1000, 0)
-	name := metadata["name"].(string)
-	return File{FileMetaData{name, dateMod}, []byte("")}
+func FileFromMetaData(metadata FileMeta) File {
+	millis, _ := strconv.ParseInt(metadata.DateModified, 10, 64)
+	dateMod := time.Unix(millis/1000, 0)
+	return File{FileMetaData: FileMetaData{metadata.Name, dateMod}, data: []byte(""), version: metadata.Version}
 }
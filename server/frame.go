@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+/*
+	From protocol version 3 every binary message is a self-describing Frame, so it no
+	longer has to follow the JSON message it belongs to. All integers are big-endian:
+
+		magic      2 bytes  "NF"
+		version    1 byte   frameVersion
+		type       1 byte   one of the Frame* types below
+		requestId  8 bytes  request the frame answers or announces, 0 if none
+		offset     8 bytes  position of the payload within the whole file or part
+		length     8 bytes  length of the payload
+		checksum  32 bytes  SHA-256 of the payload
+		nameLen    2 bytes  length of name
+		name       nameLen bytes, the file or part name
+		payload    length bytes
+
+	Sessions that negotiated an older version keep the legacy form, where the bytes are
+	sent bare as the binary message right after their JSON header.
+*/
+
+// FrameProtocolVersion is the first protocol version that uses Frames for binary messages
+const FrameProtocolVersion = 3
+
+const frameVersion = 1
+
+const frameHeaderSize = 2 + 1 + 1 + 8 + 8 + 8 + sha256.Size + 2
+
+var frameMagic = []byte("NF")
+
+// Frame types
+const (
+	// FrameFileData carries the bytes of an upload announced by a "file" message with the same request ID
+	FrameFileData byte = iota + 1
+	// FramePart carries a FilePart the server asks a peer to store. From version 4 its request ID
+	// is echoed in a "partStored" message once the peer holds the part.
+	FramePart
+	// FramePartResponse carries a peer's answer to the part request with the same request ID
+	FramePartResponse
+	// FrameFileResponse carries the bytes at Offset of a File a client requested.
+	// A download is streamed as several of them, followed by a "downloadComplete" message.
+	FrameFileResponse
+	// FrameUploadChunk carries the chunk at Offset of the chunked upload whose id is the frame's Name
+	FrameUploadChunk
+)
+
+// Frame is a binary message with its own header
+type Frame struct {
+	Type      byte
+	RequestID uint64
+	Name      string
+	Offset    uint64
+	Payload   []byte
+}
+
+// Marshal encodes the Frame for sending, computing its checksum
+func (f Frame) Marshal() []byte {
+	buf := make([]byte, frameHeaderSize+len(f.Name)+len(f.Payload))
+	copy(buf, frameMagic)
+	buf[2] = frameVersion
+	buf[3] = f.Type
+	binary.BigEndian.PutUint64(buf[4:], f.RequestID)
+	binary.BigEndian.PutUint64(buf[12:], f.Offset)
+	binary.BigEndian.PutUint64(buf[20:], uint64(len(f.Payload)))
+	sum := sha256.Sum256(f.Payload)
+	copy(buf[28:], sum[:])
+	binary.BigEndian.PutUint16(buf[28+sha256.Size:], uint16(len(f.Name)))
+	copy(buf[frameHeaderSize:], f.Name)
+	copy(buf[frameHeaderSize+len(f.Name):], f.Payload)
+	return buf
+}
+
+// ParseFrame decodes a binary message into a Frame, checking its length and checksum
+func ParseFrame(b []byte) (Frame, error) {
+	if len(b) < frameHeaderSize || !bytes.Equal(b[:2], frameMagic) {
+		return Frame{}, errors.New("frame: bad magic or truncated header")
+	}
+	if b[2] != frameVersion {
+		return Frame{}, errors.New("frame: unknown frame version")
+	}
+	f := Frame{Type: b[3]}
+	f.RequestID = binary.BigEndian.Uint64(b[4:])
+	f.Offset = binary.BigEndian.Uint64(b[12:])
+	length := binary.BigEndian.Uint64(b[20:])
+	checksum := b[28 : 28+sha256.Size]
+	nameLen := int(binary.BigEndian.Uint16(b[28+sha256.Size:]))
+	rest := b[frameHeaderSize:]
+	if uint64(len(rest)) != uint64(nameLen)+length {
+		return Frame{}, errors.New("frame: length doesn't match payload")
+	}
+	f.Name = string(rest[:nameLen])
+	f.Payload = rest[nameLen:]
+	if sum := sha256.Sum256(f.Payload); !bytes.Equal(sum[:], checksum) {
+		return Frame{}, errors.New("frame: checksum mismatch")
+	}
+	return f, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fetch flags. Parts of a stripe are fetched concurrently, and a part whose owner is slower
+// than hedgePercentile of recent part fetches is also requested from its next owner.
+var fetchParallelism = flag.Int("fetch-parallelism", 4, "maximum number of parts of a stripe fetched at once")
+var hedgePercentile = flag.Float64("hedge-percentile", 95, "percentile of recent part fetch latencies after which the next owner is asked too, 0 to never hedge")
+var hedgeDelay = flag.Duration("hedge-delay", 500*time.Millisecond, "hedge delay used until enough part fetch latencies have been recorded")
+
+// Number of recent latencies kept, and how many are needed before hedging follows them
+const (
+	latencySamples    = 1000
+	minLatencySamples = 20
+)
+
+// Latencies of recent successful part fetches, as a ring buffer
+var partLatency = struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+}{}
+
+// Record the latency of a successful part fetch
+func recordPartLatency(d time.Duration) {
+	partLatency.Lock()
+	defer partLatency.Unlock()
+	if len(partLatency.samples) < latencySamples {
+		partLatency.samples = append(partLatency.samples, d)
+		return
+	}
+	partLatency.samples[partLatency.next] = d
+	partLatency.next = (partLatency.next + 1) % latencySamples
+}
+
+// Get how long to wait for an owner before also asking the next one, and whether to hedge at all
+func hedgeAfter() (time.Duration, bool) {
+	if *hedgePercentile <= 0 {
+		return 0, false
+	}
+	partLatency.Lock()
+	samples := append([]time.Duration{}, partLatency.samples...)
+	partLatency.Unlock()
+	if len(samples) < minLatencySamples {
+		return *hedgeDelay, true
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	i := int(float64(len(samples)) * *hedgePercentile / 100)
+	if i >= len(samples) {
+		i = len(samples) - 1
+	}
+	return samples[i], true
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withLatencies gives the test empty part fetch latencies and its own hedging flags
+func withLatencies(t *testing.T) {
+	t.Helper()
+	partLatency.Lock()
+	oldSamples, oldNext := partLatency.samples, partLatency.next
+	partLatency.samples, partLatency.next = nil, 0
+	partLatency.Unlock()
+	oldPercentile, oldDelay, oldTimeout := *hedgePercentile, *hedgeDelay, *partTimeout
+	t.Cleanup(func() {
+		partLatency.Lock()
+		partLatency.samples, partLatency.next = oldSamples, oldNext
+		partLatency.Unlock()
+		*hedgePercentile, *hedgeDelay, *partTimeout = oldPercentile, oldDelay, oldTimeout
+	})
+}
+
+// hedgePeer connects cli as a peer that answers part requests with data after delay, or never if
+// it is negative, and returns a count of the requests it got
+func hedgePeer(t *testing.T, cli Client, data []byte, delay time.Duration) *int32 {
+	t.Helper()
+	s, conn := testSession(t, cli)
+	sessions.Add(s)
+	sessions.Register(s, cli, nil, ProtocolVersion, "")
+	var requests int32
+	go func() {
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg RequestMessage
+			if json.Unmarshal(b, &msg) != nil || msg.Type != "request" {
+				continue
+			}
+			atomic.AddInt32(&requests, 1)
+			if delay >= 0 {
+				time.AfterFunc(delay, func() { s.deliverTo(msg.RequestID, data) })
+			}
+		}
+	}()
+	return &requests
+}
+
+// hedgedRequest sets up a part held by a slow or silent peer and then a fast one, and the request for it
+func hedgedRequest(t *testing.T, slowDelay time.Duration) (FilePartRequest, *int32, *int32) {
+	t.Helper()
+	oldSessions := sessions
+	t.Cleanup(func() { sessions = oldSessions })
+	sessions = NewSessionRegistry()
+	data := []byte("part data")
+	slow, fast := Client{username: "slow"}, Client{username: "fast"}
+	slowRequests := hedgePeer(t, slow, data, slowDelay)
+	fastRequests := hedgePeer(t, fast, data, 0)
+	var fp FilePart
+	fp.name, fp.checksum = "p", hashBytes(data)
+	return FilePartRequest{[]Client{slow, fast}, fp}, slowRequests, fastRequests
+}
+
+func TestHedgeAfter(t *testing.T) {
+	withLatencies(t)
+	*hedgePercentile, *hedgeDelay = 95, 123*time.Millisecond
+	// Too few samples to go by uses the configured delay
+	for i := 1; i < minLatencySamples; i++ {
+		recordPartLatency(time.Second)
+	}
+	if d, ok := hedgeAfter(); !ok || d != *hedgeDelay {
+		t.Errorf("hedgeAfter with %d samples = %v, %v, want %v", minLatencySamples-1, d, ok, *hedgeDelay)
+	}
+
+	partLatency.Lock()
+	partLatency.samples = nil
+	partLatency.Unlock()
+	for i := 100; i >= 1; i-- {
+		recordPartLatency(time.Duration(i) * time.Millisecond)
+	}
+	for percentile, want := range map[float64]time.Duration{95: 96 * time.Millisecond, 50: 51 * time.Millisecond, 100: 100 * time.Millisecond, 0.5: time.Millisecond} {
+		*hedgePercentile = percentile
+		if d, ok := hedgeAfter(); !ok || d != want {
+			t.Errorf("hedgeAfter at percentile %v = %v, %v, want %v", percentile, d, ok, want)
+		}
+	}
+	*hedgePercentile = 0
+	if _, ok := hedgeAfter(); ok {
+		t.Error("hedged with hedging turned off")
+	}
+
+	// Only the newest latencySamples count
+	*hedgePercentile = 95
+	for i := 0; i < latencySamples; i++ {
+		recordPartLatency(time.Microsecond)
+	}
+	if d, _ := hedgeAfter(); d != time.Microsecond {
+		t.Errorf("hedgeAfter = %v once old latencies were replaced, want 1µs", d)
+	}
+}
+
+func TestHedgedFetchFromSlowPeer(t *testing.T) {
+	withLatencies(t)
+	*hedgePercentile, *hedgeDelay = 95, 20*time.Millisecond
+	req, slowRequests, fastRequests := hedgedRequest(t, 2*time.Second)
+
+	start := time.Now()
+	pt, ok := fetchPartFromOwners(context.Background(), req)
+	if !ok || !bytes.Equal(pt.data, []byte("part data")) {
+		t.Fatalf("fetch gave %q, %v", pt.data, ok)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("hedged fetch took %v, as long as the slow peer", elapsed)
+	}
+	if atomic.LoadInt32(slowRequests) != 1 || atomic.LoadInt32(fastRequests) != 1 {
+		t.Errorf("slow peer got %d requests and fast %d, want 1 each", atomic.LoadInt32(slowRequests), atomic.LoadInt32(fastRequests))
+	}
+	partLatency.Lock()
+	samples := len(partLatency.samples)
+	partLatency.Unlock()
+	if samples != 1 {
+		t.Errorf("recorded %d latencies, want the winning fetch's", samples)
+	}
+}
+
+func TestFetchWithoutHedging(t *testing.T) {
+	withLatencies(t)
+	*hedgePercentile = 0
+	req, slowRequests, fastRequests := hedgedRequest(t, 100*time.Millisecond)
+
+	// The fast peer is only asked if the slow one fails, and it doesn't
+	start := time.Now()
+	if _, ok := fetchPartFromOwners(context.Background(), req); !ok {
+		t.Fatal("fetch failed")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("fetch took %v, less than the slow peer needs", elapsed)
+	}
+	if atomic.LoadInt32(slowRequests) != 1 || atomic.LoadInt32(fastRequests) != 0 {
+		t.Errorf("slow peer got %d requests and fast %d, want 1 and 0", atomic.LoadInt32(slowRequests), atomic.LoadInt32(fastRequests))
+	}
+}
+
+func TestFetchFromSilentPeer(t *testing.T) {
+	withLatencies(t)
+	*hedgePercentile, *partTimeout = 0, 100*time.Millisecond
+	req, silentRequests, fastRequests := hedgedRequest(t, -1)
+
+	// Without hedging the next owner is asked once the silent one times out
+	start := time.Now()
+	pt, ok := fetchPartFromOwners(context.Background(), req)
+	if !ok || !bytes.Equal(pt.data, []byte("part data")) {
+		t.Fatalf("fetch gave %q, %v", pt.data, ok)
+	}
+	if elapsed := time.Since(start); elapsed < *partTimeout {
+		t.Errorf("fetch took %v, less than the part timeout", elapsed)
+	}
+	if atomic.LoadInt32(silentRequests) != 1 || atomic.LoadInt32(fastRequests) != 1 {
+		t.Errorf("silent peer got %d requests and fast %d, want 1 each", atomic.LoadInt32(silentRequests), atomic.LoadInt32(fastRequests))
+	}
+
+	// With nobody answering the fetch fails
+	req.owners = req.owners[:1]
+	if _, ok := fetchPartFromOwners(context.Background(), req); ok {
+		t.Error("fetched a part nobody sent")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+var badPartLimit = flag.Int("bad-part-limit", 3, "number of corrupted parts after which a peer is flagged")
+
+// verify checks the FilePart's data against the checksum recorded when it was sharded.
+// Parts stored before checksums were recorded always pass.
+func (fp FilePart) verify() bool {
+	return fp.checksum == "" || hashBytes(fp.data) == fp.checksum
+}
+
+// Record that Client c served a corrupted part, flagging it once it reaches badPartLimit
+func reportBadPart(c Client) {
+	n, err := database.RecordBadPart(c)
+	if err != nil {
+		log.Println("record bad part:", err)
+	} else if n >= *badPartLimit {
+		log.Println("Flagged peer", c.username, "after", n, "corrupted parts")
+	}
+}
@@ -4,29 +4,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Maps connection to key objects
-var connections = map[*websocket.Conn]Client{}
-var buffers = map[*websocket.Conn][]byte{}
-var waitGroups = map[*websocket.Conn]*sync.WaitGroup{}
+// Tracks every open connection and the Client it registered as
+var sessions = NewSessionRegistry()
 
-// Signleton instance for database, address flag
-var database = NewDatabase()
+// Singleton metadata store set up by main, address flag
+var database MetadataStore
 var addr = flag.String("addr", "0.0.0.0:8080", "http service address")
+var adminAddr = flag.String("admin-addr", "127.0.0.1:8081", "address serving operator endpoints such as /repair, keep it off public interfaces, empty to disable")
+var partTimeout = flag.Duration("part-timeout", 30*time.Second, "time a peer has to answer a part request before we ask another owner")
 
 // Singleton upgrader object
 var upgrader = websocket.Upgrader{
@@ -47,25 +50,30 @@ func upgradeToWebsocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn
 	return c, err
 }
 
-// Gets the current websocket object for a given Client
-func connForClient(c Client) *websocket.Conn {
-	for con, cli := range connections {
-		if cli.username == c.username {
-			return con
-		}
+// Gets the longest lived Session for a given Client, nil if it isn't connected
+func sessionForClient(c Client) *Session {
+	return sessions.First(c)
+}
+
+// Gets how long the Client has been connected, using its longest lived Session
+func clientUptime(c Client) time.Duration {
+	if s := sessionForClient(c); s != nil {
+		return s.Uptime()
 	}
-	return nil
+	return 0
 }
 
 // Main listener function for an accepted connection
 func listen(w http.ResponseWriter, r *http.Request) {
-	c, err := upgradeToWebsocket(w, r)
+	conn, err := upgradeToWebsocket(w, r)
 	if err != nil {
 		return
 	}
+	c := NewSession(conn)
+	sessions.Add(c)
 	defer func() {
 		c.Close()
-		delete(connections, c)
+		sessions.Remove(c)
 	}()
 	for {
 		mt, message, err := c.ReadMessage()
@@ -76,223 +84,819 @@ func listen(w http.ResponseWriter, r *http.Request) {
 		log.Println("Message type is:", mt)
 		if mt == websocket.TextMessage {
 			log.Printf("recv: %s", message)
-
-			var m map[string]interface{}
-			if err = json.Unmarshal(message, &m); err != nil {
-				log.Println("json unmarshal:", err)
-				return
+			if t, err := handleMessage(message, c); err != nil {
+				log.Println("handle", t, "message:", err)
+				c.WriteError(t, err)
 			}
-			t := m["type"].(string)
-			if t == "file" || t == "part" {
-				handleFileUpload(m, c)
-			} else if t == "registration" {
-				handleRegistration(m, c)
-			} else if t == "request" {
-				handleFileRequest(m, c)
-			} else {
-				log.Println("type: unknown json type:", t)
+		} else if c.UsesFrames() {
+			if err := handleFrame(message, c); err != nil {
+				log.Println("handle frame:", err)
+				c.WriteError("frame", err)
 			}
 		} else {
-			log.Println("Not text message, save to byte storage")
-			buffers[c] = message
-			if wt, ok := waitGroups[c]; ok {
-				wt.Done()
+			log.Println("Not text message, handing to oldest waiting part fetch")
+			if !c.deliver(message) {
+				log.Println("binary message with nobody waiting for it, dropped")
 			}
 		}
 	}
 }
 
-// Accept uploaded File over websocket c and then shard to peers
-func handleFileUpload(m map[string]interface{}, c *websocket.Conn) {
-	metadata := m["fileMeta"].(map[string]interface{})
-	f := FileFromMetaData(metadata)
-	f, err := getFileUpload(c, f)
+// Decode a text message from Session c and hand it to the handler for its type.
+// Returns the message's type along with any error to report back to the client.
+func handleMessage(message []byte, c *Session) (string, error) {
+	t, err := messageType(message)
 	if err != nil {
-		log.Println("couldn't get file upload", err)
-		return
+		return t, err
+	}
+	if _, ok := c.Client(); !ok && t != "register" && t != "login" && t != "registration" {
+		if t == "file" || t == "part" {
+			// The File's bytes follow the header, drop them with it
+			c.discardPayload()
+		}
+		return t, ProtocolError{ErrCodeNotRegistered, errors.New("register before sending " + t)}
+	}
+
+	switch t {
+	case "register", "login", "registration":
+		var msg RegistrationMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		switch t {
+		case "register":
+			return t, handleRegister(msg, c)
+		case "login":
+			return t, handleLogin(msg, c)
+		}
+		return t, handleRegistration(msg, c)
+	case "file", "part":
+		var msg FileMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			c.discardPayload()
+			return t, err
+		}
+		return t, handleFileUpload(msg, c)
+	case "uploadInit":
+		var msg UploadInitMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleUploadInit(msg, c)
+	case "uploadStatus":
+		var msg UploadStatusMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleUploadStatus(msg, c)
+	case "uploadCommit":
+		var msg UploadCommitMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		finishInBackground(t, c, func() error { return handleUploadCommit(msg, c) })
+		return t, nil
+	case "request":
+		var msg RequestMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		// Run downloads alongside the listen loop, which has to keep reading part
+		// responses and notice when the requester goes away
+		go func() {
+			if err := handleFileRequest(c.Context(), msg, c); err != nil {
+				log.Println("handle request message:", err)
+				c.WriteError(t, err)
+			}
+		}()
+		return t, nil
+	case "delete":
+		var msg DeleteMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleDelete(msg, c)
+	case "fileList":
+		var msg FileListMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleFileList(msg, c)
+	case "mkdir":
+		var msg MkdirMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleMkdir(msg, c)
+	case "move":
+		var msg MoveMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleMove(msg, c)
+	case "versions":
+		var msg VersionsMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleVersions(msg, c)
+	case "restore":
+		var msg RestoreMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleRestore(msg, c)
+	case "partResponse":
+		var msg PartResponseMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handlePartResponse(msg, c)
+	case "partStored":
+		var msg PartStoredMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handlePartStored(msg, message, c)
+	case "sessions":
+		var msg SessionsMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleSessionsRequest(c)
+	case "usage":
+		var msg UsageMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleUsage(c)
+	case "logout":
+		var msg LogoutMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleLogout(msg, c)
+	case "challengeResponse":
+		var msg ChallengeResponseMessage
+		if err := decodeMessage(message, &msg); err != nil {
+			return t, err
+		}
+		return t, handleChallengeResponse(msg, c)
+	}
+	return t, ProtocolError{ErrCodeUnknownType, errors.New("unknown message type " + t)}
+}
+
+// Decode a binary Frame from Session c and hand its payload to whoever is expecting it
+func handleFrame(message []byte, c *Session) error {
+	frame, err := ParseFrame(message)
+	if err != nil {
+		return badMessage("%v", err)
+	}
+	switch frame.Type {
+	case FramePartResponse:
+		if !c.deliverTo(frame.RequestID, frame.Payload) {
+			log.Println("part response: no outstanding request", frame.RequestID)
+		}
+		return nil
+	case FrameFileData:
+		msg, ok := c.takeUpload(frame.RequestID)
+		if !ok {
+			return ProtocolError{ErrCodeNotFound, fmt.Errorf("no file message announced upload %d", frame.RequestID)}
+		}
+		finishInBackground("file", c, func() error {
+			return finishFileUpload(msg, bytes.NewReader(frame.Payload), int64(len(frame.Payload)), c)
+		})
+		return nil
+	case FrameUploadChunk:
+		return handleUploadChunk(frame, c)
+	}
+	return badMessage("unexpected frame type %d", frame.Type)
+}
+
+// Route a peer's answer to a part request to the fetchPart waiting on it.
+// The header names the request ID and the part's bytes follow as the next binary message.
+func handlePartResponse(msg PartResponseMessage, c *Session) error {
+	if c.UsesFrames() {
+		return badMessage("partResponse: send the part as a FramePartResponse frame instead")
+	}
+	mt, message, err := c.ReadMessage()
+	if err != nil {
+		return err
+	} else if mt != websocket.BinaryMessage {
+		return badMessage("partResponse: peer sent non-byte data for request %d", msg.RequestID)
+	}
+	if !c.deliverTo(msg.RequestID, message) {
+		log.Println("part response: no outstanding request", msg.RequestID)
+	}
+	return nil
+}
+
+// Accept uploaded File over Session c and then shard to peers.
+// Sessions using Frames send the bytes later in a FrameFileData, legacy ones right after the header.
+func handleFileUpload(msg FileMessage, c *Session) error {
+	if err := checkSealing("file", msg.FileMeta, c); err != nil {
+		return err
+	}
+	if c.UsesFrames() {
+		if msg.RequestID == 0 {
+			return badMessage("file: requestId is required to match the upload's frame")
+		}
+		c.expectUpload(msg)
+		return nil
+	}
+	data, err := getFileUpload(c)
+	if err != nil {
+		return err
+	}
+	finishInBackground("file", c, func() error { return finishFileUpload(msg, bytes.NewReader(data), int64(len(data)), c) })
+	return nil
+}
+
+// checkSealing rejects a msgType upload from Session c that isn't sealed by the client when it should be,
+// or is when the client's protocol version doesn't allow it, see envelope.go
+func checkSealing(msgType string, fm FileMeta, c *Session) error {
+	if c.Version() >= ClientSealProtocolVersion && fm.WrappedKey == "" {
+		return badMessage("%s: fileMeta.wrappedKey is required, clients seal their files from protocol version %d", msgType, ClientSealProtocolVersion)
 	}
-	shardFile(f, c)
+	if c.Version() < ClientSealProtocolVersion && fm.WrappedKey != "" {
+		return badMessage("%s: fileMeta.wrappedKey needs protocol version %d", msgType, ClientSealProtocolVersion)
+	}
+	return nil
+}
+
+// Run the last step of an upload from Session c alongside the listen loop, which has to keep
+// reading the acknowledgements of peers storing its parts. Errors answer the msgType message.
+func finishInBackground(msgType string, c *Session, finish func() error) {
+	go func() {
+		if err := finish(); err != nil {
+			log.Println("handle", msgType, "message:", err)
+			c.WriteError(msgType, err)
+		}
+	}()
+}
+
+// Encrypt the size bytes of the upload announced by msg as they are read from data, and shard them to peers
+func finishFileUpload(msg FileMessage, data io.Reader, size int64, c *Session) error {
+	if err := checkUploadSize("file", size); err != nil {
+		return err
+	}
+	wrappedKey, err := msg.FileMeta.wrappedKey()
+	if err != nil {
+		return err
+	}
+	// Files the client sealed are stored as they were sent
+	if wrappedKey != nil {
+		if !validSealedSize(size) {
+			return badMessage("file: %d bytes isn't the size of a sealed file", size)
+		}
+		f := FileFromMetaData(msg.FileMeta)
+		f.wrappedKey = wrappedKey
+		return shardFile(f, data, int(size), c, ReplicasFromMetaData(msg.FileMeta))
+	}
+	f, sealed, err := storeFileUpload(c, FileFromMetaData(msg.FileMeta), data, size)
+	if err != nil {
+		return err
+	}
+	return shardFile(f, sealed, int(sealed.Size()), c, ReplicasFromMetaData(msg.FileMeta))
+}
+
+// Handle a new user's "register" message from Session c, creating their account and logging them in
+func handleRegister(msg RegistrationMessage, c *Session) error {
+	client, err := ClientFromMetaData(msg.UserMeta)
+	if err != nil {
+		return err
+	}
+	if err := database.CreateClient(client); errors.Is(err, ErrConflict) {
+		return ProtocolError{ErrCodeConflict, errors.New("username " + client.username + " is taken")}
+	} else if err != nil {
+		return err
+	}
+	log.Println("Added client", client.username)
+	return startSession(msg, client, c, "registered")
+}
+
+// Handle a returning user's "login" message from Session c, with either their password or a session token
+func handleLogin(msg RegistrationMessage, c *Session) error {
+	if msg.Token != "" {
+		claims, passwordKey, err := ParseToken(msg.Token, msg.UserMeta.Name)
+		if err != nil {
+			return err
+		}
+		client := Client{username: claims.User}
+		return registerSession(c, client, passwordKey, claims.ID, msg.Version, RegisteredMessage{Type: "loggedIn"})
+	}
+	client, err := authenticate(msg.UserMeta)
+	if err != nil {
+		return err
+	}
+	return startSession(msg, client, c, "loggedIn")
 }
 
-// Handle user's initial connection registration from websocket c
-func handleRegistration(m map[string]interface{}, c *websocket.Conn) {
-	metadata := m["userMeta"].(map[string]interface{})
-	client := ClientFromMetaData(metadata)
-	log.Println("Adding client", client)
-	connections[c] = client
-	database.AddClient(client)
+// Handle the legacy "registration" message from Session c, which logs in and creates the account if it's new
+func handleRegistration(msg RegistrationMessage, c *Session) error {
+	client, err := ClientFromMetaData(msg.UserMeta)
+	if err != nil {
+		return err
+	}
+	if err := database.CreateClient(client); errors.Is(err, ErrConflict) {
+		if client, err = authenticate(msg.UserMeta); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return startSession(msg, client, c, "registered")
+}
+
+// Check the credentials in meta against the stored password hash, upgrading the hash if it's outdated
+func authenticate(meta UserMeta) (Client, error) {
+	client, err := database.LookupClient(meta.Name)
+	if errors.Is(err, ErrNotFound) {
+		return Client{}, ProtocolError{ErrCodeUnauthorized, errors.New("wrong username or password")}
+	} else if err != nil {
+		return Client{}, err
+	}
+	ok, rehash := VerifyPassword(meta.Pass, client.password)
+	if !ok {
+		log.Println("Failed login for client", client.username)
+		return Client{}, ProtocolError{ErrCodeUnauthorized, errors.New("wrong username or password")}
+	}
+	if rehash {
+		passwordHash, err := HashPassword(meta.Pass)
+		if err != nil {
+			log.Println("rehash password:", err)
+			return client, nil
+		}
+		log.Println("Upgrading password hash of client", client.username)
+		if err := database.SetPasswordHash(client, passwordHash); err != nil {
+			log.Println("rehash password:", err)
+			return client, nil
+		}
+		client.password = passwordHash
+	}
+	return client, nil
+}
+
+// Register the client msg authenticated with its password on Session c, issuing them a session token
+// if msg asked to be remembered
+func startSession(msg RegistrationMessage, client Client, c *Session, reply string) error {
+	salt, err := database.KeySaltForClient(client)
+	if err != nil {
+		return err
+	}
+	passwordKey := PasswordKey(msg.UserMeta.Pass, salt)
+	answer := RegisteredMessage{Type: reply}
+	if !msg.Remember {
+		return registerSession(c, client, passwordKey, "", msg.Version, answer)
+	}
+	token, st, err := IssueToken(client, passwordKey)
+	if err != nil {
+		return err
+	}
+	answer.Token, answer.TokenExpires = token, strconv.FormatInt(st.expires.Unix(), 10)
+	return registerSession(c, client, passwordKey, st.id, msg.Version, answer)
+}
+
+// Register client on Session c under the session token with tokenID, then send answer filled in
+// with the protocol version negotiated from requested, followed by the client's file list
+func registerSession(c *Session, client Client, passwordKey []byte, tokenID string, requested int, answer RegisteredMessage) error {
+	answer.Version = negotiateVersion(requested)
+	answer.SessionID = c.ID()
+	sessions.Register(c, client, passwordKey, answer.Version, tokenID)
+	if err := c.WriteJSON(answer); err != nil {
+		return err
+	}
 	sendUsersFileMetaData(c)
+	sendPendingDeletions(c)
+	return nil
 }
 
-// Handle request for a particular File
-func handleFileRequest(m map[string]interface{}, c *websocket.Conn) {
-	metadata := m["fileMeta"].(map[string]interface{})
-	f := FileFromMetaData(metadata)
-	f = database.GetFile(f.name, connections[c])
-	reqs := database.FilePartRequestsForFile(f, connections[c])
+// Handle request for a particular File, its current version unless the message names another.
+// Outstanding part fetches are abandoned once ctx is done.
+// Sessions using Frames get the File streamed as it is fetched, legacy ones get it whole.
+func handleFileRequest(ctx context.Context, msg RequestMessage, c *Session) error {
+	client, _ := c.Client()
+	f := FileFromMetaData(msg.FileMeta)
+	f, err := database.GetFile(f.name, f.version, client)
+	if err != nil {
+		return err
+	}
+	reqs, err := database.FilePartRequestsForFile(f, client)
+	if err != nil {
+		return err
+	}
 	log.Println("Number of reqs:", len(reqs))
-	for _, req := range reqs {
-		var reqCon *websocket.Conn
-		i := 0
-		for reqCon == nil {
-			if i >= len(req.owners) {
-				// out of bounds
-				log.Panicln("No available peers to fetch part from.")
-				return
-			}
-			reqCon = connForClient(req.owners[i])
-			i++
+	if len(reqs) == 0 {
+		return ProtocolError{ErrCodeUnavailable, errors.New("no parts stored for file " + f.name)}
+	}
+	if clientWrapped(f.wrappedKey) && c.Version() < ClientSealProtocolVersion {
+		return ProtocolError{ErrCodeUnavailable, fmt.Errorf("file %s was sealed by a client and needs protocol version %d", f.name, ClientSealProtocolVersion)}
+	}
+	if c.UsesFrames() {
+		return streamFile(ctx, c, f, reqs, msg.RequestID)
+	}
+	data, err := assembleFile(ctx, reqs)
+	if err != nil {
+		return ProtocolError{ErrCodeUnavailable, fmt.Errorf("assemble file %s: %v", f.name, err)}
+	}
+	// Files uploaded before encryption have no key and are stored as plaintext
+	if f.wrappedKey != nil {
+		if data, err = OpenFile(data, f.wrappedKey, c.PasswordKey()); err != nil {
+			return fmt.Errorf("decrypt file %s: %v", f.name, err)
 		}
-
-		pt := fetchPart(reqCon, req.filePart)
-		f.data = append(f.data, pt.data...)
 	}
+	f.data = data
 	log.Println("About to send file ", f.name)
-	sendFileResponse(c, f)
+	return sendFileResponse(c, f, msg.RequestID)
 }
 
-// Send full File f to client via websocket c
-func sendFileResponse(c *websocket.Conn, f File) {
-	json := "{\"type\" : \"response\", \"fileMeta\" : { \"name\" : \"" + f.name + "\" } }"
-	if err := c.WriteMessage(websocket.TextMessage, []byte(json)); err != nil {
-		log.Println("send file response json: ", err)
-		return
+// Fetch enough of the FileParts in reqs from peers to rebuild the original File's data.
+// Assumes reqs is sorted by index, so data shards are tried before parity shards.
+func assembleFile(ctx context.Context, reqs []FilePartRequest) ([]byte, error) {
+	if len(reqs) == 0 {
+		return nil, errors.New("no parts stored for file")
+	}
+	var data []byte
+	err := streamStripes(ctx, reqs, func(stripe []byte) error {
+		data = append(data, stripe...)
+		return nil
+	})
+	return data, err
+}
+
+// Fetch the first coding.dataShards FileParts of a stripe in reqs that a peer can provide,
+// indexed by their position in the stripe. Parts that weren't fetched are left nil.
+// Up to fetchParallelism parts are fetched at once, preferring the earliest in reqs.
+func fetchShards(ctx context.Context, reqs []FilePartRequest, coding Coding) ([][]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type fetched struct {
+		req  FilePartRequest
+		part FilePart
+		ok   bool
+	}
+	results := make(chan fetched, len(reqs))
+	shards := make([][]byte, coding.total())
+	have, inFlight, next := 0, 0, 0
+	for {
+		// Only ask for as many parts as could still be missing
+		for next < len(reqs) && inFlight < *fetchParallelism && have+inFlight < coding.dataShards {
+			req := reqs[next]
+			next++
+			if coding.shardOf(req.filePart.index) >= len(shards) {
+				log.Println("fetch shards: part index out of range:", req.filePart.index)
+				continue
+			}
+			inFlight++
+			go func() {
+				pt, ok := fetchPartFromOwners(ctx, req)
+				results <- fetched{req, pt, ok}
+			}()
+		}
+		if have == coding.dataShards || inFlight == 0 {
+			break
+		}
+		r := <-results
+		inFlight--
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		} else if !r.ok {
+			log.Println("No available peers to fetch", r.req.filePart.kind, "part", r.req.filePart.index, "from")
+			continue
+		}
+		shards[coding.shardOf(r.req.filePart.index)] = r.part.data
+		have++
+	}
+	if have < coding.dataShards {
+		return nil, fmt.Errorf("only %d of the %d parts needed are available", have, coding.dataShards)
+	}
+	return shards, nil
+}
+
+// Fetch the FilePart for req from its owners' connected Sessions, the first valid answer winning.
+// Each attempt gets partTimeout. The next Session is asked once an attempt fails, or as a hedge
+// once it has taken longer than hedgeAfter, and outstanding attempts are cancelled when one wins.
+func fetchPartFromOwners(ctx context.Context, req FilePartRequest) (FilePart, bool) {
+	type holder struct {
+		owner Client
+		con   *Session
+	}
+	var holders []holder
+	for _, o := range req.owners {
+		for _, con := range sessions.ForClient(o) {
+			holders = append(holders, holder{o, con})
+		}
+	}
+	if len(holders) == 0 {
+		return FilePart{}, false
 	}
-	if err := c.WriteMessage(websocket.BinaryMessage, f.data); err != nil {
-		log.Println("send user requested file:", err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type attempt struct {
+		holder
+		part FilePart
+		err  error
+	}
+	results := make(chan attempt, len(holders))
+	next, inFlight := 0, 0
+	ask := func() {
+		h := holders[next]
+		next++
+		inFlight++
+		go func() {
+			partCtx, cancel := context.WithTimeout(ctx, *partTimeout)
+			defer cancel()
+			start := time.Now()
+			pt, err := fetchPart(partCtx, h.con, req.filePart)
+			if err == nil && len(pt.data) > 0 {
+				recordPartLatency(time.Since(start))
+			}
+			results <- attempt{h, pt, err}
+		}()
+	}
+
+	var hedge <-chan time.Time
+	askAndHedge := func() {
+		ask()
+		hedge = nil
+		if delay, ok := hedgeAfter(); ok && next < len(holders) {
+			hedge = time.After(delay)
+		}
+	}
+	askAndHedge()
+	for inFlight > 0 {
+		select {
+		case a := <-results:
+			inFlight--
+			switch {
+			case a.err != nil:
+				if ctx.Err() == nil {
+					log.Println("fetch part", req.filePart.name, "from", a.owner.username, ":", a.err)
+				}
+			case len(a.part.data) == 0:
+			case !a.part.verify():
+				log.Println("Part", a.part.name, "from", a.owner.username, "failed its checksum, trying next owner")
+				reportBadPart(a.owner)
+			default:
+				return a.part, true
+			}
+			if next < len(holders) {
+				askAndHedge()
+			}
+		case <-hedge:
+			log.Println("Part", req.filePart.name, "is slow, also asking", holders[next].owner.username)
+			askAndHedge()
+		case <-ctx.Done():
+			return FilePart{}, false
+		}
 	}
+	return FilePart{}, false
 }
 
-// Provide the Client connected via websocket c a list of FileMetaData for the files they are storing.
+// Send full File f to client via Session c, in answer to its request with requestID
+func sendFileResponse(c *Session, f File, requestID uint64) error {
+	frame := Frame{Type: FrameFileResponse, RequestID: requestID, Name: f.name, Payload: f.data}
+	return c.WritePayload(ResponseMessage{"response", FileMeta{Name: f.name}}, frame)
+}
+
+// Provide the Client connected via Session c a list of FileMetaData for the files they are storing,
+// in the directory the Session lists, see directories.go.
 // Sent when a connection is established and a Client can see what they've stored on nfinite.space.
-func sendUsersFileMetaData(c *websocket.Conn) {
-	json := "{ \"type\" : \"fileList\", \"files\" : [ "
-	files := database.ClientsFiles(connections[c])
-	for i, f := range files {
-		json += " { \"fileMeta\" : { "
-		json += "\"name\" : \"" + f.name + "\", \"lastModified\" : \"" + strconv.FormatInt(f.modified.Unix(), 10) + "\" } }"
-		if i != len(files)-1 {
-			json += ", "
-		}
-	}
-	json += " ] }"
-	if err := c.WriteMessage(websocket.TextMessage, []byte(json)); err != nil {
+func sendUsersFileMetaData(c *Session) {
+	client, _ := c.Client()
+	dir, recursive := c.Listing()
+	var dirs []string
+	if c.Version() < DirectoryProtocolVersion {
+		dir, recursive = "", true
+	} else {
+		var err error
+		if dirs, err = database.Directories(dirPrefix(dir), client); err != nil {
+			log.Println("send users files metadata:", err)
+			c.WriteError("fileList", err)
+			return
+		}
+	}
+	files, err := database.ClientsFiles(dirPrefix(dir), client)
+	if err != nil {
+		log.Println("send users files metadata:", err)
+		c.WriteError("fileList", err)
+		return
+	}
+	msg := FileListMessage{Type: "fileList", Prefix: dir, Recursive: recursive, Files: []FileListEntry{}}
+	for _, entry := range listDirectory(files, dirs, dir, recursive) {
+		// Older clients only know Files
+		if !entry.Directory || c.Version() >= DirectoryProtocolVersion {
+			msg.Files = append(msg.Files, entry)
+		}
+	}
+	if err := c.WriteJSON(msg); err != nil {
 		log.Println("send users files metadata:", err)
 	}
 }
 
-// Accepted the uploaded file and put the file data into File f
-func getFileUpload(c *websocket.Conn, f File) (File, error) {
+// Accept the bare uploaded file bytes following a legacy "file" header
+func getFileUpload(c *Session) ([]byte, error) {
 	mt, message, err := c.ReadMessage()
-	if mt != websocket.BinaryMessage {
-		log.Println("file upload: client tried to upload non-byte data:", mt, message)
-		return File{}, errors.New("file upload: client tried to upload non-byte data")
-	} else if err != nil {
+	if err != nil {
 		log.Println("file upload:", err)
-		return File{}, err
-	}
-	log.Println("Client is", connections[c])
-	if database.DoesFileExist(f, connections[c]) {
-		return File{}, errors.New("File doesn't exist in database")
-	}
-	f.data = message
-	if cli, ok := connections[c]; ok {
-		database.InsertFile(f, cli)
-		return f, nil
-	}
-	return f, errors.New("No client found for websocket on uploaded file")
-}
-
-// Shard File f and distribute it round-robin style to connected Clients
-func shardFile(f File, c *websocket.Conn) {
-	splitAmount := len(f.data) / (len(connections) - 1)
-	sp := splitAmount
-	begin := 0
-	i := 0
-	log.Println("Length of data is", len(f.data))
-	for con, cli := range connections {
-		// Don't send part back to owner
-		if con == c {
-			continue
+		return nil, err
+	} else if mt != websocket.BinaryMessage {
+		log.Println("file upload: client tried to upload non-byte data:", mt, message)
+		return nil, badMessage("file upload: client tried to upload non-byte data")
+	}
+	return message, nil
+}
+
+// Start encrypting the size bytes of an upload read from data into File f for the Session's Client.
+// Uploading a name the Client already has stores a new version of that File, see versions.go.
+func storeFileUpload(c *Session, f File, data io.Reader, size int64) (File, *FileSealer, error) {
+	var err error
+	var sealed *FileSealer
+	cli, _ := c.Client()
+	log.Println("Client is", cli.username)
+	sealed, f.wrappedKey, err = NewFileSealer(data, size, c.PasswordKey())
+	if err != nil {
+		return File{}, nil, err
+	}
+	return f, sealed, nil
+}
+
+// Shard the size sealed bytes of File f read from sealed into data and parity parts and distribute them
+// to the Clients chosen by the placement policy. If replicas is above zero, f is instead stored whole on
+// that many distinct Clients. Only one stripe is read and held at a time, its parts are delivered before
+// the next is read. f is only recorded once every Client has acknowledged its parts, see deliver.go,
+// as the newest version of its name.
+func shardFile(f File, sealed io.Reader, size int, c *Session, replicas int) error {
+	owner, _ := c.Client()
+	candidates := peerCandidates(owner)
+	if len(candidates) == 0 {
+		return ProtocolError{ErrCodeUnavailable, errors.New("no peers connected to store " + f.name)}
+	}
+	version, err := nextVersion(f, owner)
+	if err != nil {
+		return err
+	}
+	f.version = version
+	f.uploaded = time.Now()
+	// The version can still be taken by a racing upload, the nonce keeps this upload's parts its own
+	nonce, err := newPartNonce()
+	if err != nil {
+		return err
+	}
+
+	coding := NewCoding(size)
+	copies := 1
+	if replicas > 0 {
+		coding = NewReplicaCoding(size)
+		copies = replicas
+	}
+	log.Println("Length of data is", size, "split into", coding.stripes(), "stripes of", coding.dataShards, "data and", coding.parityShards, "parity shards with", copies, "copies each")
+	holders := copies
+	if len(candidates) < coding.total()*copies {
+		log.Println("shard file: only", len(candidates), "peers for", coding.total()*copies, "part copies, some peers will hold several")
+		if holders > len(candidates) {
+			holders = len(candidates)
 		}
+	}
+	if err := checkQuota(owner, coding.storedSize()*holders); err != nil {
+		return err
+	}
 
-		// Edge case where integer division cuts off last bit
-		if splitAmount == len(f.data)-1 {
-			splitAmount++
+	placed := make([]PlacedPart, 0, coding.stripes()*coding.total())
+	for j := 0; j < coding.stripes(); j++ {
+		stripe, err := shardStripe(f, nonce, sealed, coding, j, copies)
+		if err != nil {
+			discardParts(placed)
+			return err
+		}
+		var stripePlaced []PlacedPart
+		for k, holders := range placeStripe(placement, candidates, stripe) {
+			stripePlaced = append(stripePlaced, PlacedPart{stripe[k], holders, NewChallenges(stripe[k], *challengesPerPart)})
+		}
+		if err := deliverParts(stripePlaced); err != nil {
+			discardParts(placed)
+			return err
+		}
+		// Holders have the bytes now, only the parts' sizes and challenges are still needed
+		for k := range stripePlaced {
+			stripePlaced[k].part.data = nil
 		}
+		placed = append(placed, stripePlaced...)
+	}
 
-		log.Println("Begin: ", begin, " splitAmt: ", splitAmount)
-		fpData := f.data[begin:splitAmount]
+	if err := database.SaveUpload(f, owner, placed); err != nil {
+		discardParts(placed)
+		return err
+	}
+	pruneVersions(f, owner)
+	return nil
+}
 
+// Read stripe j of File f from sealed and shard it into its parts, named after the upload's nonce, see Coding.
+// Part i is shard i%total of stripe i/total.
+func shardStripe(f File, nonce string, sealed io.Reader, coding Coding, j int, copies int) ([]FilePart, error) {
+	sc := coding.stripe(j)
+	data := make([]byte, sc.size)
+	if _, err := io.ReadFull(sealed, data); err != nil {
+		return nil, fmt.Errorf("shard file: read stripe %d: %v", j, err)
+	}
+	shards, err := encodeShards(data, sc)
+	if err != nil {
+		return nil, fmt.Errorf("shard file: stripe %d: %v", j, err)
+	}
+	parts := make([]FilePart, len(shards))
+	for k, shard := range shards {
+		i := j*coding.total() + k
 		// Create new file part
 		fp := FilePart{}
-		fp.name = hash(fmt.Sprintf("%s%v", f.name, con))
+		fp.name = partName(nonce, i)
 		fp.parent = f
 		fp.modified = f.modified
 		fp.index = i
-		fp.data = fpData
+		fp.kind = coding.kindForIndex(i)
+		fp.coding = coding
+		fp.replicas = copies
+		fp.data = shard
+		fp.size = len(shard)
+		fp.checksum = hashBytes(shard)
+		parts[k] = fp
+	}
+	return parts, nil
+}
 
-		log.Println("DEBUG: created fp: ", fp.name, fp.index, fp.parent.name)
+// newPartNonce returns a random nonce to name the parts of one upload after
+func newPartNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// partName derives the name of part i of the upload with nonce. Nothing about the File goes
+// into it, so uploads never share part names whatever their owner, name, version or mtime,
+// and moving a File leaves its parts' names behind.
+func partName(nonce string, i int) string {
+	return hash(nonce + "|" + strconv.Itoa(i))
+}
 
-		database.AddFilePart(fp, connections[c], cli)
-		sendPart(con, fp)
-		begin = splitAmount
-		splitAmount += sp
-		i++
+// Gets the connected Clients that could store parts for owner, sorted by username.
+// The owner is left out and a Client connected more than once is only listed once.
+func peerCandidates(owner Client) []Client {
+	var candidates []Client
+	for _, cli := range sessions.Clients() {
+		if cli.username != owner.username {
+			candidates = append(candidates, cli)
+		}
 	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].username < candidates[j].username
+	})
+	return candidates
 }
 
-// Get the FilePart fp from client connected over websocket c.
-// Use WaitGroup to hold until we've received the FilePart.
-func fetchPart(c *websocket.Conn, fp FilePart) FilePart {
-	json := "{\"type\" : \"request\", \"fileMeta\" : { \"name\" : \"" + fp.name + "\" } }"
-	if err := c.WriteMessage(websocket.TextMessage, []byte(json)); err != nil {
-		log.Println("send request json: ", err)
-		return FilePart{}
+// Get the FilePart fp from client connected over Session c.
+// Hold until the Session's listen loop hands us the response carrying our request ID,
+// ctx is done or the peer disconnects.
+func fetchPart(ctx context.Context, c *Session, fp FilePart) (FilePart, error) {
+	id, response := c.expect()
+	defer c.cancelRequest(id)
+	if err := c.WriteJSON(RequestMessage{"request", id, FileMeta{Name: fp.name}}); err != nil {
+		return FilePart{}, err
 	}
 	log.Println("Sent request to client for part", fp.name)
-	wt := sync.WaitGroup{}
-	wt.Add(1)
-	waitGroups[c] = &wt
-	wt.Wait()
-	log.Println("Got response from client for part", fp.name)
-	delete(waitGroups, c)
-	message := buffers[c]
-	fp.data = message
-	return fp
-}
-
-// Sends the provided FilePart f to the client connected over the websocket c
-func sendPart(c *websocket.Conn, f FilePart) {
-	json := "{\"type\" : \"part\", \"fileMeta\" : { \"name\" : \"" + f.name + "\", \"dateModified\" : \"" + strconv.FormatInt(f.modified.Unix(), 10) + "\" } }"
-	log.Println("Sending json: ", json)
-	if err := c.WriteMessage(websocket.TextMessage, []byte(json)); err != nil {
-		log.Println("send part json: ", err)
-		return
-	}
-	if err := c.WriteMessage(websocket.BinaryMessage, f.data); err != nil {
-		log.Println("send part data: ", err)
-		return
+	select {
+	case fp.data = <-response:
+		log.Println("Got response from client for part", fp.name)
+		return fp, nil
+	case <-ctx.Done():
+		return FilePart{}, ctx.Err()
+	case <-c.Context().Done():
+		return FilePart{}, errors.New("peer disconnected")
 	}
 }
 
-// Sends the provided File f to the client connected over the websocket c
-func sendFile(c *websocket.Conn, f File) {
-	json := "{\"type\" : \"file\", \"fileMeta\" : { \"name\" : \"" + f.name + "\", \"dateModified\" : \"" + strconv.FormatInt(f.modified.Unix(), 10) + "\" } }"
-	log.Println("Sending json: ", json)
-	if err := c.WriteMessage(websocket.TextMessage, []byte(json)); err != nil {
-		log.Println("send file json: ", err)
-		return
-	}
-	if err := c.WriteMessage(websocket.BinaryMessage, f.data); err != nil {
-		log.Println("send file data: ", err)
-		return
+// Sends the provided FilePart f to the client connected over the Session c, requestID is 0 unless it should acknowledge it
+func sendPart(c *Session, f FilePart, requestID uint64) error {
+	msg := PartMessage{"part", FileMeta{Name: f.name, DateModified: strconv.FormatInt(f.modified.Unix(), 10)}}
+	log.Println("Sending part", f.name)
+	return c.WritePayload(msg, Frame{Type: FramePart, RequestID: requestID, Name: f.name, Payload: f.data})
+}
+
+// Sends the provided File f to the client connected over the Session c
+func sendFile(c *Session, f File) {
+	msg := FileMessage{Type: "file", FileMeta: FileMeta{Name: f.name, DateModified: strconv.FormatInt(f.modified.Unix(), 10)}}
+	log.Println("Sending file", f.name)
+	if err := c.WritePayload(msg, Frame{Type: FrameFileResponse, Name: f.name, Payload: f.data}); err != nil {
+		log.Println("send file: ", err)
 	}
 }
 
 // Compiles the original file from the file parts, assumes fps is sorted by index
-func sendFileFromParts(c *websocket.Conn, fps []FilePart, original File) {
-	file := File{FileMetaData{original.name, original.modified}, []byte("")}
+func sendFileFromParts(c *Session, fps []FilePart, original File) {
+	file := File{FileMetaData: FileMetaData{original.name, original.modified}, data: []byte("")}
 	for _, fp := range fps {
 		file.data = append(file.data, fp.data...)
 	}
@@ -306,9 +910,56 @@ func hash(s string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// Gets hash of provided bytes
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
 func main() {
 	flag.Parse()
 	log.SetFlags(0)
+	if err := checkShardCounts(*dataShards, *parityShards); err != nil {
+		log.Fatalln("coding:", err)
+	}
+	database = NewMetadataStore(*storeKind)
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(database, flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if err := prepareSchema(database); err != nil {
+		log.Fatalln("schema:", err)
+	}
+	policy, err := NewPlacementPolicy(*placementFlag)
+	if err != nil {
+		log.Fatalln("placement:", err)
+	}
+	placement = policy
+	if tokenKey, err = loadTokenKey(); err != nil {
+		log.Fatalln("token key:", err)
+	}
+	if *repairInterval > 0 {
+		go repairDaemon()
+	}
+	if *challengeInterval > 0 {
+		go challengeDaemon()
+	}
+	go uploadDaemon()
+	if *tokenPurgeInterval > 0 {
+		go tokenPurgeDaemon()
+	}
+	if *keepVersions > 0 && *keepVersionsFor > 0 && *versionPruneInterval > 0 {
+		go versionDaemon()
+	}
+	if *adminAddr != "" {
+		admin := http.NewServeMux()
+		admin.HandleFunc("/repair", handleRepairReport)
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminAddr, admin))
+		}()
+	}
 	http.HandleFunc("/", listen)
 	log.Println("Now listening...")
 	log.Fatal(http.ListenAndServe(*addr, nil))
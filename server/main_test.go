@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPartNamesDontCollide(t *testing.T) {
+	seen := map[string]bool{}
+	for u := 0; u < 2; u++ {
+		// Two uploads of the same File, as when one is moved away and uploaded again or two race
+		nonce, err := newPartNonce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 64; i++ {
+			name := partName(nonce, i)
+			if seen[name] {
+				t.Fatalf("part %d of upload %d reuses name %s", i, u, name)
+			}
+			seen[name] = true
+			if partName(nonce, i) != name {
+				t.Fatal("part names aren't stable")
+			}
+		}
+	}
+}
+
+// placedUpload gives the parts of an upload with a fresh nonce, all held by holder
+func placedUpload(t *testing.T, n int, holder Client) []PlacedPart {
+	t.Helper()
+	nonce, err := newPartNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make([]PlacedPart, n)
+	for i := range parts {
+		var fp FilePart
+		fp.name, fp.index, fp.coding = partName(nonce, i), i, Coding{n, 0, n, 0}
+		parts[i] = PlacedPart{fp, []Client{holder}, nil}
+	}
+	return parts
+}
+
+func TestRacingUploadKeepsWinnersParts(t *testing.T) {
+	oldDatabase, oldSessions := database, sessions
+	defer func() { database, sessions = oldDatabase, oldSessions }()
+	database, sessions = NewMemoryStore(), NewSessionRegistry()
+
+	alice, bob := Client{username: "alice"}, Client{username: "bob"}
+	for _, c := range []Client{alice, bob} {
+		if err := database.CreateClient(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Both uploads read the same next version before either was recorded
+	f := File{FileMetaData: FileMetaData{"a.txt", time.Unix(5, 0)}, version: 1, uploaded: time.Now()}
+	winner, loser := placedUpload(t, 3, bob), placedUpload(t, 3, bob)
+	if err := database.SaveUpload(f, alice, winner); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SaveUpload(f, alice, loser); !errors.Is(err, ErrConflict) {
+		t.Fatalf("second upload of version 1 gave %v, want ErrConflict", err)
+	}
+	discardParts(loser)
+
+	pending, err := database.PendingDeletions(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := map[string]bool{}
+	for _, name := range pending {
+		queued[name] = true
+	}
+	for _, p := range loser {
+		if !queued[p.part.name] {
+			t.Errorf("losing upload's part %s wasn't queued for deletion", p.part.name)
+		}
+	}
+	for _, p := range winner {
+		if queued[p.part.name] {
+			t.Errorf("winning upload's part %s was queued for deletion", p.part.name)
+		}
+	}
+}
+
+func TestMoveThenUploadKeepsMovedParts(t *testing.T) {
+	oldDatabase, oldSessions := database, sessions
+	defer func() { database, sessions = oldDatabase, oldSessions }()
+	database, sessions = NewMemoryStore(), NewSessionRegistry()
+
+	alice, bob := Client{username: "alice"}, Client{username: "bob"}
+	for _, c := range []Client{alice, bob} {
+		if err := database.CreateClient(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "a" moved to "b" and then uploaded again with the same mtime gets the same version as before
+	f := File{FileMetaData: FileMetaData{"a", time.Unix(5, 0)}, version: 1, uploaded: time.Now()}
+	moved := placedUpload(t, 3, bob)
+	if err := database.SaveUpload(f, alice, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Move("a", "b", alice); err != nil {
+		t.Fatal(err)
+	}
+	again := placedUpload(t, 3, bob)
+	if err := database.SaveUpload(f, alice, again); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.DeleteFile(f, alice); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := database.PendingDeletions(bob)
+	if err != nil || len(pending) != len(again) {
+		t.Fatalf("bob has deletions %v, %v queued, want the %d parts of the new a", pending, err, len(again))
+	}
+	for _, name := range pending {
+		for _, p := range moved {
+			if p.part.name == name {
+				t.Errorf("deleting the new a queued b's part %s", name)
+			}
+		}
+	}
+	if reqs, err := database.FilePartRequestsForFile(File{FileMetaData: FileMetaData{name: "b"}}, alice); err != nil || len(reqs) != len(moved) {
+		t.Errorf("b has part requests %v, %v, want its %d parts", reqs, err, len(moved))
+	}
+}
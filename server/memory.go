@@ -0,0 +1,838 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a MetadataStore that keeps everything in memory, for tests and throwaway servers.
+// It mirrors the rows of the SQL schema in cockroach.go.
+type MemoryStore struct {
+	mu         sync.Mutex
+	nextID     int
+	clients    []*DbClient
+	files      []*DbFile
+	parts      []*memoryPart
+	challenges []*memoryChallenge
+	tokens     map[string]*memoryToken
+	deletions  []memoryDeletion
+	dirs       []memoryDirectory
+}
+
+// A FilePart row along with the IDs of the Clients holding it
+type memoryPart struct {
+	DbFilePart
+	holders []int
+}
+
+// heldBy checks if the Client with id holds the part
+func (p *memoryPart) heldBy(id int) bool {
+	for _, holder := range p.holders {
+		if holder == id {
+			return true
+		}
+	}
+	return false
+}
+
+// A Challenge row
+type memoryChallenge struct {
+	Challenge
+	partID int
+	used   bool
+}
+
+// A SessionToken row
+type memoryToken struct {
+	SessionToken
+	revoked bool
+}
+
+// A PendingDeletion row
+type memoryDeletion struct {
+	holderID int
+	partName string
+}
+
+// A Directory row
+type memoryDirectory struct {
+	ownerID int
+	path    string
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tokens: map[string]*memoryToken{}}
+}
+
+// CreateClient adds Client c, failing with ErrConflict if its username is taken
+func (m *MemoryStore) CreateClient(c Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.client(c.username); err == nil {
+		return fmt.Errorf("client %s: %w", c.username, ErrConflict)
+	}
+	m.clients = append(m.clients, &DbClient{id: m.newID(), username: c.username, password: c.password, reliability: 1})
+	return nil
+}
+
+// LookupClient returns the Client with username along with its password hash
+func (m *MemoryStore) LookupClient(username string) (Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(username)
+	if err != nil {
+		return Client{}, err
+	}
+	return Client{dbC.username, dbC.password}, nil
+}
+
+// SetPasswordHash replaces the stored password hash of Client c
+func (m *MemoryStore) SetPasswordHash(c Client, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(c.username)
+	if err != nil {
+		return err
+	}
+	dbC.password = passwordHash
+	return nil
+}
+
+// KeySaltForClient returns the salt for deriving Client c's password key, creating one if c has none yet
+func (m *MemoryStore) KeySaltForClient(c Client) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(c.username)
+	if err != nil {
+		return nil, err
+	}
+	if len(dbC.keySalt) == 0 {
+		salt, err := NewKeySalt()
+		if err != nil {
+			return nil, err
+		}
+		dbC.keySalt = salt
+	}
+	return dbC.keySalt, nil
+}
+
+// Clients returns every Client registered with nfinite.space
+func (m *MemoryStore) Clients() ([]Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var clients []Client
+	for _, dbC := range m.clients {
+		clients = append(clients, Client{dbC.username, dbC.password})
+	}
+	return clients, nil
+}
+
+// RecordBadPart counts another corrupted part served by Client c, returning c's new total
+func (m *MemoryStore) RecordBadPart(c Client) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(c.username)
+	if err != nil {
+		return 0, err
+	}
+	dbC.badParts++
+	return dbC.badParts, nil
+}
+
+// RecordChallengeResult updates Client c's challenge counts and reliability score
+func (m *MemoryStore) RecordChallengeResult(c Client, passed bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(c.username)
+	if err != nil {
+		return err
+	}
+	dbC.reliability *= reliabilityDecay
+	if passed {
+		dbC.challengesPassed++
+		dbC.reliability += 1 - reliabilityDecay
+	} else {
+		dbC.challengesFailed++
+	}
+	return nil
+}
+
+// SaveUpload adds File f of owner along with its parts, their holders and challenges, or nothing if any is invalid
+func (m *MemoryStore) SaveUpload(f File, owner Client, parts []PlacedPart) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbOwner, err := m.client(owner.username)
+	if err != nil {
+		return err
+	}
+	if _, err := m.file(f.name, f.version, owner.username); err == nil {
+		return fmt.Errorf("%s: %w", fileWhat(f), ErrConflict)
+	}
+	if err := m.checkPath(dbOwner.id, f.name, true); err != nil {
+		return err
+	}
+	indexes, names := map[int]bool{}, map[string]bool{}
+	for _, mp := range m.parts {
+		names[mp.name] = true
+	}
+	for _, p := range parts {
+		if indexes[p.part.index] || names[p.part.name] {
+			return fmt.Errorf("part %d of %s: %w", p.part.index, f.name, ErrConflict)
+		}
+		indexes[p.part.index] = true
+		names[p.part.name] = true
+		for _, h := range p.holders {
+			if _, err := m.client(h.username); err != nil {
+				return err
+			}
+		}
+	}
+
+	dbF := &DbFile{m.newID(), int(f.modified.Unix()), f.name, strconv.Itoa(dbOwner.id), f.wrappedKey, f.version, int(f.uploaded.Unix())}
+	m.files = append(m.files, dbF)
+	for _, p := range parts {
+		fp, c := p.part, p.part.coding
+		mp := &memoryPart{DbFilePart: DbFilePart{dbF.id, fp.name, m.newID(), fp.index, int(fp.kind), c.dataShards, c.parityShards, c.size, fp.replicas, fp.size, fp.checksum, c.stripeSize}}
+		for _, h := range p.holders {
+			if dbC, _ := m.client(h.username); !mp.heldBy(dbC.id) {
+				mp.holders = append(mp.holders, dbC.id)
+				m.cancelDeletion(dbC.id, fp.name)
+			}
+		}
+		m.parts = append(m.parts, mp)
+		for _, ch := range p.challenges {
+			ch.id = m.newID()
+			ch.partName = fp.name
+			m.challenges = append(m.challenges, &memoryChallenge{ch, mp.id, false})
+		}
+	}
+	return nil
+}
+
+// DoesFileExist checks if the File f exists for Client c
+func (m *MemoryStore) DoesFileExist(f File, c Client) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.client(c.username); err != nil {
+		return false, err
+	}
+	_, err := m.file(f.name, 0, c.username)
+	return err == nil, nil
+}
+
+// GetFile returns version of Client c's File with name, the current version if version is 0
+func (m *MemoryStore) GetFile(name string, version int, c Client) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbF, err := m.file(name, version, c.username)
+	if err != nil {
+		return File{}, err
+	}
+	return dbF.file(), nil
+}
+
+// ClientsFiles returns the current version of every File belonging to the Client c whose name starts with prefix
+func (m *MemoryStore) ClientsFiles(prefix string, c Client) ([]File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(c.username)
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	for _, dbF := range m.files {
+		if dbF.ownerID != strconv.Itoa(dbC.id) || !strings.HasPrefix(dbF.name, prefix) {
+			continue
+		}
+		if current, _ := m.file(dbF.name, 0, c.username); current == dbF {
+			files = append(files, dbF.file())
+		}
+	}
+	return files, nil
+}
+
+// FileVersions returns every version of Client c's File with name, newest first
+func (m *MemoryStore) FileVersions(name string, c Client) ([]File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbFs, err := m.versions(name, c.username)
+	if err != nil {
+		return nil, err
+	}
+	if len(dbFs) == 0 {
+		return nil, fmt.Errorf("file %s: %w", name, ErrNotFound)
+	}
+	var files []File
+	for _, dbF := range dbFs {
+		files = append(files, dbF.file())
+	}
+	return files, nil
+}
+
+// RestoreVersion makes owner's version f.version of File f the current one, by renumbering it after the newest.
+// Returns the restored File.
+func (m *MemoryStore) RestoreVersion(f File, owner Client) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, err := m.file(f.name, 0, owner.username)
+	if err != nil {
+		return File{}, err
+	}
+	dbF, err := m.file(f.name, f.version, owner.username)
+	if err != nil {
+		return File{}, err
+	}
+	if dbF != current {
+		dbF.version = current.version + 1
+		dbF.uploaded = int(time.Now().Unix())
+	}
+	return dbF.file(), nil
+}
+
+// AddPartHolders records every storer as holding the already added FilePart fp
+func (m *MemoryStore) AddPartHolders(fp FilePart, storers ...Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, err := m.part(fp)
+	if err != nil {
+		return err
+	}
+	for _, storer := range storers {
+		dbC, err := m.client(storer.username)
+		if err != nil {
+			return err
+		}
+		if !p.heldBy(dbC.id) {
+			p.holders = append(p.holders, dbC.id)
+			m.cancelDeletion(dbC.id, p.name)
+		}
+	}
+	return nil
+}
+
+// RemovePartHolder forgets that holder stores the FilePart fp and queues a deletion of holder's copy
+func (m *MemoryStore) RemovePartHolder(fp FilePart, holder Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, err := m.part(fp)
+	if err != nil {
+		return err
+	}
+	dbC, err := m.client(holder.username)
+	if err != nil {
+		return err
+	}
+	var holders []int
+	for _, id := range p.holders {
+		if id != dbC.id {
+			holders = append(holders, id)
+		} else {
+			m.queueDeletion(id, fp.name)
+		}
+	}
+	p.holders = holders
+	return nil
+}
+
+// FilePartRequestsForFile returns a FilePartRequest for every part of owner's File f, sorted by index
+func (m *MemoryStore) FilePartRequestsForFile(f File, owner Client) ([]FilePartRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbF, err := m.file(f.name, f.version, owner.username)
+	if err != nil {
+		return nil, err
+	}
+	var parts []*memoryPart
+	for _, p := range m.parts {
+		if p.parentID == dbF.id {
+			parts = append(parts, p)
+		}
+	}
+	sort.SliceStable(parts, func(i, j int) bool { return parts[i].fileIndex < parts[j].fileIndex })
+
+	var reqs []FilePartRequest
+	for _, p := range parts {
+		var owners []Client
+		for _, id := range p.holders {
+			if dbC := m.clientByID(id); dbC != nil {
+				owners = append(owners, Client{dbC.username, dbC.password})
+			}
+		}
+		fp := FilePart{parent: f, index: p.fileIndex, kind: ShardKind(p.kind), coding: p.coding(), replicas: p.replicas, checksum: p.checksum}
+		fp.name = p.name
+		fp.modified = f.modified
+		reqs = append(reqs, FilePartRequest{owners, fp})
+	}
+	return reqs, nil
+}
+
+// StoredBytesByClient returns how many bytes of other users' parts each Client stores, keyed by username
+func (m *MemoryStore) StoredBytesByClient() (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := map[string]int{}
+	for _, p := range m.parts {
+		for _, id := range p.holders {
+			if dbC := m.clientByID(id); dbC != nil {
+				stored[dbC.username] += p.partSize
+			}
+		}
+	}
+	return stored, nil
+}
+
+// StorageUsage returns how many bytes of parts Client c has given to and received from its peers, see quota.go
+func (m *MemoryStore) StorageUsage(c Client) (StorageUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(c.username)
+	if err != nil {
+		return StorageUsage{}, err
+	}
+	owners := map[int]string{}
+	for _, dbF := range m.files {
+		owners[dbF.id] = dbF.ownerID
+	}
+	var u StorageUsage
+	for _, p := range m.parts {
+		own := owners[p.parentID] == strconv.Itoa(dbC.id)
+		if own {
+			u.received += p.partSize * len(p.holders)
+		} else if p.heldBy(dbC.id) {
+			u.given += p.partSize
+		}
+	}
+	return u, nil
+}
+
+// DeleteFile removes version f.version of owner's File f, or every version if it is 0, along with
+// their parts and challenges, queueing a deletion for every Client that held one of the parts.
+// Returns those Clients.
+func (m *MemoryStore) DeleteFile(f File, owner Client) ([]Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbFs, err := m.versions(f.name, owner.username)
+	if err != nil {
+		return nil, err
+	}
+	doomed := map[int]bool{}
+	for _, dbF := range dbFs {
+		if f.version == 0 || dbF.version == f.version {
+			doomed[dbF.id] = true
+		}
+	}
+	if len(doomed) == 0 {
+		return nil, fmt.Errorf("%s: %w", fileWhat(f), ErrNotFound)
+	}
+	var holders []Client
+	held := map[int]bool{}
+	deleted := map[int]bool{}
+	var parts []*memoryPart
+	for _, p := range m.parts {
+		if !doomed[p.parentID] {
+			parts = append(parts, p)
+			continue
+		}
+		deleted[p.id] = true
+		for _, id := range p.holders {
+			m.queueDeletion(id, p.name)
+			if dbC := m.clientByID(id); dbC != nil && !held[id] {
+				held[id] = true
+				holders = append(holders, Client{dbC.username, dbC.password})
+			}
+		}
+	}
+	m.parts = parts
+	var challenges []*memoryChallenge
+	for _, ch := range m.challenges {
+		if !deleted[ch.partID] {
+			challenges = append(challenges, ch)
+		}
+	}
+	m.challenges = challenges
+	var files []*DbFile
+	for _, dbF := range m.files {
+		if !doomed[dbF.id] {
+			files = append(files, dbF)
+		}
+	}
+	m.files = files
+	return holders, nil
+}
+
+// MakeDirectory creates directory path for owner, failing with ErrConflict if the path is taken
+func (m *MemoryStore) MakeDirectory(path string, owner Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(owner.username)
+	if err != nil {
+		return err
+	}
+	if err := m.checkPath(dbC.id, path, false); err != nil {
+		return err
+	}
+	m.dirs = append(m.dirs, memoryDirectory{dbC.id, path})
+	return nil
+}
+
+// RemoveDirectory removes owner's directory path made with MakeDirectory, failing with ErrConflict if it isn't empty
+func (m *MemoryStore) RemoveDirectory(path string, owner Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(owner.username)
+	if err != nil {
+		return err
+	}
+	if m.countUnder(dbC.id, path) > 0 {
+		return fmt.Errorf("directory %s isn't empty: %w", path, ErrConflict)
+	}
+	for i, d := range m.dirs {
+		if d == (memoryDirectory{dbC.id, path}) {
+			m.dirs = append(m.dirs[:i], m.dirs[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("directory %s: %w", path, ErrNotFound)
+}
+
+// Directories returns the paths starting with prefix of the directories owner made with MakeDirectory
+func (m *MemoryStore) Directories(prefix string, owner Client) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(owner.username)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, d := range m.dirs {
+		if d.ownerID == dbC.id && strings.HasPrefix(d.path, prefix) {
+			paths = append(paths, d.path)
+		}
+	}
+	return paths, nil
+}
+
+// Move renames every version of owner's File from, or the directory from and everything under it, to to.
+// Fails with ErrConflict if to is taken.
+func (m *MemoryStore) Move(from, to string, owner Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(owner.username)
+	if err != nil {
+		return err
+	}
+	if dbFs, _ := m.versions(from, owner.username); len(dbFs) > 0 {
+		if err := m.checkPath(dbC.id, to, false); err != nil {
+			return err
+		}
+		for _, dbF := range dbFs {
+			dbF.name = to
+		}
+		return nil
+	}
+
+	if !m.madeDirectory(dbC.id, from) && m.countUnder(dbC.id, from) == 0 {
+		return fmt.Errorf("file or directory %s: %w", from, ErrNotFound)
+	}
+	if err := m.checkPath(dbC.id, to, false); err != nil {
+		return err
+	}
+	for _, dbF := range m.files {
+		if dbF.ownerID == strconv.Itoa(dbC.id) && strings.HasPrefix(dbF.name, dirPrefix(from)) {
+			dbF.name = movedPath(dbF.name, from, to)
+		}
+	}
+	for i, d := range m.dirs {
+		if d.ownerID == dbC.id && (d.path == from || strings.HasPrefix(d.path, dirPrefix(from))) {
+			m.dirs[i].path = movedPath(d.path, from, to)
+		}
+	}
+	return nil
+}
+
+// PendingDeletions returns the names of the parts Client holder still has to be told to delete
+func (m *MemoryStore) PendingDeletions(holder Client) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(holder.username)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, d := range m.deletions {
+		if d.holderID == dbC.id {
+			names = append(names, d.partName)
+		}
+	}
+	return names, nil
+}
+
+// QueuePendingDeletion records that Client holder has to be told to delete the part called partName
+func (m *MemoryStore) QueuePendingDeletion(holder Client, partName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(holder.username)
+	if err != nil {
+		return err
+	}
+	m.queueDeletion(dbC.id, partName)
+	return nil
+}
+
+// ClearPendingDeletion forgets that Client holder has to be told to delete the part called partName
+func (m *MemoryStore) ClearPendingDeletion(holder Client, partName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(holder.username)
+	if err != nil {
+		return err
+	}
+	m.cancelDeletion(dbC.id, partName)
+	return nil
+}
+
+// TakeChallengeForHolder picks an unused Challenge for one of the parts Client c stores and marks it used.
+// It fails with ErrNotFound when there is none left.
+func (m *MemoryStore) TakeChallengeForHolder(c Client) (Challenge, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dbC, err := m.client(c.username)
+	if err != nil {
+		return Challenge{}, err
+	}
+	held := map[int]bool{}
+	for _, p := range m.parts {
+		held[p.id] = p.heldBy(dbC.id)
+	}
+	var candidates []*memoryChallenge
+	for _, ch := range m.challenges {
+		if !ch.used && held[ch.partID] {
+			candidates = append(candidates, ch)
+		}
+	}
+	if len(candidates) == 0 {
+		return Challenge{}, fmt.Errorf("challenge for %s: %w", c.username, ErrNotFound)
+	}
+	ch := candidates[rand.Intn(len(candidates))]
+	ch.used = true
+	return ch.Challenge, nil
+}
+
+// InsertSessionToken records a newly issued SessionToken
+func (m *MemoryStore) InsertSessionToken(st SessionToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.client(st.owner.username); err != nil {
+		return err
+	}
+	if _, ok := m.tokens[st.id]; ok {
+		return fmt.Errorf("session token %s: %w", st.id, ErrConflict)
+	}
+	m.tokens[st.id] = &memoryToken{st, false}
+	return nil
+}
+
+// SessionTokenKey gets the sealed password key of Client c's session token with id.
+// Fails with ErrNotFound unless the token is c's and neither revoked nor expired.
+func (m *MemoryStore) SessionTokenKey(id string, c Client) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[id]
+	if !ok || t.owner.username != c.username || t.revoked || !t.expires.After(time.Now()) || t.key == nil {
+		return nil, fmt.Errorf("session token %s: %w", id, ErrNotFound)
+	}
+	return t.key, nil
+}
+
+// ActiveSessionTokens returns Client c's session tokens that are neither revoked nor expired, oldest first
+func (m *MemoryStore) ActiveSessionTokens(c Client) ([]SessionToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tokens []SessionToken
+	for _, t := range m.tokens {
+		if t.owner.username == c.username && !t.revoked && t.expires.After(time.Now()) {
+			st := t.SessionToken
+			st.key = nil
+			tokens = append(tokens, st)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].created.Before(tokens[j].created) })
+	return tokens, nil
+}
+
+// RevokeSessionToken revokes Client c's session token with id and deletes its password key,
+// failing with ErrNotFound if c has no such token
+func (m *MemoryStore) RevokeSessionToken(id string, c Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[id]
+	if !ok || t.owner.username != c.username {
+		return fmt.Errorf("session token %s: %w", id, ErrNotFound)
+	}
+	t.revoked = true
+	t.key = nil
+	return nil
+}
+
+// PurgeSessionTokens deletes every session token revoked or expired by now, returning how many it deleted
+func (m *MemoryStore) PurgeSessionTokens(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, t := range m.tokens {
+		if t.revoked || !t.expires.After(now) {
+			delete(m.tokens, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// newID returns the next row ID. Callers hold m.mu.
+func (m *MemoryStore) newID() int {
+	m.nextID++
+	return m.nextID
+}
+
+// queueDeletion adds a PendingDeletion row unless there is one already. Callers hold m.mu.
+func (m *MemoryStore) queueDeletion(holderID int, partName string) {
+	d := memoryDeletion{holderID, partName}
+	for _, other := range m.deletions {
+		if other == d {
+			return
+		}
+	}
+	m.deletions = append(m.deletions, d)
+}
+
+// cancelDeletion removes the PendingDeletion row of partName for holderID, if any. Callers hold m.mu.
+func (m *MemoryStore) cancelDeletion(holderID int, partName string) {
+	var deletions []memoryDeletion
+	for _, d := range m.deletions {
+		if d != (memoryDeletion{holderID, partName}) {
+			deletions = append(deletions, d)
+		}
+	}
+	m.deletions = deletions
+}
+
+// madeDirectory checks if the Client with ownerID made directory path. Callers hold m.mu.
+func (m *MemoryStore) madeDirectory(ownerID int, path string) bool {
+	for _, d := range m.dirs {
+		if d == (memoryDirectory{ownerID, path}) {
+			return true
+		}
+	}
+	return false
+}
+
+// countUnder counts the File rows and made directories of the Client with ownerID under directory dir.
+// Callers hold m.mu.
+func (m *MemoryStore) countUnder(ownerID int, dir string) int {
+	n := 0
+	for _, dbF := range m.files {
+		if dbF.ownerID == strconv.Itoa(ownerID) && strings.HasPrefix(dbF.name, dirPrefix(dir)) {
+			n++
+		}
+	}
+	for _, d := range m.dirs {
+		if d.ownerID == ownerID && strings.HasPrefix(d.path, dirPrefix(dir)) {
+			n++
+		}
+	}
+	return n
+}
+
+// checkPath fails with ErrConflict if the Client with ownerID can't give path to a new File, or a
+// new directory if isFile is false. Files can take the path of a File, as a new version. Callers hold m.mu.
+func (m *MemoryStore) checkPath(ownerID int, path string, isFile bool) error {
+	hasFile := func(name string) bool {
+		for _, dbF := range m.files {
+			if dbF.ownerID == strconv.Itoa(ownerID) && dbF.name == name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, parent := range parentDirs(path) {
+		if hasFile(parent) {
+			return fmt.Errorf("%s is a file: %w", parent, ErrConflict)
+		}
+	}
+	if m.madeDirectory(ownerID, path) || m.countUnder(ownerID, path) > 0 {
+		return fmt.Errorf("directory %s: %w", path, ErrConflict)
+	}
+	if !isFile && hasFile(path) {
+		return fmt.Errorf("file %s: %w", path, ErrConflict)
+	}
+	return nil
+}
+
+// client gets the row for username. Callers hold m.mu.
+func (m *MemoryStore) client(username string) (*DbClient, error) {
+	for _, dbC := range m.clients {
+		if dbC.username == username {
+			return dbC, nil
+		}
+	}
+	return nil, fmt.Errorf("client %s: %w", username, ErrNotFound)
+}
+
+// clientByID gets the Client row with id, nil if there is none. Callers hold m.mu.
+func (m *MemoryStore) clientByID(id int) *DbClient {
+	for _, dbC := range m.clients {
+		if dbC.id == id {
+			return dbC
+		}
+	}
+	return nil
+}
+
+// file gets the row of version of username's File called name, the current version if version is 0.
+// Callers hold m.mu.
+func (m *MemoryStore) file(name string, version int, username string) (*DbFile, error) {
+	dbFs, err := m.versions(name, username)
+	if err != nil {
+		return nil, err
+	}
+	for _, dbF := range dbFs {
+		if version == 0 || dbF.version == version {
+			return dbF, nil
+		}
+	}
+	f := File{version: version}
+	f.name = name
+	return nil, fmt.Errorf("%s: %w", fileWhat(f), ErrNotFound)
+}
+
+// versions gets the rows of every version of username's File called name, newest first. Callers hold m.mu.
+func (m *MemoryStore) versions(name string, username string) ([]*DbFile, error) {
+	dbC, err := m.client(username)
+	if err != nil {
+		return nil, err
+	}
+	var dbFs []*DbFile
+	for _, dbF := range m.files {
+		if dbF.name == name && dbF.ownerID == strconv.Itoa(dbC.id) {
+			dbFs = append(dbFs, dbF)
+		}
+	}
+	sort.Slice(dbFs, func(i, j int) bool { return dbFs[i].version > dbFs[j].version })
+	return dbFs, nil
+}
+
+// part gets the row of FilePart fp. Callers hold m.mu.
+func (m *MemoryStore) part(fp FilePart) (*memoryPart, error) {
+	for _, p := range m.parts {
+		if p.name == fp.name && p.fileIndex == fp.index {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("part %d of %s: %w", fp.index, fp.name, ErrNotFound)
+}
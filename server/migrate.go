@@ -0,0 +1,521 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+/*
+	The SQL schema is built by the numbered migrations below, each with statements for
+	every dialect to apply it and to revert it. The schema_version table has a row for
+	every applied migration. Migrations are never edited once released, add a new one.
+
+	Pending migrations are applied at startup unless -auto-migrate=false, in which case
+	they are managed with the migrate subcommand (flags go before it):
+
+		server -store=sqlite migrate status
+		server -store=sqlite migrate up [version]    (the latest if omitted)
+		server -store=sqlite migrate down [version]  (one step if omitted)
+
+	SQLite applies each migration in a transaction. CockroachDB can't reliably roll back
+	schema changes, so its statements are idempotent and a failed migration is run again.
+*/
+
+var autoMigrate = flag.Bool("auto-migrate", true, "apply pending schema migrations at startup, otherwise refuse to start until the migrate subcommand has been run")
+
+// SQL dialects a Migration has statements for
+const (
+	dialectCockroach = "cockroach"
+	dialectSQLite    = "sqlite"
+)
+
+// Migration is one numbered, reversible change to the SQL schema
+type Migration struct {
+	version int
+	name    string
+	up      map[string][]string // statements for each dialect
+	down    map[string][]string
+}
+
+// Every Migration in order, migrations[i] has version i+1
+var migrations = []Migration{
+	{1, "initial schema",
+		map[string][]string{
+			// Stores created before migrations already have these tables, possibly lacking later columns
+			dialectCockroach: {
+				"CREATE TABLE IF NOT EXISTS PartLookup (id SERIAL PRIMARY KEY, partId INT, ownerId INT)",
+				"CREATE TABLE IF NOT EXISTS FilePart (parentId INT, name string, id SERIAL PRIMARY KEY, fileIndex INT, kind INT DEFAULT 0, dataShards INT DEFAULT 0, parityShards INT DEFAULT 0, size INT DEFAULT 0, replicas INT DEFAULT 1, partSize INT DEFAULT 0, checksum string DEFAULT '', stripeSize INT DEFAULT 0)",
+				"ALTER TABLE FilePart ADD COLUMN IF NOT EXISTS kind INT DEFAULT 0",
+				"ALTER TABLE FilePart ADD COLUMN IF NOT EXISTS dataShards INT DEFAULT 0",
+				"ALTER TABLE FilePart ADD COLUMN IF NOT EXISTS parityShards INT DEFAULT 0",
+				"ALTER TABLE FilePart ADD COLUMN IF NOT EXISTS size INT DEFAULT 0",
+				"ALTER TABLE FilePart ADD COLUMN IF NOT EXISTS replicas INT DEFAULT 1",
+				"ALTER TABLE FilePart ADD COLUMN IF NOT EXISTS partSize INT DEFAULT 0",
+				"ALTER TABLE FilePart ADD COLUMN IF NOT EXISTS checksum string DEFAULT ''",
+				"ALTER TABLE FilePart ADD COLUMN IF NOT EXISTS stripeSize INT DEFAULT 0",
+				"CREATE TABLE IF NOT EXISTS Client (id SERIAL, username string PRIMARY KEY, password string, keySalt BYTES, badParts INT DEFAULT 0, challengesPassed INT DEFAULT 0, challengesFailed INT DEFAULT 0, reliability FLOAT DEFAULT 1.0)",
+				"ALTER TABLE Client ADD COLUMN IF NOT EXISTS keySalt BYTES",
+				"ALTER TABLE Client ADD COLUMN IF NOT EXISTS badParts INT DEFAULT 0",
+				"ALTER TABLE Client ADD COLUMN IF NOT EXISTS challengesPassed INT DEFAULT 0",
+				"ALTER TABLE Client ADD COLUMN IF NOT EXISTS challengesFailed INT DEFAULT 0",
+				"ALTER TABLE Client ADD COLUMN IF NOT EXISTS reliability FLOAT DEFAULT 1.0",
+				"CREATE TABLE IF NOT EXISTS File (id SERIAL PRIMARY KEY, modified INT, name string, ownerId INT, wrappedKey BYTES)",
+				"ALTER TABLE File ADD COLUMN IF NOT EXISTS wrappedKey BYTES",
+				"CREATE TABLE IF NOT EXISTS Challenge (id SERIAL PRIMARY KEY, partId INT, nonce BYTES, start INT, length INT, answer string, used BOOL DEFAULT false)",
+				"CREATE TABLE IF NOT EXISTS SessionToken (id string PRIMARY KEY, ownerId INT, created INT, expires INT, revoked BOOL DEFAULT false)",
+			},
+			dialectSQLite: {
+				"CREATE TABLE IF NOT EXISTS PartLookup (id INTEGER PRIMARY KEY, partId INTEGER, ownerId INTEGER)",
+				"CREATE TABLE IF NOT EXISTS FilePart (parentId INTEGER, name TEXT, id INTEGER PRIMARY KEY, fileIndex INTEGER, kind INTEGER DEFAULT 0, dataShards INTEGER DEFAULT 0, parityShards INTEGER DEFAULT 0, size INTEGER DEFAULT 0, replicas INTEGER DEFAULT 1, partSize INTEGER DEFAULT 0, checksum TEXT DEFAULT '', stripeSize INTEGER DEFAULT 0)",
+				"CREATE TABLE IF NOT EXISTS Client (id INTEGER PRIMARY KEY, username TEXT UNIQUE, password TEXT, keySalt BLOB, badParts INTEGER DEFAULT 0, challengesPassed INTEGER DEFAULT 0, challengesFailed INTEGER DEFAULT 0, reliability REAL DEFAULT 1.0)",
+				"CREATE TABLE IF NOT EXISTS File (id INTEGER PRIMARY KEY, modified INTEGER, name TEXT, ownerId INTEGER, wrappedKey BLOB)",
+				"CREATE TABLE IF NOT EXISTS Challenge (id INTEGER PRIMARY KEY, partId INTEGER, nonce BLOB, start INTEGER, length INTEGER, answer TEXT, used BOOLEAN DEFAULT false)",
+				"CREATE TABLE IF NOT EXISTS SessionToken (id TEXT PRIMARY KEY, ownerId INTEGER, created INTEGER, expires INTEGER, revoked BOOLEAN DEFAULT false)",
+			},
+		},
+		map[string][]string{
+			dialectCockroach: {
+				"DROP TABLE IF EXISTS SessionToken",
+				"DROP TABLE IF EXISTS Challenge",
+				"DROP TABLE IF EXISTS PartLookup",
+				"DROP TABLE IF EXISTS FilePart",
+				"DROP TABLE IF EXISTS File",
+				"DROP TABLE IF EXISTS Client",
+			},
+			dialectSQLite: {
+				"DROP TABLE IF EXISTS SessionToken",
+				"DROP TABLE IF EXISTS Challenge",
+				"DROP TABLE IF EXISTS PartLookup",
+				"DROP TABLE IF EXISTS FilePart",
+				"DROP TABLE IF EXISTS File",
+				"DROP TABLE IF EXISTS Client",
+			},
+		},
+	},
+	{2, "indexes and uniqueness",
+		map[string][]string{
+			// A holder could be recorded twice for a part, keep the first of any duplicates
+			dialectCockroach: {
+				"DELETE FROM PartLookup WHERE id NOT IN (SELECT MIN(id) FROM PartLookup GROUP BY partId, ownerId)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS Client_id_key ON Client (id)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS File_ownerId_name_key ON File (ownerId, name)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS FilePart_parentId_fileIndex_key ON FilePart (parentId, fileIndex)",
+				"CREATE INDEX IF NOT EXISTS FilePart_name_fileIndex_idx ON FilePart (name, fileIndex)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS PartLookup_partId_ownerId_key ON PartLookup (partId, ownerId)",
+				"CREATE INDEX IF NOT EXISTS PartLookup_ownerId_idx ON PartLookup (ownerId)",
+				"CREATE INDEX IF NOT EXISTS Challenge_partId_idx ON Challenge (partId)",
+				"CREATE INDEX IF NOT EXISTS SessionToken_ownerId_idx ON SessionToken (ownerId)",
+			},
+			dialectSQLite: {
+				"DELETE FROM PartLookup WHERE id NOT IN (SELECT MIN(id) FROM PartLookup GROUP BY partId, ownerId)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS File_ownerId_name_key ON File (ownerId, name)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS FilePart_parentId_fileIndex_key ON FilePart (parentId, fileIndex)",
+				"CREATE INDEX IF NOT EXISTS FilePart_name_fileIndex_idx ON FilePart (name, fileIndex)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS PartLookup_partId_ownerId_key ON PartLookup (partId, ownerId)",
+				"CREATE INDEX IF NOT EXISTS PartLookup_ownerId_idx ON PartLookup (ownerId)",
+				"CREATE INDEX IF NOT EXISTS Challenge_partId_idx ON Challenge (partId)",
+				"CREATE INDEX IF NOT EXISTS SessionToken_ownerId_idx ON SessionToken (ownerId)",
+			},
+		},
+		map[string][]string{
+			dialectCockroach: {
+				"DROP INDEX IF EXISTS SessionToken@SessionToken_ownerId_idx",
+				"DROP INDEX IF EXISTS Challenge@Challenge_partId_idx",
+				"DROP INDEX IF EXISTS PartLookup@PartLookup_ownerId_idx",
+				"DROP INDEX IF EXISTS PartLookup@PartLookup_partId_ownerId_key CASCADE",
+				"DROP INDEX IF EXISTS FilePart@FilePart_name_fileIndex_idx",
+				"DROP INDEX IF EXISTS FilePart@FilePart_parentId_fileIndex_key CASCADE",
+				"DROP INDEX IF EXISTS File@File_ownerId_name_key CASCADE",
+				"DROP INDEX IF EXISTS Client@Client_id_key CASCADE",
+			},
+			dialectSQLite: {
+				"DROP INDEX IF EXISTS SessionToken_ownerId_idx",
+				"DROP INDEX IF EXISTS Challenge_partId_idx",
+				"DROP INDEX IF EXISTS PartLookup_ownerId_idx",
+				"DROP INDEX IF EXISTS PartLookup_partId_ownerId_key",
+				"DROP INDEX IF EXISTS FilePart_name_fileIndex_idx",
+				"DROP INDEX IF EXISTS FilePart_parentId_fileIndex_key",
+				"DROP INDEX IF EXISTS File_ownerId_name_key",
+			},
+		},
+	},
+	{3, "foreign keys",
+		map[string][]string{
+			// Rows pointing at a missing parent can't be reached, drop them so the constraints hold
+			dialectCockroach: {
+				"DELETE FROM File WHERE ownerId NOT IN (SELECT id FROM Client)",
+				"DELETE FROM FilePart WHERE parentId NOT IN (SELECT id FROM File)",
+				"DELETE FROM PartLookup WHERE partId NOT IN (SELECT id FROM FilePart) OR ownerId NOT IN (SELECT id FROM Client)",
+				"DELETE FROM Challenge WHERE partId NOT IN (SELECT id FROM FilePart)",
+				"DELETE FROM SessionToken WHERE ownerId NOT IN (SELECT id FROM Client)",
+				"ALTER TABLE File DROP CONSTRAINT IF EXISTS File_ownerId_fk",
+				"ALTER TABLE File ADD CONSTRAINT File_ownerId_fk FOREIGN KEY (ownerId) REFERENCES Client (id) ON DELETE CASCADE",
+				"ALTER TABLE FilePart DROP CONSTRAINT IF EXISTS FilePart_parentId_fk",
+				"ALTER TABLE FilePart ADD CONSTRAINT FilePart_parentId_fk FOREIGN KEY (parentId) REFERENCES File (id) ON DELETE CASCADE",
+				"ALTER TABLE PartLookup DROP CONSTRAINT IF EXISTS PartLookup_partId_fk",
+				"ALTER TABLE PartLookup ADD CONSTRAINT PartLookup_partId_fk FOREIGN KEY (partId) REFERENCES FilePart (id) ON DELETE CASCADE",
+				"ALTER TABLE PartLookup DROP CONSTRAINT IF EXISTS PartLookup_ownerId_fk",
+				"ALTER TABLE PartLookup ADD CONSTRAINT PartLookup_ownerId_fk FOREIGN KEY (ownerId) REFERENCES Client (id) ON DELETE CASCADE",
+				"ALTER TABLE Challenge DROP CONSTRAINT IF EXISTS Challenge_partId_fk",
+				"ALTER TABLE Challenge ADD CONSTRAINT Challenge_partId_fk FOREIGN KEY (partId) REFERENCES FilePart (id) ON DELETE CASCADE",
+				"ALTER TABLE SessionToken DROP CONSTRAINT IF EXISTS SessionToken_ownerId_fk",
+				"ALTER TABLE SessionToken ADD CONSTRAINT SessionToken_ownerId_fk FOREIGN KEY (ownerId) REFERENCES Client (id) ON DELETE CASCADE",
+			},
+			// SQLite can't add constraints to a table, so each is rebuilt, parents before children.
+			// Dropping a table drops its indexes, those from migration 2 are made again.
+			dialectSQLite: {
+				"DELETE FROM File WHERE ownerId NOT IN (SELECT id FROM Client)",
+				"DELETE FROM FilePart WHERE parentId NOT IN (SELECT id FROM File)",
+				"DELETE FROM PartLookup WHERE partId NOT IN (SELECT id FROM FilePart) OR ownerId NOT IN (SELECT id FROM Client)",
+				"DELETE FROM Challenge WHERE partId NOT IN (SELECT id FROM FilePart)",
+				"DELETE FROM SessionToken WHERE ownerId NOT IN (SELECT id FROM Client)",
+
+				"CREATE TABLE File_new (id INTEGER PRIMARY KEY, modified INTEGER, name TEXT, ownerId INTEGER REFERENCES Client (id) ON DELETE CASCADE, wrappedKey BLOB)",
+				"INSERT INTO File_new SELECT * FROM File",
+				"DROP TABLE File",
+				"ALTER TABLE File_new RENAME TO File",
+				"CREATE UNIQUE INDEX File_ownerId_name_key ON File (ownerId, name)",
+
+				"CREATE TABLE FilePart_new (parentId INTEGER REFERENCES File (id) ON DELETE CASCADE, name TEXT, id INTEGER PRIMARY KEY, fileIndex INTEGER, kind INTEGER DEFAULT 0, dataShards INTEGER DEFAULT 0, parityShards INTEGER DEFAULT 0, size INTEGER DEFAULT 0, replicas INTEGER DEFAULT 1, partSize INTEGER DEFAULT 0, checksum TEXT DEFAULT '', stripeSize INTEGER DEFAULT 0)",
+				"INSERT INTO FilePart_new SELECT * FROM FilePart",
+				"DROP TABLE FilePart",
+				"ALTER TABLE FilePart_new RENAME TO FilePart",
+				"CREATE UNIQUE INDEX FilePart_parentId_fileIndex_key ON FilePart (parentId, fileIndex)",
+				"CREATE INDEX FilePart_name_fileIndex_idx ON FilePart (name, fileIndex)",
+
+				"CREATE TABLE PartLookup_new (id INTEGER PRIMARY KEY, partId INTEGER REFERENCES FilePart (id) ON DELETE CASCADE, ownerId INTEGER REFERENCES Client (id) ON DELETE CASCADE)",
+				"INSERT INTO PartLookup_new SELECT * FROM PartLookup",
+				"DROP TABLE PartLookup",
+				"ALTER TABLE PartLookup_new RENAME TO PartLookup",
+				"CREATE UNIQUE INDEX PartLookup_partId_ownerId_key ON PartLookup (partId, ownerId)",
+				"CREATE INDEX PartLookup_ownerId_idx ON PartLookup (ownerId)",
+
+				"CREATE TABLE Challenge_new (id INTEGER PRIMARY KEY, partId INTEGER REFERENCES FilePart (id) ON DELETE CASCADE, nonce BLOB, start INTEGER, length INTEGER, answer TEXT, used BOOLEAN DEFAULT false)",
+				"INSERT INTO Challenge_new SELECT * FROM Challenge",
+				"DROP TABLE Challenge",
+				"ALTER TABLE Challenge_new RENAME TO Challenge",
+				"CREATE INDEX Challenge_partId_idx ON Challenge (partId)",
+
+				"CREATE TABLE SessionToken_new (id TEXT PRIMARY KEY, ownerId INTEGER REFERENCES Client (id) ON DELETE CASCADE, created INTEGER, expires INTEGER, revoked BOOLEAN DEFAULT false)",
+				"INSERT INTO SessionToken_new SELECT * FROM SessionToken",
+				"DROP TABLE SessionToken",
+				"ALTER TABLE SessionToken_new RENAME TO SessionToken",
+				"CREATE INDEX SessionToken_ownerId_idx ON SessionToken (ownerId)",
+			},
+		},
+		map[string][]string{
+			dialectCockroach: {
+				"ALTER TABLE SessionToken DROP CONSTRAINT IF EXISTS SessionToken_ownerId_fk",
+				"ALTER TABLE Challenge DROP CONSTRAINT IF EXISTS Challenge_partId_fk",
+				"ALTER TABLE PartLookup DROP CONSTRAINT IF EXISTS PartLookup_ownerId_fk",
+				"ALTER TABLE PartLookup DROP CONSTRAINT IF EXISTS PartLookup_partId_fk",
+				"ALTER TABLE FilePart DROP CONSTRAINT IF EXISTS FilePart_parentId_fk",
+				"ALTER TABLE File DROP CONSTRAINT IF EXISTS File_ownerId_fk",
+			},
+			// Children are rebuilt first, so no table is dropped while another still references it
+			dialectSQLite: {
+				"CREATE TABLE SessionToken_new (id TEXT PRIMARY KEY, ownerId INTEGER, created INTEGER, expires INTEGER, revoked BOOLEAN DEFAULT false)",
+				"INSERT INTO SessionToken_new SELECT * FROM SessionToken",
+				"DROP TABLE SessionToken",
+				"ALTER TABLE SessionToken_new RENAME TO SessionToken",
+				"CREATE INDEX SessionToken_ownerId_idx ON SessionToken (ownerId)",
+
+				"CREATE TABLE Challenge_new (id INTEGER PRIMARY KEY, partId INTEGER, nonce BLOB, start INTEGER, length INTEGER, answer TEXT, used BOOLEAN DEFAULT false)",
+				"INSERT INTO Challenge_new SELECT * FROM Challenge",
+				"DROP TABLE Challenge",
+				"ALTER TABLE Challenge_new RENAME TO Challenge",
+				"CREATE INDEX Challenge_partId_idx ON Challenge (partId)",
+
+				"CREATE TABLE PartLookup_new (id INTEGER PRIMARY KEY, partId INTEGER, ownerId INTEGER)",
+				"INSERT INTO PartLookup_new SELECT * FROM PartLookup",
+				"DROP TABLE PartLookup",
+				"ALTER TABLE PartLookup_new RENAME TO PartLookup",
+				"CREATE UNIQUE INDEX PartLookup_partId_ownerId_key ON PartLookup (partId, ownerId)",
+				"CREATE INDEX PartLookup_ownerId_idx ON PartLookup (ownerId)",
+
+				"CREATE TABLE FilePart_new (parentId INTEGER, name TEXT, id INTEGER PRIMARY KEY, fileIndex INTEGER, kind INTEGER DEFAULT 0, dataShards INTEGER DEFAULT 0, parityShards INTEGER DEFAULT 0, size INTEGER DEFAULT 0, replicas INTEGER DEFAULT 1, partSize INTEGER DEFAULT 0, checksum TEXT DEFAULT '', stripeSize INTEGER DEFAULT 0)",
+				"INSERT INTO FilePart_new SELECT * FROM FilePart",
+				"DROP TABLE FilePart",
+				"ALTER TABLE FilePart_new RENAME TO FilePart",
+				"CREATE UNIQUE INDEX FilePart_parentId_fileIndex_key ON FilePart (parentId, fileIndex)",
+				"CREATE INDEX FilePart_name_fileIndex_idx ON FilePart (name, fileIndex)",
+
+				"CREATE TABLE File_new (id INTEGER PRIMARY KEY, modified INTEGER, name TEXT, ownerId INTEGER, wrappedKey BLOB)",
+				"INSERT INTO File_new SELECT * FROM File",
+				"DROP TABLE File",
+				"ALTER TABLE File_new RENAME TO File",
+				"CREATE UNIQUE INDEX File_ownerId_name_key ON File (ownerId, name)",
+			},
+		},
+	},
+	{4, "pending part deletions",
+		map[string][]string{
+			dialectCockroach: {
+				"CREATE TABLE IF NOT EXISTS PendingDeletion (id SERIAL PRIMARY KEY, holderId INT REFERENCES Client (id) ON DELETE CASCADE, partName string)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS PendingDeletion_holderId_partName_key ON PendingDeletion (holderId, partName)",
+			},
+			dialectSQLite: {
+				"CREATE TABLE IF NOT EXISTS PendingDeletion (id INTEGER PRIMARY KEY, holderId INTEGER REFERENCES Client (id) ON DELETE CASCADE, partName TEXT)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS PendingDeletion_holderId_partName_key ON PendingDeletion (holderId, partName)",
+			},
+		},
+		map[string][]string{
+			dialectCockroach: {
+				"DROP TABLE IF EXISTS PendingDeletion",
+			},
+			dialectSQLite: {
+				"DROP TABLE IF EXISTS PendingDeletion",
+			},
+		},
+	},
+	{5, "file versions",
+		map[string][]string{
+			// Existing Files become version 1, uploaded when they were last modified
+			dialectCockroach: {
+				"ALTER TABLE File ADD COLUMN IF NOT EXISTS version INT DEFAULT 1",
+				"ALTER TABLE File ADD COLUMN IF NOT EXISTS uploaded INT DEFAULT 0",
+				"UPDATE File SET uploaded = modified WHERE uploaded = 0",
+				"CREATE UNIQUE INDEX IF NOT EXISTS File_ownerId_name_version_key ON File (ownerId, name, version)",
+				"DROP INDEX IF EXISTS File@File_ownerId_name_key CASCADE",
+			},
+			dialectSQLite: {
+				"ALTER TABLE File ADD COLUMN version INTEGER DEFAULT 1",
+				"ALTER TABLE File ADD COLUMN uploaded INTEGER DEFAULT 0",
+				"UPDATE File SET uploaded = modified WHERE uploaded = 0",
+				"CREATE UNIQUE INDEX File_ownerId_name_version_key ON File (ownerId, name, version)",
+				"DROP INDEX File_ownerId_name_key",
+			},
+		},
+		// Only the newest version of each File survives, older ones are deleted with their
+		// parts without telling the holders
+		map[string][]string{
+			dialectCockroach: {
+				"DELETE FROM File WHERE version < (SELECT MAX(newest.version) FROM File AS newest WHERE newest.ownerId = File.ownerId AND newest.name = File.name)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS File_ownerId_name_key ON File (ownerId, name)",
+				"DROP INDEX IF EXISTS File@File_ownerId_name_version_key CASCADE",
+				"ALTER TABLE File DROP COLUMN IF EXISTS uploaded",
+				"ALTER TABLE File DROP COLUMN IF EXISTS version",
+			},
+			dialectSQLite: {
+				"DELETE FROM File WHERE version < (SELECT MAX(newest.version) FROM File AS newest WHERE newest.ownerId = File.ownerId AND newest.name = File.name)",
+				"CREATE UNIQUE INDEX File_ownerId_name_key ON File (ownerId, name)",
+				"DROP INDEX File_ownerId_name_version_key",
+				"ALTER TABLE File DROP COLUMN uploaded",
+				"ALTER TABLE File DROP COLUMN version",
+			},
+		},
+	},
+	{6, "directories",
+		map[string][]string{
+			dialectCockroach: {
+				"CREATE TABLE IF NOT EXISTS Directory (id SERIAL PRIMARY KEY, ownerId INT REFERENCES Client (id) ON DELETE CASCADE, path string)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS Directory_ownerId_path_key ON Directory (ownerId, path)",
+			},
+			dialectSQLite: {
+				"CREATE TABLE IF NOT EXISTS Directory (id INTEGER PRIMARY KEY, ownerId INTEGER REFERENCES Client (id) ON DELETE CASCADE, path TEXT)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS Directory_ownerId_path_key ON Directory (ownerId, path)",
+			},
+		},
+		// Directories that hold no File are forgotten
+		map[string][]string{
+			dialectCockroach: {
+				"DROP TABLE IF EXISTS Directory",
+			},
+			dialectSQLite: {
+				"DROP TABLE IF EXISTS Directory",
+			},
+		},
+	},
+	// Older tokens carry the password key in their claims, so they are revoked rather than trusted
+	{7, "session token keys",
+		map[string][]string{
+			dialectCockroach: {
+				"ALTER TABLE SessionToken ADD COLUMN IF NOT EXISTS passwordKey BYTES",
+				"UPDATE SessionToken SET revoked = true WHERE passwordKey IS NULL",
+			},
+			dialectSQLite: {
+				"ALTER TABLE SessionToken ADD COLUMN passwordKey BLOB",
+				"UPDATE SessionToken SET revoked = true WHERE passwordKey IS NULL",
+			},
+		},
+		map[string][]string{
+			dialectCockroach: {
+				"ALTER TABLE SessionToken DROP COLUMN IF EXISTS passwordKey",
+			},
+			dialectSQLite: {
+				"ALTER TABLE SessionToken DROP COLUMN passwordKey",
+			},
+		},
+	},
+	// Parts used to be named after their File, so a File uploaded again after a move, or two uploads
+	// racing for a version, could share part names. Holders only keep the last bytes sent under a
+	// name, so only the newest part of each name still describes what they store.
+	{8, "unique part names",
+		map[string][]string{
+			dialectCockroach: {
+				"DELETE FROM FilePart WHERE id NOT IN (SELECT MAX(id) FROM FilePart GROUP BY name)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS FilePart_name_key ON FilePart (name)",
+			},
+			dialectSQLite: {
+				"DELETE FROM FilePart WHERE id NOT IN (SELECT MAX(id) FROM FilePart GROUP BY name)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS FilePart_name_key ON FilePart (name)",
+			},
+		},
+		map[string][]string{
+			dialectCockroach: {
+				"DROP INDEX IF EXISTS FilePart@FilePart_name_key CASCADE",
+			},
+			dialectSQLite: {
+				"DROP INDEX IF EXISTS FilePart_name_key",
+			},
+		},
+	},
+}
+
+// SchemaVersion returns the version of the last Migration applied to the store, 0 for an empty store
+func (db *SQLStore) SchemaVersion() (int, error) {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INT PRIMARY KEY, name TEXT, applied INT)"); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	return int(version.Int64), err
+}
+
+// Migrate applies or reverts Migrations until the store's schema is at version target
+func (db *SQLStore) Migrate(target int) error {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this server knows, latest is %d", current, len(migrations))
+	}
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("no schema version %d, latest is %d", target, len(migrations))
+	}
+	for ; current < target; current++ {
+		m := migrations[current]
+		log.Println("Applying migration", m.version, m.name)
+		const recordSQL = `
+		INSERT INTO schema_version (version, name, applied) VALUES ($1, $2, $3)`
+		if err := db.runMigration(m.up[db.dialect], recordSQL, m.version, m.name, time.Now().Unix()); err != nil {
+			return fmt.Errorf("migration %d %s: %v", m.version, m.name, err)
+		}
+	}
+	for ; current > target; current-- {
+		m := migrations[current-1]
+		log.Println("Reverting migration", m.version, m.name)
+		if err := db.runMigration(m.down[db.dialect], "DELETE FROM schema_version WHERE version=$1", m.version); err != nil {
+			return fmt.Errorf("revert migration %d %s: %v", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// runMigration executes statements followed by the schema_version bookkeeping query record
+func (db *SQLStore) runMigration(statements []string, record string, args ...interface{}) error {
+	if db.dialect != dialectSQLite {
+		for _, stmt := range statements {
+			if _, err := db.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		_, err := db.Exec(record, args...)
+		return err
+	}
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// prepareSchema brings store's schema up to date at startup, or checks it already is if auto-migrate is off
+func prepareSchema(store MetadataStore) error {
+	db, ok := store.(*SQLStore)
+	if !ok {
+		return nil
+	}
+	if *autoMigrate {
+		return db.Migrate(len(migrations))
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version != len(migrations) {
+		return fmt.Errorf("schema is at version %d but this server needs %d, run the migrate subcommand", version, len(migrations))
+	}
+	return nil
+}
+
+// runMigrate carries out the migrate subcommand with args following "migrate" on the command line
+func runMigrate(store MetadataStore, args []string) error {
+	db, ok := store.(*SQLStore)
+	if !ok {
+		return errors.New("the " + *storeKind + " store has no schema to migrate")
+	}
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	target := -1
+	if len(args) > 1 {
+		if target, err = strconv.Atoi(args[1]); err != nil {
+			return errors.New("migrate: version must be a number")
+		}
+	}
+
+	switch action {
+	case "status":
+		for _, m := range migrations {
+			state := "pending"
+			if m.version <= current {
+				state = "applied"
+			}
+			fmt.Printf("%3d  %-8s %s\n", m.version, state, m.name)
+		}
+		return nil
+	case "up":
+		if target == -1 {
+			target = len(migrations)
+		}
+		if target < current {
+			return fmt.Errorf("migrate up: schema is already at version %d", current)
+		}
+	case "down":
+		if target == -1 {
+			target = current - 1
+		}
+		if target > current {
+			return fmt.Errorf("migrate down: schema is only at version %d", current)
+		}
+	default:
+		return errors.New("migrate: unknown action " + action + ", use up, down or status")
+	}
+	if err := db.Migrate(target); err != nil {
+		return err
+	}
+	log.Println("Schema is at version", target)
+	return nil
+}
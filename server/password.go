@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+/*
+	Client passwords are stored as argon2id hashes in the PHC string format:
+
+		$argon2id$v=19$m=<memory KiB>,t=<time>,p=<threads>$<base64 salt>$<base64 hash>
+
+	Clients created before salted hashing have a bare hex SHA-256 of their password
+	instead. Those are still accepted at login and replaced by an argon2id hash, as are
+	hashes made with parameters other than the current flags.
+*/
+
+// Password hashing flags, raise them as hardware gets faster
+var passwordTime = flag.Uint("password-time", 2, "argon2id passes over memory when hashing passwords")
+var passwordMemory = flag.Uint("password-memory", 64*1024, "argon2id memory in KiB used when hashing passwords")
+var passwordThreads = flag.Uint("password-threads", 4, "argon2id parallelism when hashing passwords")
+
+const passwordHashLength = 32
+
+// argon2Params are the tunables a password hash was made with
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// currentArgon2Params returns the tunables new password hashes are made with
+func currentArgon2Params() argon2Params {
+	return argon2Params{uint32(*passwordMemory), uint32(*passwordTime), uint8(*passwordThreads)}
+}
+
+// HashPassword hashes password with argon2id under a new random salt
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := currentArgon2Params()
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, passwordHashLength)
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// VerifyPassword checks password against a stored hash, and reports whether the hash
+// should be replaced because it is a legacy SHA-256 or uses outdated parameters
+func VerifyPassword(password string, stored string) (ok bool, rehash bool) {
+	if !strings.HasPrefix(stored, "$argon2id$") {
+		return subtle.ConstantTimeCompare([]byte(hash(password)), []byte(stored)) == 1, true
+	}
+	p, salt, key, err := parseArgon2Hash(stored)
+	if err != nil {
+		return false, false
+	}
+	got := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	ok = subtle.ConstantTimeCompare(got, key) == 1
+	return ok, p != currentArgon2Params()
+}
+
+// parseArgon2Hash splits a PHC string made by HashPassword into its parameters, salt and hash
+func parseArgon2Hash(stored string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	fields := strings.Split(stored, "$")
+	if len(fields) != 6 || fields[1] != "argon2id" {
+		return p, nil, nil, errors.New("password hash: not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errors.New("password hash: unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil || p.memory == 0 || p.time == 0 || p.threads == 0 {
+		return p, nil, nil, errors.New("password hash: bad parameters")
+	}
+	b64 := base64.RawStdEncoding
+	salt, err := b64.DecodeString(fields[4])
+	if err != nil {
+		return p, nil, nil, errors.New("password hash: bad salt")
+	}
+	key, err := b64.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, errors.New("password hash: bad hash")
+	}
+	return p, salt, key, nil
+}
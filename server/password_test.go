@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// withCheapPasswords makes password hashing fast enough for tests
+func withCheapPasswords(t *testing.T) {
+	t.Helper()
+	oldTime, oldMemory, oldThreads := *passwordTime, *passwordMemory, *passwordThreads
+	t.Cleanup(func() { *passwordTime, *passwordMemory, *passwordThreads = oldTime, oldMemory, oldThreads })
+	*passwordTime, *passwordMemory, *passwordThreads = 1, 64, 1
+}
+
+func TestVerifyPassword(t *testing.T) {
+	withCheapPasswords(t)
+	stored, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, rehash := VerifyPassword("secret", stored); !ok || rehash {
+		t.Errorf("correct password gave ok %v rehash %v, want ok and no rehash", ok, rehash)
+	}
+	if ok, _ := VerifyPassword("Secret", stored); ok {
+		t.Error("wrong password was accepted")
+	}
+	if again, _ := HashPassword("secret"); again == stored {
+		t.Error("hashing twice gave the same hash, salts aren't random")
+	}
+}
+
+func TestVerifyPasswordMalformed(t *testing.T) {
+	withCheapPasswords(t)
+	stored, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Split(stored, "$")
+	with := func(i int, field string) string {
+		f := append([]string(nil), fields...)
+		f[i] = field
+		return strings.Join(f, "$")
+	}
+	for name, bad := range map[string]string{
+		"truncated":        stored[:len(stored)/2],
+		"no hash":          strings.Join(fields[:5], "$"),
+		"extra field":      stored + "$x",
+		"other algorithm":  with(1, "argon2i"),
+		"other version":    with(2, "v=16"),
+		"bad parameters":   with(3, "m=64,t=1"),
+		"zero time":        with(3, "m=64,t=0,p=1"),
+		"zero threads":     with(3, "m=64,t=1,p=0"),
+		"salt not base64":  with(4, "!!!"),
+		"hash not base64":  with(5, "!!!"),
+		"empty hash":       with(5, ""),
+		"only the prefix":  "$argon2id$",
+		"empty":            "",
+		"legacy but wrong": hash("other"),
+	} {
+		if ok, _ := VerifyPassword("secret", bad); ok {
+			t.Errorf("%s: accepted %q", name, bad)
+		}
+	}
+}
+
+func TestVerifyPasswordRehash(t *testing.T) {
+	withCheapPasswords(t)
+	stored, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Raising any of the flags outdates existing hashes, which still verify
+	for _, raise := range []func(){
+		func() { *passwordTime++ },
+		func() { *passwordMemory *= 2 },
+		func() { *passwordThreads++ },
+	} {
+		withCheapPasswords(t)
+		raise()
+		if ok, rehash := VerifyPassword("secret", stored); !ok || !rehash {
+			t.Errorf("hash with old parameters gave ok %v rehash %v, want both", ok, rehash)
+		}
+	}
+	// Legacy SHA-256 hashes verify and are always replaced
+	if ok, rehash := VerifyPassword("secret", hash("secret")); !ok || !rehash {
+		t.Errorf("legacy hash gave ok %v rehash %v, want both", ok, rehash)
+	}
+}
+
+func TestAuthenticateUpgradesLegacyHash(t *testing.T) {
+	withCheapPasswords(t)
+	oldDatabase := database
+	defer func() { database = oldDatabase }()
+	database = NewMemoryStore()
+	if err := database.CreateClient(Client{"alice", hash("secret")}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := authenticate(UserMeta{"alice", "wrong"})
+	var pe ProtocolError
+	if !errors.As(err, &pe) || pe.Code != ErrCodeUnauthorized {
+		t.Errorf("wrong password gave %v, want an %s error", err, ErrCodeUnauthorized)
+	}
+	if c, _ := database.LookupClient("alice"); c.password != hash("secret") {
+		t.Error("a failed login changed the stored hash")
+	}
+
+	if _, err := authenticate(UserMeta{"alice", "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := database.LookupClient("alice")
+	if err != nil || !strings.HasPrefix(c.password, "$argon2id$") {
+		t.Fatalf("stored hash after login is %q, %v, want an argon2id hash", c.password, err)
+	}
+	if ok, rehash := VerifyPassword("secret", c.password); !ok || rehash {
+		t.Errorf("upgraded hash gave ok %v rehash %v", ok, rehash)
+	}
+	// The upgraded hash keeps working
+	if _, err := authenticate(UserMeta{"alice", "secret"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := authenticate(UserMeta{"bob", "secret"}); !errors.As(err, &pe) || pe.Code != ErrCodeUnauthorized {
+		t.Errorf("unknown client gave %v, want an %s error", err, ErrCodeUnauthorized)
+	}
+}
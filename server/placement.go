@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var placementFlag = flag.String("placement", "round-robin", "policy for choosing peers to store parts on: round-robin, least-used, uptime or weighted-random")
+
+// Singleton placement policy, set from the placement flag in main
+var placement PlacementPolicy
+
+// PlacementPolicy chooses which of the candidate Clients a FilePart gets stored on.
+// Place returns up to fp.replicas distinct Clients from candidates. Policies don't know
+// where the other parts of a File went, see placeStripe.
+type PlacementPolicy interface {
+	Place(candidates []Client, fp FilePart) []Client
+}
+
+// NewPlacementPolicy returns the PlacementPolicy registered under name
+func NewPlacementPolicy(name string) (PlacementPolicy, error) {
+	switch name {
+	case "round-robin":
+		return &RoundRobinPlacement{}, nil
+	case "least-used":
+		return LeastUsedPlacement{database.StoredBytesByClient}, nil
+	case "uptime":
+		return UptimePlacement{clientUptime}, nil
+	case "weighted-random":
+		return &WeightedRandomPlacement{weight: uptimeWeight, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	}
+	return nil, fmt.Errorf("unknown placement policy %q", name)
+}
+
+// RoundRobinPlacement hands out candidates in turn, carrying on where the last FilePart stopped
+type RoundRobinPlacement struct {
+	mu   sync.Mutex
+	next int
+}
+
+// Place implements PlacementPolicy
+func (p *RoundRobinPlacement) Place(candidates []Client, fp FilePart) []Client {
+	n := placementCount(candidates, fp)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Consecutive candidates in the ring are distinct as long as we take no more than len(candidates)
+	var targets []Client
+	for i := 0; i < n; i++ {
+		targets = append(targets, candidates[p.next%len(candidates)])
+		p.next++
+	}
+	return targets
+}
+
+// LeastUsedPlacement prefers the candidates currently storing the fewest bytes for others
+type LeastUsedPlacement struct {
+	storedBytes func() (map[string]int, error)
+}
+
+// Place implements PlacementPolicy
+func (p LeastUsedPlacement) Place(candidates []Client, fp FilePart) []Client {
+	stored, err := p.storedBytes()
+	if err != nil {
+		log.Println("least used placement:", err)
+	}
+	sorted := append([]Client{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return stored[sorted[i].username] < stored[sorted[j].username]
+	})
+	return sorted[:placementCount(candidates, fp)]
+}
+
+// UptimePlacement prefers the candidates that have been connected the longest
+type UptimePlacement struct {
+	uptime func(Client) time.Duration
+}
+
+// Place implements PlacementPolicy
+func (p UptimePlacement) Place(candidates []Client, fp FilePart) []Client {
+	sorted := append([]Client{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return p.uptime(sorted[i]) > p.uptime(sorted[j])
+	})
+	return sorted[:placementCount(candidates, fp)]
+}
+
+// WeightedRandomPlacement picks candidates at random, each in proportion to its weight
+type WeightedRandomPlacement struct {
+	weight func(Client) float64
+	mu     sync.Mutex // rand.Rand isn't safe for concurrent uploads
+	rnd    *rand.Rand
+}
+
+// Place implements PlacementPolicy
+func (p *WeightedRandomPlacement) Place(candidates []Client, fp FilePart) []Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := placementCount(candidates, fp)
+	remaining := append([]Client{}, candidates...)
+	var targets []Client
+	for len(targets) < n {
+		total := 0.0
+		for _, c := range remaining {
+			total += p.weight(c)
+		}
+		pick := p.rnd.Float64() * total
+		i := 0
+		for ; i < len(remaining)-1; i++ {
+			pick -= p.weight(remaining[i])
+			if pick < 0 {
+				break
+			}
+		}
+		targets = append(targets, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return targets
+}
+
+// placeStripe chooses the holders of every part of one stripe with policy. While there are enough
+// candidates each part goes to peers holding no other part of the stripe, so losing a peer costs the
+// stripe as few shards as possible. With fewer candidates than copies, peers get several parts in turn.
+func placeStripe(policy PlacementPolicy, candidates []Client, parts []FilePart) [][]Client {
+	holders := make([][]Client, len(parts))
+	used := map[string]bool{}
+	for i, fp := range parts {
+		var free []Client
+		for _, c := range candidates {
+			if !used[c.username] {
+				free = append(free, c)
+			}
+		}
+		if len(free) < placementCount(candidates, fp) {
+			free = candidates
+			used = map[string]bool{}
+		}
+		holders[i] = policy.Place(free, fp)
+		for _, h := range holders[i] {
+			used[h.username] = true
+		}
+	}
+	return holders
+}
+
+// placementCount is how many targets a policy should return for fp
+func placementCount(candidates []Client, fp FilePart) int {
+	n := fp.replicas
+	if n < 1 {
+		n = 1
+	}
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	return n
+}
+
+// uptimeWeight weighs a Client by the minutes it has been connected, so new peers still get some parts
+func uptimeWeight(c Client) float64 {
+	return 1 + clientUptime(c).Minutes()
+}
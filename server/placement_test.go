@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPolicies returns one of every PlacementPolicy, with stand-ins for what they measure peers by
+func testPolicies() map[string]PlacementPolicy {
+	return map[string]PlacementPolicy{
+		"round-robin": &RoundRobinPlacement{},
+		"least-used": LeastUsedPlacement{func() (map[string]int, error) {
+			return map[string]int{"peer0": 10, "peer1": 5}, nil
+		}},
+		"uptime": UptimePlacement{func(c Client) time.Duration {
+			return time.Duration(len(c.username)) * time.Minute
+		}},
+		"weighted-random": &WeightedRandomPlacement{weight: func(Client) float64 { return 1 }, rnd: rand.New(rand.NewSource(1))},
+	}
+}
+
+func testPeers(n int) []Client {
+	var peers []Client
+	for i := 0; i < n; i++ {
+		peers = append(peers, Client{username: fmt.Sprintf("peer%d", i)})
+	}
+	return peers
+}
+
+func testStripe(n, replicas int) []FilePart {
+	parts := make([]FilePart, n)
+	for i := range parts {
+		parts[i].index = i
+		parts[i].replicas = replicas
+	}
+	return parts
+}
+
+func TestPlaceStripeSpreadsParts(t *testing.T) {
+	tests := []struct {
+		peers, parts, replicas int
+		maxPerPeer             int
+	}{
+		{peers: 6, parts: 6, replicas: 1, maxPerPeer: 1},
+		{peers: 10, parts: 6, replicas: 1, maxPerPeer: 1},
+		{peers: 3, parts: 6, replicas: 1, maxPerPeer: 2},
+		{peers: 6, parts: 3, replicas: 2, maxPerPeer: 1},
+		{peers: 2, parts: 2, replicas: 3, maxPerPeer: 2},
+	}
+	for name, policy := range testPolicies() {
+		for _, tt := range tests {
+			holders := placeStripe(policy, testPeers(tt.peers), testStripe(tt.parts, tt.replicas))
+			perPeer := map[string]int{}
+			for i, hs := range holders {
+				want := tt.replicas
+				if want > tt.peers {
+					want = tt.peers
+				}
+				if len(hs) != want {
+					t.Errorf("%s %+v: part %d got %d holders, want %d", name, tt, i, len(hs), want)
+				}
+				distinct := map[string]bool{}
+				for _, h := range hs {
+					if distinct[h.username] {
+						t.Errorf("%s %+v: part %d placed twice on %s", name, tt, i, h.username)
+					}
+					distinct[h.username] = true
+					perPeer[h.username]++
+				}
+			}
+			for peer, n := range perPeer {
+				if n > tt.maxPerPeer {
+					t.Errorf("%s %+v: %s holds %d parts of the stripe, want at most %d", name, tt, peer, n, tt.maxPerPeer)
+				}
+			}
+		}
+	}
+}
+
+func TestWeightedRandomPlacementConcurrent(t *testing.T) {
+	policy := testPolicies()["weighted-random"]
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				placeStripe(policy, testPeers(6), testStripe(6, 1))
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	Every text message on the websocket is a JSON object whose "type" names one of the
+	message structs below. New users send a "register" message and returning users a
+	"login" message, announcing the newest protocol version they speak. The server answers
+	with a "registered" or "loggedIn" message carrying the version both sides will use, and
+	a session token that later "login" messages can send instead of the password.
+	The legacy "registration" message logs in, creating the account if the name is new. Clients that don't send a version speak
+	version 1, the original untyped protocol, which version 2 is wire compatible with.
+	Version 3 sends binary messages as Frames, see frame.go. Version 4 peers acknowledge
+	every part they store and delete parts of failed uploads, see deliver.go. Version 5 file
+	lists list one directory at a time, see directories.go. Version 6 clients encrypt the
+	Files they upload themselves, see envelope.go.
+
+	Messages that fail to decode or validate are answered with an "error" message
+	instead of being dropped.
+*/
+
+// ProtocolVersion is the newest wire protocol version the server speaks
+const ProtocolVersion = 6
+
+// Error codes sent in ErrorMessage
+const (
+	ErrCodeBadMessage    = "badMessage"
+	ErrCodeUnknownType   = "unknownType"
+	ErrCodeNotRegistered = "notRegistered"
+	ErrCodeUnauthorized  = "unauthorized"
+	ErrCodeNotFound      = "notFound"
+	ErrCodeConflict      = "conflict"
+	ErrCodeUnavailable   = "unavailable"
+	ErrCodeQuotaExceeded = "quotaExceeded"
+	ErrCodeInternal      = "internal"
+)
+
+// MessageHeader is the part every text message has in common
+type MessageHeader struct {
+	Type string `json:"type"`
+}
+
+// FileMeta describes a File or FilePart in a message
+type FileMeta struct {
+	Name         string `json:"name"`
+	DateModified string `json:"dateModified,omitempty"` // milliseconds since the epoch from clients, seconds from the server
+	LastModified string `json:"lastModified,omitempty"` // seconds since the epoch
+	Replicas     *int   `json:"replicas,omitempty"`     // per-upload replication factor override
+	Version      int    `json:"version,omitempty"`      // version of the File, the current one if omitted
+	WrappedKey   string `json:"wrappedKey,omitempty"`   // base64 file key wrapped by the client that sealed the File
+}
+
+// UserMeta holds a Client's credentials
+type UserMeta struct {
+	Name string `json:"name"`
+	Pass string `json:"pass"`
+}
+
+// RegistrationMessage is sent by a client when it connects, as a "register", "login" or legacy "registration".
+// A "login" can carry a session token from an earlier login instead of the password.
+type RegistrationMessage struct {
+	Type     string   `json:"type"`
+	Version  int      `json:"version,omitempty"`
+	UserMeta UserMeta `json:"userMeta"`
+	Token    string   `json:"token,omitempty"`
+	Remember bool     `json:"remember,omitempty"` // asks for a session token to log in with later
+}
+
+// RegisteredMessage acknowledges a registration or login with the negotiated protocol version.
+// Registrations and logins with a password that asked to be remembered are issued a session token.
+type RegisteredMessage struct {
+	Type         string `json:"type"`
+	Version      int    `json:"version"`
+	SessionID    string `json:"sessionId"`
+	Token        string `json:"token,omitempty"`
+	TokenExpires string `json:"tokenExpires,omitempty"` // seconds since the epoch
+}
+
+// SessionInfo describes one active session token in a SessionsMessage
+type SessionInfo struct {
+	TokenID     string `json:"tokenId"`
+	Created     string `json:"created"` // seconds since the epoch
+	Expires     string `json:"expires"` // seconds since the epoch
+	Connections int    `json:"connections"`
+	Current     bool   `json:"current"`
+}
+
+// SessionsMessage asks for the Client's active session tokens, the server answers with them listed
+type SessionsMessage struct {
+	Type     string        `json:"type"`
+	Sessions []SessionInfo `json:"sessions,omitempty"`
+}
+
+// UsageMessage asks for the bytes the Client has given to and received from its peers,
+// the server answers with them and the Client's quota, if there is one, see quota.go
+type UsageMessage struct {
+	Type     string `json:"type"`
+	Given    int    `json:"given"`
+	Received int    `json:"received"`
+	Quota    *int   `json:"quota,omitempty"` // absent when there is no quota
+}
+
+// LogoutMessage revokes a session token, the current one if TokenID is empty.
+// The server answers with type "loggedOut" and closes the connections that used the token.
+type LogoutMessage struct {
+	Type    string `json:"type"`
+	TokenID string `json:"tokenId,omitempty"`
+}
+
+// FileMessage announces an upload. The File's bytes follow as the next binary message, or
+// from version 3 as a FrameFileData with the same RequestID. The server also uses it to send a whole File.
+type FileMessage struct {
+	Type      string   `json:"type"`
+	RequestID uint64   `json:"requestId,omitempty"`
+	FileMeta  FileMeta `json:"fileMeta"`
+}
+
+// RequestMessage asks for a File's bytes. From the server it asks a peer for a part and carries a RequestID,
+// from a client the RequestID is optional and echoed in the download's frames.
+type RequestMessage struct {
+	Type      string   `json:"type"`
+	RequestID uint64   `json:"requestId,omitempty"`
+	FileMeta  FileMeta `json:"fileMeta"`
+}
+
+// ResponseMessage precedes the bytes of a requested File
+type ResponseMessage struct {
+	Type     string   `json:"type"`
+	FileMeta FileMeta `json:"fileMeta"`
+}
+
+// DownloadCompleteMessage follows the last FrameFileResponse of a streamed download
+type DownloadCompleteMessage struct {
+	Type      string   `json:"type"`
+	RequestID uint64   `json:"requestId,omitempty"`
+	FileMeta  FileMeta `json:"fileMeta"`
+	Size      int64    `json:"size"`
+}
+
+// PartMessage precedes the bytes of a FilePart sent to a peer for storage.
+// The server also sends it with type "deletePart" to have a peer drop a part it stores.
+type PartMessage struct {
+	Type     string   `json:"type"`
+	FileMeta FileMeta `json:"fileMeta"`
+}
+
+// PartResponseMessage precedes a peer's answer to a part request
+type PartResponseMessage struct {
+	Type      string   `json:"type"`
+	RequestID uint64   `json:"requestId"`
+	FileMeta  FileMeta `json:"fileMeta"`
+}
+
+// PartStoredMessage is a peer's acknowledgement that it stores the part sent in the FramePart with RequestID
+type PartStoredMessage struct {
+	Type      string   `json:"type"`
+	RequestID uint64   `json:"requestId"`
+	FileMeta  FileMeta `json:"fileMeta"`
+}
+
+// UploadInitMessage starts a chunked upload of a File of Size bytes
+type UploadInitMessage struct {
+	Type      string   `json:"type"`
+	RequestID uint64   `json:"requestId,omitempty"`
+	FileMeta  FileMeta `json:"fileMeta"`
+	Size      int64    `json:"size"`
+}
+
+// UploadStartedMessage answers an UploadInitMessage. Chunk i is sent as a FrameUploadChunk
+// named UploadID at offset i*ChunkSize.
+type UploadStartedMessage struct {
+	Type      string `json:"type"`
+	RequestID uint64 `json:"requestId,omitempty"`
+	UploadID  string `json:"uploadId"`
+	ChunkSize int    `json:"chunkSize"`
+	Chunks    int    `json:"chunks"`
+	ExpiresAt string `json:"expiresAt"` // seconds since the epoch
+}
+
+// UploadStatusMessage asks which chunks of an upload have arrived, the server answers with the rest filled in
+type UploadStatusMessage struct {
+	Type      string `json:"type"`
+	UploadID  string `json:"uploadId"`
+	ChunkSize int    `json:"chunkSize,omitempty"`
+	Chunks    int    `json:"chunks,omitempty"`
+	Received  []int  `json:"received,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+// UploadCommitMessage finishes a chunked upload, the server answers with type "uploadCommitted"
+type UploadCommitMessage struct {
+	Type     string `json:"type"`
+	UploadID string `json:"uploadId"`
+}
+
+// DeleteMessage deletes one of the Client's Files, or one version of it if FileMeta has a version.
+// The server answers with type "deleted".
+type DeleteMessage struct {
+	Type     string   `json:"type"`
+	FileMeta FileMeta `json:"fileMeta"`
+}
+
+// VersionInfo describes one version of a File in a VersionsMessage
+type VersionInfo struct {
+	Version      int    `json:"version"`
+	LastModified string `json:"lastModified"` // seconds since the epoch
+	Uploaded     string `json:"uploaded"`     // seconds since the epoch
+	Current      bool   `json:"current"`
+}
+
+// VersionsMessage asks for the versions of a File, the server answers with them listed newest first
+type VersionsMessage struct {
+	Type     string        `json:"type"`
+	FileMeta FileMeta      `json:"fileMeta"`
+	Versions []VersionInfo `json:"versions,omitempty"`
+}
+
+// RestoreMessage makes the version of a File in FileMeta its current one.
+// The server answers with type "restored" and the version number the File now has.
+type RestoreMessage struct {
+	Type     string   `json:"type"`
+	FileMeta FileMeta `json:"fileMeta"`
+}
+
+// FileListEntry is one File or directory in a FileListMessage, directories only have a name
+type FileListEntry struct {
+	FileMeta  FileMeta `json:"fileMeta"`
+	Directory bool     `json:"directory,omitempty"`
+}
+
+// FileListMessage lists the Files a Client has stored in the directory Prefix.
+// Clients send one, without Files, to pick the directory later file lists list.
+type FileListMessage struct {
+	Type      string          `json:"type"`
+	Prefix    string          `json:"prefix,omitempty"`
+	Recursive bool            `json:"recursive,omitempty"`
+	Files     []FileListEntry `json:"files"`
+}
+
+// MkdirMessage creates a directory, the server answers with type "directoryCreated"
+type MkdirMessage struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
+// MoveMessage renames a File or directory, the server answers with type "moved"
+type MoveMessage struct {
+	Type string `json:"type"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ChallengeMessage asks a peer to prove it holds a part
+type ChallengeMessage struct {
+	Type        string   `json:"type"`
+	ChallengeID int      `json:"challengeId"`
+	FileMeta    FileMeta `json:"fileMeta"`
+	Nonce       string   `json:"nonce"`
+	Offset      int      `json:"offset"`
+	Length      int      `json:"length"`
+}
+
+// ChallengeResponseMessage is a peer's answer to a ChallengeMessage
+type ChallengeResponseMessage struct {
+	Type        string `json:"type"`
+	ChallengeID int    `json:"challengeId"`
+	MAC         string `json:"mac"`
+}
+
+// ErrorMessage reports why the server couldn't act on a message
+type ErrorMessage struct {
+	Type      string `json:"type"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	InReplyTo string `json:"inReplyTo,omitempty"`
+}
+
+// NewErrorMessage returns an ErrorMessage answering a message of type inReplyTo
+func NewErrorMessage(code string, inReplyTo string, err error) ErrorMessage {
+	return ErrorMessage{"error", code, err.Error(), inReplyTo}
+}
+
+// ProtocolError is an error that should be reported to the client with the given code
+type ProtocolError struct {
+	Code string
+	Err  error
+}
+
+func (e ProtocolError) Error() string {
+	return e.Err.Error()
+}
+
+// badMessage returns a ProtocolError for a malformed message
+func badMessage(format string, args ...interface{}) error {
+	return ProtocolError{ErrCodeBadMessage, fmt.Errorf(format, args...)}
+}
+
+// decodeMessage strictly decodes a text message into v and validates it
+func decodeMessage(message []byte, v interface{ validate() error }) error {
+	d := json.NewDecoder(bytes.NewReader(message))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		return badMessage("decode: %v", err)
+	}
+	return v.validate()
+}
+
+// messageType reads the type of a text message without decoding the rest of it
+func messageType(message []byte) (string, error) {
+	var h MessageHeader
+	if err := json.Unmarshal(message, &h); err != nil {
+		return "", badMessage("decode: %v", err)
+	}
+	if h.Type == "" {
+		return "", badMessage("message has no type")
+	}
+	return h.Type, nil
+}
+
+// negotiateVersion picks the protocol version to speak with a client that asked for requested
+func negotiateVersion(requested int) int {
+	if requested <= 0 {
+		return 1
+	}
+	if requested > ProtocolVersion {
+		return ProtocolVersion
+	}
+	return requested
+}
+
+func (m *RegistrationMessage) validate() error {
+	if m.UserMeta.Name == "" {
+		return badMessage("%s: userMeta.name is required", m.Type)
+	}
+	if m.Version < 0 {
+		return badMessage("%s: version can't be negative", m.Type)
+	}
+	if m.Token != "" && m.Type != "login" {
+		return badMessage("%s: only login accepts a token", m.Type)
+	}
+	if m.Remember && (m.Token != "" || (m.Type != "register" && m.Type != "login")) {
+		return badMessage("%s: only register and login with a password can ask to be remembered", m.Type)
+	}
+	if m.UserMeta.Pass == "" && m.Token == "" {
+		return badMessage("%s: userMeta.pass is required", m.Type)
+	}
+	return nil
+}
+
+func (m *SessionsMessage) validate() error {
+	return nil
+}
+
+func (m *LogoutMessage) validate() error {
+	return nil
+}
+
+func (m *UsageMessage) validate() error {
+	return nil
+}
+
+func (m *FileMessage) validate() error {
+	if err := m.FileMeta.validateName(); err != nil {
+		return err
+	}
+	if _, err := strconv.ParseInt(m.FileMeta.DateModified, 10, 64); err != nil {
+		return badMessage("file: fileMeta.dateModified must be milliseconds since the epoch")
+	}
+	if m.FileMeta.Replicas != nil && *m.FileMeta.Replicas < 0 {
+		return badMessage("file: fileMeta.replicas can't be negative")
+	}
+	if m.FileMeta.Version != 0 {
+		return badMessage("file: fileMeta.version is assigned by the server")
+	}
+	if _, err := m.FileMeta.wrappedKey(); err != nil {
+		return err
+	}
+	return validatePath(m.FileMeta.Name)
+}
+
+func (m *UploadInitMessage) validate() error {
+	if m.Size < 0 {
+		return badMessage("uploadInit: size can't be negative")
+	}
+	file := FileMessage{m.Type, m.RequestID, m.FileMeta}
+	return file.validate()
+}
+
+func (m *UploadStatusMessage) validate() error {
+	if m.UploadID == "" {
+		return badMessage("uploadStatus: uploadId is required")
+	}
+	return nil
+}
+
+func (m *UploadCommitMessage) validate() error {
+	if m.UploadID == "" {
+		return badMessage("uploadCommit: uploadId is required")
+	}
+	return nil
+}
+
+func (m *RequestMessage) validate() error {
+	if err := m.FileMeta.validateName(); err != nil {
+		return err
+	}
+	return m.FileMeta.validateVersion()
+}
+
+func (m *DeleteMessage) validate() error {
+	if err := m.FileMeta.validateName(); err != nil {
+		return err
+	}
+	return m.FileMeta.validateVersion()
+}
+
+func (m *VersionsMessage) validate() error {
+	return m.FileMeta.validateName()
+}
+
+func (m *RestoreMessage) validate() error {
+	if err := m.FileMeta.validateName(); err != nil {
+		return err
+	}
+	if m.FileMeta.Version <= 0 {
+		return badMessage("restore: fileMeta.version is required")
+	}
+	return nil
+}
+
+func (m *FileListMessage) validate() error {
+	if m.Prefix == "" {
+		return nil
+	}
+	return validatePath(m.Prefix)
+}
+
+func (m *MkdirMessage) validate() error {
+	return validatePath(m.Path)
+}
+
+func (m *MoveMessage) validate() error {
+	if m.From == "" {
+		return badMessage("move: from is required")
+	}
+	if err := validatePath(m.To); err != nil {
+		return err
+	}
+	if m.To == m.From || strings.HasPrefix(m.To, m.From+"/") {
+		return badMessage("move: can't move %s into itself", m.From)
+	}
+	return nil
+}
+
+func (m *PartResponseMessage) validate() error {
+	if m.RequestID == 0 {
+		return badMessage("partResponse: requestId is required")
+	}
+	return nil
+}
+
+func (m *PartStoredMessage) validate() error {
+	if m.RequestID == 0 {
+		return badMessage("partStored: requestId is required")
+	}
+	return nil
+}
+
+func (m *ChallengeResponseMessage) validate() error {
+	if m.ChallengeID == 0 {
+		return badMessage("challengeResponse: challengeId is required")
+	}
+	if m.MAC == "" {
+		return badMessage("challengeResponse: mac is required")
+	}
+	return nil
+}
+
+// validateName checks a FileMeta names a File
+func (fm FileMeta) validateName() error {
+	if fm.Name == "" {
+		return badMessage("fileMeta.name is required")
+	}
+	return nil
+}
+
+// wrappedKey decodes a FileMeta's client wrapped file key, nil if it has none
+func (fm FileMeta) wrappedKey() ([]byte, error) {
+	if fm.WrappedKey == "" {
+		return nil, nil
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(fm.WrappedKey)
+	if err != nil {
+		return nil, badMessage("fileMeta.wrappedKey must be base64")
+	}
+	if err := checkClientWrappedKey(wrappedKey); err != nil {
+		return nil, badMessage("fileMeta.wrappedKey: %v", err)
+	}
+	return wrappedKey, nil
+}
+
+// validateVersion checks a FileMeta's version, if any, is a valid version number
+func (fm FileMeta) validateVersion() error {
+	if fm.Version < 0 {
+		return badMessage("fileMeta.version can't be negative")
+	}
+	return nil
+}
+
+// asProtocolError gets the code to report err to a client with
+func asProtocolError(err error) ProtocolError {
+	var pe ProtocolError
+	if errors.As(err, &pe) {
+		return pe
+	}
+	if errors.Is(err, ErrNotFound) {
+		return ProtocolError{ErrCodeNotFound, err}
+	}
+	if errors.Is(err, ErrConflict) {
+		return ProtocolError{ErrCodeConflict, err}
+	}
+	return ProtocolError{ErrCodeInternal, err}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// strictDecode decodes message into a new value of v's type the way decodeMessage does, without validating it
+func strictDecode(message []byte, v interface{}) (interface{}, error) {
+	out := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+	d := json.NewDecoder(bytes.NewReader(message))
+	d.DisallowUnknownFields()
+	return out, d.Decode(out)
+}
+
+func TestMessagesRoundTrip(t *testing.T) {
+	replicas, quota := 2, 1<<20
+	meta := FileMeta{Name: "docs/a.txt", DateModified: "1700000000000", Replicas: &replicas}
+	stored := FileMeta{Name: "docs/a.txt", LastModified: "1700000000", Version: 3}
+	part := FileMeta{Name: "0123abcd"}
+	messages := []interface{}{
+		&MessageHeader{"file"},
+		&RegistrationMessage{"register", ProtocolVersion, UserMeta{"alice", "secret"}, "", false},
+		&RegistrationMessage{"login", ProtocolVersion, UserMeta{"alice", "secret"}, "", true},
+		&RegistrationMessage{"login", ProtocolVersion, UserMeta{"alice", ""}, "token", false},
+		&RegisteredMessage{"registered", ProtocolVersion, "s1", "token", "1700003600"},
+		&SessionsMessage{"sessions", []SessionInfo{{"t1", "1700000000", "1700003600", 2, true}}},
+		&UsageMessage{"usage", 10, 20, &quota},
+		&LogoutMessage{"logout", "t1"},
+		&FileMessage{"file", 7, meta},
+		&RequestMessage{"request", 8, stored},
+		&ResponseMessage{"response", stored},
+		&DownloadCompleteMessage{"downloadComplete", 8, stored, 1234},
+		&PartMessage{"deletePart", part},
+		&PartResponseMessage{"partResponse", 9, part},
+		&PartStoredMessage{"partStored", 9, part},
+		&UploadInitMessage{"uploadInit", 10, meta, 1 << 30},
+		&UploadStartedMessage{"uploadStarted", 10, "u1", 1 << 20, 1024, "1700086400"},
+		&UploadStatusMessage{"uploadStatus", "u1", 1 << 20, 1024, []int{0, 1, 5}, "1700086400"},
+		&UploadCommitMessage{"uploadCommit", "u1"},
+		&DeleteMessage{"delete", stored},
+		&VersionsMessage{"versions", stored, []VersionInfo{{3, "1700000000", "1700000100", true}, {2, "1690000000", "1690000100", false}}},
+		&RestoreMessage{"restore", stored},
+		&FileListMessage{"fileList", "docs", true, []FileListEntry{{FileMeta: stored}, {FileMeta: FileMeta{Name: "docs/old"}, Directory: true}}},
+		&MkdirMessage{"mkdir", "docs/old"},
+		&MoveMessage{"move", "docs/a.txt", "docs/old/a.txt"},
+		&ChallengeMessage{"challenge", 4, part, "bm9uY2U=", 16, 32},
+		&ChallengeResponseMessage{"challengeResponse", 4, "bWFj"},
+		&ErrorMessage{"error", ErrCodeNotFound, "file: no such file", "request"},
+	}
+	for _, msg := range messages {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("%T: marshal: %v", msg, err)
+		}
+		got, err := strictDecode(b, msg)
+		if err != nil {
+			t.Errorf("%T: decode %s: %v", msg, b, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("%T: round trip of %s gave %+v, want %+v", msg, b, got, msg)
+		}
+		// messages clients send must also pass decodeMessage's validation
+		if v, ok := got.(interface{ validate() error }); ok {
+			if err := decodeMessage(b, v); err != nil {
+				t.Errorf("%T: decodeMessage %s: %v", msg, b, err)
+			}
+		}
+	}
+}
+
+func TestDecodeMessageRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		into    interface{ validate() error }
+	}{
+		{"unknown field", `{"type":"delete","fileMeta":{"name":"a"},"bogus":1}`, &DeleteMessage{}},
+		{"unknown fileMeta field", `{"type":"request","fileMeta":{"name":"a","size":3}}`, &RequestMessage{}},
+		{"unknown userMeta field", `{"type":"login","userMeta":{"name":"a","pass":"b","admin":true}}`, &RegistrationMessage{}},
+		{"wrong field type", `{"type":"uploadInit","fileMeta":{"name":"a","dateModified":"1"},"size":"3"}`, &UploadInitMessage{}},
+		{"not an object", `["delete"]`, &DeleteMessage{}},
+		{"missing name", `{"type":"register","userMeta":{"pass":"b"}}`, &RegistrationMessage{}},
+		{"missing pass", `{"type":"register","userMeta":{"name":"a"}}`, &RegistrationMessage{}},
+		{"token outside login", `{"type":"register","userMeta":{"name":"a"},"token":"t"}`, &RegistrationMessage{}},
+		{"remembered token login", `{"type":"login","userMeta":{"name":"a"},"token":"t","remember":true}`, &RegistrationMessage{}},
+		{"remembered legacy registration", `{"type":"registration","userMeta":{"name":"a","pass":"b"},"remember":true}`, &RegistrationMessage{}},
+		{"missing file name", `{"type":"file","fileMeta":{"dateModified":"1"}}`, &FileMessage{}},
+		{"missing dateModified", `{"type":"file","fileMeta":{"name":"a"}}`, &FileMessage{}},
+		{"negative replicas", `{"type":"file","fileMeta":{"name":"a","dateModified":"1","replicas":-1}}`, &FileMessage{}},
+		{"bad path", `{"type":"file","fileMeta":{"name":"a/../b","dateModified":"1"}}`, &FileMessage{}},
+		{"negative size", `{"type":"uploadInit","fileMeta":{"name":"a","dateModified":"1"},"size":-1}`, &UploadInitMessage{}},
+		{"missing uploadId", `{"type":"uploadCommit"}`, &UploadCommitMessage{}},
+		{"missing status uploadId", `{"type":"uploadStatus"}`, &UploadStatusMessage{}},
+		{"missing request name", `{"type":"request","fileMeta":{}}`, &RequestMessage{}},
+		{"missing restore version", `{"type":"restore","fileMeta":{"name":"a"}}`, &RestoreMessage{}},
+		{"missing mkdir path", `{"type":"mkdir"}`, &MkdirMessage{}},
+		{"missing move from", `{"type":"move","to":"b"}`, &MoveMessage{}},
+		{"move into itself", `{"type":"move","from":"a","to":"a/b"}`, &MoveMessage{}},
+		{"missing requestId", `{"type":"partStored","fileMeta":{"name":"p"}}`, &PartStoredMessage{}},
+		{"missing response requestId", `{"type":"partResponse","fileMeta":{"name":"p"}}`, &PartResponseMessage{}},
+		{"missing challengeId", `{"type":"challengeResponse","mac":"m"}`, &ChallengeResponseMessage{}},
+		{"missing mac", `{"type":"challengeResponse","challengeId":1}`, &ChallengeResponseMessage{}},
+		{"negative protocol version", `{"type":"login","version":-1,"userMeta":{"name":"a","pass":"b"}}`, &RegistrationMessage{}},
+		{"protocol version not a number", `{"type":"login","version":"5","userMeta":{"name":"a","pass":"b"}}`, &RegistrationMessage{}},
+		{"upload with a version", `{"type":"file","fileMeta":{"name":"a","dateModified":"1","version":2}}`, &FileMessage{}},
+		{"negative file version", `{"type":"delete","fileMeta":{"name":"a","version":-1}}`, &DeleteMessage{}},
+		{"negative restore version", `{"type":"restore","fileMeta":{"name":"a","version":-2}}`, &RestoreMessage{}},
+	}
+	for _, test := range tests {
+		err := decodeMessage([]byte(test.message), test.into)
+		var pe ProtocolError
+		if !errors.As(err, &pe) || pe.Code != ErrCodeBadMessage {
+			t.Errorf("%s: decodeMessage(%s) = %v, want a %s error", test.name, test.message, err, ErrCodeBadMessage)
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	for requested, want := range map[int]int{0: 1, 1: 1, 3: 3, ProtocolVersion: ProtocolVersion, ProtocolVersion + 1: ProtocolVersion, 99: ProtocolVersion} {
+		if got := negotiateVersion(requested); got != want {
+			t.Errorf("negotiateVersion(%d) = %d, want %d", requested, got, want)
+		}
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, f := range []Frame{
+		{Type: FramePart, RequestID: 9, Name: "0123abcd", Payload: []byte("part bytes")},
+		{Type: FrameFileResponse, RequestID: 8, Name: "docs/a.txt", Offset: 1 << 40, Payload: []byte{}},
+		{Type: FrameUploadChunk, Name: "u1", Offset: 1 << 20, Payload: bytes.Repeat([]byte{7}, 1000)},
+	} {
+		got, err := ParseFrame(f.Marshal())
+		if err != nil {
+			t.Fatalf("ParseFrame: %v", err)
+		}
+		if !reflect.DeepEqual(got, f) {
+			t.Errorf("round trip gave %+v, want %+v", got, f)
+		}
+	}
+}
+
+func TestParseFrameRejects(t *testing.T) {
+	good := Frame{Type: FramePart, RequestID: 1, Name: "p", Payload: []byte("payload")}.Marshal()
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), good...))
+	}
+	tests := map[string][]byte{
+		"truncated header": good[:frameHeaderSize-1],
+		"bad magic":        corrupt(func(b []byte) []byte { b[0] = 'X'; return b }),
+		"wrong version":    corrupt(func(b []byte) []byte { b[2] = frameVersion + 1; return b }),
+		"short payload":    good[:len(good)-1],
+		"long payload":     append(append([]byte(nil), good...), 0),
+		"bad checksum":     corrupt(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }),
+	}
+	for name, b := range tests {
+		if _, err := ParseFrame(b); err == nil {
+			t.Errorf("%s: ParseFrame accepted the frame", name)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+/*
+	nfinite.space trades disk for cloud space: Clients store parts of other users' Files and
+	in return get to store their own Files on other users' disks. A Client has given the bytes
+	of the parts of other users' Files it holds, and received the bytes of every copy of every
+	part of its own Files, all versions included, as held by its peers.
+
+	With -quota-ratio set, a Client may receive up to -quota-free bytes plus -quota-ratio times
+	what it has given. Uploads that would take a Client past that are refused with a
+	"quotaExceeded" error before any part is sent. Deleting Files and pruning versions frees
+	their bytes once holders drop them from the store, while a new version counts until older
+	ones are pruned. Uploads running at the same time are checked independently, so together
+	they can overshoot the quota. A "usage" message shows a Client where it stands.
+*/
+
+var quotaRatio = flag.Float64("quota-ratio", 0, "bytes a client may store on peers for every byte of others' parts it stores, 0 for no quota")
+var quotaFree = flag.Int("quota-free", 256<<20, "bytes a client may store on peers before storing anything for others, when -quota-ratio is set")
+
+// StorageUsage is how many bytes of parts a Client has given to and received from its peers
+type StorageUsage struct {
+	given    int // bytes of other users' parts the Client holds
+	received int // bytes of the copies of the Client's own parts its peers hold
+}
+
+// quota gets the bytes a Client with usage u may receive, and whether there is a quota at all
+func quota(u StorageUsage) (int, bool) {
+	if *quotaRatio <= 0 {
+		return 0, false
+	}
+	return *quotaFree + int(*quotaRatio*float64(u.given)), true
+}
+
+// checkQuota fails with a "quotaExceeded" ProtocolError if owner receiving bytes more would exceed its quota
+func checkQuota(owner Client, bytes int) error {
+	if *quotaRatio <= 0 {
+		return nil
+	}
+	u, err := database.StorageUsage(owner)
+	if err != nil {
+		return err
+	}
+	if limit, _ := quota(u); u.received+bytes > limit {
+		log.Println("Client", owner.username, "is over quota, storing", bytes, "bytes on top of", u.received, "with a quota of", limit)
+		return ProtocolError{ErrCodeQuotaExceeded, fmt.Errorf("storing %d more bytes would exceed the quota of %d bytes, %d are in use", bytes, limit, u.received)}
+	}
+	return nil
+}
+
+// Handle a "usage" message by telling the Client on Session c how much it has given, received and may receive
+func handleUsage(c *Session) error {
+	cli, _ := c.Client()
+	u, err := database.StorageUsage(cli)
+	if err != nil {
+		return err
+	}
+	msg := UsageMessage{Type: "usage", Given: u.given, Received: u.received}
+	if limit, ok := quota(u); ok {
+		msg.Quota = &limit
+	}
+	return c.WriteJSON(msg)
+}
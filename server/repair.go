@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Repair flags. A repair pass walks every stored File looking for parts with fewer
+// live holders than they should have, and pushes copies of them to new peers.
+var repairInterval = flag.Duration("repair-interval", 10*time.Minute, "time between repair passes, 0 to disable repair")
+var repairRate = flag.Int("repair-rate", 1<<20, "maximum bytes per second the repair daemon sends to peers")
+
+// RepairReport summarises the most recent repair pass. Only its counts are served,
+// which Files failed and why is only logged, as it names Clients and their Files.
+type RepairReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Checked  int       `json:"filesChecked"`
+	Repaired int       `json:"partsRepaired"`
+	Failed   int       `json:"filesFailed"`
+
+	failures map[string]string // "owner/name@version" of each unrepairable File to the reason
+}
+
+// fail records that the File described by what couldn't be repaired because of err
+func (r *RepairReport) fail(what string, err error) {
+	r.Failed++
+	r.failures[what] = err.Error()
+}
+
+// Latest finished repair report, served on /repair of the admin listener, see -admin-addr
+var lastRepair = struct {
+	sync.Mutex
+	report RepairReport
+}{}
+
+// Runs a repair pass every repairInterval, forever
+func repairDaemon() {
+	for range time.Tick(*repairInterval) {
+		report := repairAll()
+		log.Println("Repair pass checked", report.Checked, "files, repaired", report.Repaired, "parts,", report.Failed, "files could not be repaired")
+		for name, reason := range report.failures {
+			log.Println("repair:", name, ":", reason)
+		}
+		lastRepair.Lock()
+		lastRepair.report = report
+		lastRepair.Unlock()
+	}
+}
+
+// Serves the latest RepairReport as JSON
+func handleRepairReport(w http.ResponseWriter, r *http.Request) {
+	lastRepair.Lock()
+	report := lastRepair.report
+	lastRepair.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Println("repair report:", err)
+	}
+}
+
+// Check every stored version of every File and restore the redundancy of its under-replicated parts
+func repairAll() RepairReport {
+	report := RepairReport{Started: time.Now(), failures: map[string]string{}}
+	owners, err := database.Clients()
+	if err != nil {
+		log.Println("repair:", err)
+	}
+	for _, owner := range owners {
+		files, err := database.ClientsFiles("", owner)
+		if err != nil {
+			report.fail(owner.username, err)
+			continue
+		}
+		for _, current := range files {
+			versions, err := database.FileVersions(current.name, owner)
+			if err != nil {
+				report.fail(owner.username+"/"+current.name, err)
+				continue
+			}
+			for _, f := range versions {
+				report.Checked++
+				repaired, err := repairFile(f, owner)
+				report.Repaired += repaired
+				if err != nil {
+					report.fail(owner.username+"/"+f.name+"@"+strconv.Itoa(f.version), err)
+				}
+			}
+		}
+	}
+	report.Finished = time.Now()
+	return report
+}
+
+// Restore the redundancy of owner's File f, returning how many parts were given new holders
+func repairFile(f File, owner Client) (int, error) {
+	reqs, err := database.FilePartRequestsForFile(f, owner)
+	if err != nil {
+		return 0, err
+	}
+	if len(reqs) == 0 {
+		return 0, errors.New("no parts stored for file")
+	}
+	coding := reqs[0].filePart.coding
+	if coding.dataShards == 0 {
+		return repairStripe(reqs, coding, owner)
+	}
+	repaired := 0
+	for j := 0; j < coding.stripes(); j++ {
+		n, err := repairStripe(stripeRequests(reqs, j), coding.stripe(j), owner)
+		repaired += n
+		if err != nil {
+			return repaired, fmt.Errorf("stripe %d: %v", j, err)
+		}
+	}
+	return repaired, nil
+}
+
+// Restore the redundancy of the parts of one stripe of owner's File, sharded with coding
+func repairStripe(reqs []FilePartRequest, coding Coding, owner Client) (int, error) {
+	var damaged []FilePartRequest
+	lost := false
+	for _, req := range reqs {
+		live := liveHolders(req.owners)
+		if len(live) < req.filePart.replicas {
+			damaged = append(damaged, req)
+		}
+		lost = lost || len(live) == 0
+	}
+	if len(damaged) == 0 {
+		return 0, nil
+	}
+
+	// Parts without a single live holder have to be rebuilt from the rest of the File
+	var shards [][]byte
+	if lost {
+		if coding.parityShards == 0 {
+			return 0, errors.New("part lost from every holder and file has no parity to rebuild it from")
+		}
+		var err error
+		if shards, err = fetchShards(context.Background(), reqs, coding); err != nil {
+			return 0, err
+		}
+		if err := rebuildShards(shards, coding); err != nil {
+			return 0, err
+		}
+	}
+
+	repaired := 0
+	for _, req := range damaged {
+		fp := req.filePart
+		if shards != nil {
+			fp.data = shards[coding.shardOf(fp.index)]
+		} else {
+			pt, ok := fetchPartFromOwners(context.Background(), req)
+			if !ok {
+				return repaired, fmt.Errorf("part %d: no live holder answered", fp.index)
+			}
+			fp.data = pt.data
+		}
+		if err := rehomePart(fp, owner, req.owners); err != nil {
+			return repaired, fmt.Errorf("part %d: %v", fp.index, err)
+		}
+		repaired++
+	}
+	return repaired, nil
+}
+
+// Send fp to enough new peers to make up its replicas, replacing holders that are offline
+func rehomePart(fp FilePart, owner Client, holders []Client) error {
+	live := liveHolders(holders)
+	var candidates []Client
+	for _, c := range peerCandidates(owner) {
+		if !containsClient(holders, c) {
+			candidates = append(candidates, c)
+		}
+	}
+	want := fp
+	want.replicas = fp.replicas - len(live)
+	targets := placement.Place(candidates, want)
+	if len(targets) == 0 {
+		return errors.New("no new peers available")
+	}
+
+	// Only peers that acknowledge the part become holders
+	var stored []Client
+	for _, t := range targets {
+		s := sessionForClient(t)
+		if s == nil {
+			continue
+		}
+		if err := storePart(context.Background(), s, fp); err != nil {
+			log.Println("repair: peer", t.username, "didn't store part", fp.name, ":", err)
+			continue
+		}
+		stored = append(stored, t)
+	}
+	if len(stored) == 0 {
+		return errors.New("no new peer stored the part")
+	}
+	if err := database.AddPartHolders(fp, stored...); err != nil {
+		return err
+	}
+	// Offline holders are told to drop their copies when they next log in, see deletion.go
+	for _, h := range holders {
+		if !containsClient(live, h) {
+			if err := database.RemovePartHolder(fp, h); err != nil {
+				log.Println("repair: forget holder", h.username, "of part", fp.name, ":", err)
+			}
+		}
+	}
+
+	// Throttle so repair traffic doesn't starve user uploads and downloads
+	if *repairRate > 0 {
+		sent := len(fp.data) * len(stored)
+		time.Sleep(time.Duration(sent) * time.Second / time.Duration(*repairRate))
+	}
+	return nil
+}
+
+// Gets the holders that are currently connected
+func liveHolders(holders []Client) []Client {
+	var live []Client
+	for _, h := range holders {
+		if sessionForClient(h) != nil {
+			live = append(live, h)
+		}
+	}
+	return live
+}
+
+// Checks whether clients has a Client with the same username as c
+func containsClient(clients []Client, c Client) bool {
+	for _, cli := range clients {
+		if cli.username == c.username {
+			return true
+		}
+	}
+	return false
+}
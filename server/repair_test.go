@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withRepairStore points the store, sessions and placement at fresh ones holding clients for the test,
+// and turns off the repair throttle
+func withRepairStore(t *testing.T, clients ...Client) {
+	t.Helper()
+	oldDatabase, oldSessions, oldPlacement, oldRate := database, sessions, placement, *repairRate
+	t.Cleanup(func() { database, sessions, placement, *repairRate = oldDatabase, oldSessions, oldPlacement, oldRate })
+	database, sessions, placement, *repairRate = NewMemoryStore(), NewSessionRegistry(), &RoundRobinPlacement{}, 0
+	for _, c := range clients {
+		if err := database.CreateClient(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// connectPeer connects cli as a peer that acknowledges the parts it is sent if ack is set,
+// and returns a count of the parts it got
+func connectPeer(t *testing.T, cli Client, ack bool) *int32 {
+	t.Helper()
+	s, conn := testSession(t, cli)
+	sessions.Add(s)
+	sessions.Register(s, cli, nil, ProtocolVersion, "")
+	var got int32
+	go func() {
+		for {
+			mt, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if f, err := ParseFrame(b); mt == websocket.BinaryMessage && err == nil && f.Type == FramePart {
+				atomic.AddInt32(&got, 1)
+				if ack {
+					s.deliverTo(f.RequestID, nil)
+				}
+			}
+		}
+	}()
+	return &got
+}
+
+// saveReplicated stores owner's File name as one whole part with replicas copies on holders
+func saveReplicated(t *testing.T, owner Client, name string, replicas int, holders ...Client) FilePart {
+	t.Helper()
+	f := File{FileMetaData: FileMetaData{name, time.Unix(1000, 0)}, version: 1, uploaded: time.Now()}
+	fp := FilePart{parent: f, coding: NewReplicaCoding(100), replicas: replicas, size: 100}
+	fp.name = partName(name, 0)
+	if err := database.SaveUpload(f, owner, []PlacedPart{{fp, holders, nil}}); err != nil {
+		t.Fatal(err)
+	}
+	fp.data = bytes.Repeat([]byte{1}, 100)
+	return fp
+}
+
+// holdersOf lists the holders the store has for owner's File name
+func holdersOf(t *testing.T, owner Client, name string) []Client {
+	t.Helper()
+	reqs, err := database.FilePartRequestsForFile(File{FileMetaData: FileMetaData{name: name}}, owner)
+	if err != nil || len(reqs) != 1 {
+		t.Fatalf("part requests %v, %v", reqs, err)
+	}
+	return reqs[0].owners
+}
+
+func TestRehomePartReplacesOfflineHolder(t *testing.T) {
+	owner, offline, live, spare := Client{username: "owner"}, Client{username: "offline"}, Client{username: "live"}, Client{username: "spare"}
+	withRepairStore(t, owner, offline, live, spare)
+	connectPeer(t, owner, true)
+	connectPeer(t, live, true)
+	got := connectPeer(t, spare, true)
+	fp := saveReplicated(t, owner, "a.txt", 2, offline, live)
+
+	if err := rehomePart(fp, owner, []Client{offline, live}); err != nil {
+		t.Fatal(err)
+	}
+	holders := holdersOf(t, owner, "a.txt")
+	if len(holders) != 2 || !containsClient(holders, live) || !containsClient(holders, spare) {
+		t.Errorf("holders after repair are %v, want live and spare", holders)
+	}
+	if atomic.LoadInt32(got) != 1 {
+		t.Errorf("spare was sent %d parts, want 1", atomic.LoadInt32(got))
+	}
+	if pending, err := database.PendingDeletions(offline); err != nil || len(pending) != 1 || pending[0] != fp.name {
+		t.Errorf("offline holder has deletions %v, %v queued, want %s", pending, err, fp.name)
+	}
+	if pending, _ := database.PendingDeletions(live); len(pending) != 0 {
+		t.Errorf("live holder has deletions %v queued", pending)
+	}
+}
+
+func TestRehomePartWithoutNewPeers(t *testing.T) {
+	owner, offline, silent := Client{username: "owner"}, Client{username: "offline"}, Client{username: "silent"}
+	withRepairStore(t, owner, offline, silent)
+	fp := saveReplicated(t, owner, "a.txt", 1, offline)
+	if err := rehomePart(fp, owner, []Client{offline}); err == nil {
+		t.Error("rehomed a part with no peers connected")
+	}
+
+	// A peer that never acknowledges the part doesn't become a holder
+	oldTimeout := *partTimeout
+	defer func() { *partTimeout = oldTimeout }()
+	*partTimeout = 50 * time.Millisecond
+	connectPeer(t, silent, false)
+	if err := rehomePart(fp, owner, []Client{offline}); err == nil {
+		t.Error("rehomed a part no peer acknowledged")
+	}
+	if holders := holdersOf(t, owner, "a.txt"); len(holders) != 1 || holders[0].username != offline.username {
+		t.Errorf("holders after a failed repair are %v, want only offline", holders)
+	}
+	if pending, _ := database.PendingDeletions(offline); len(pending) != 0 {
+		t.Errorf("offline holder of an unrepaired part has deletions %v queued", pending)
+	}
+}
+
+func TestRepairReportsUnrepairable(t *testing.T) {
+	owner, offline, spare := Client{username: "owner"}, Client{username: "offline"}, Client{username: "spare"}
+	withRepairStore(t, owner, offline, spare)
+	connectPeer(t, spare, true)
+	// The only copy is offline and there is no parity to rebuild it from
+	saveReplicated(t, owner, "secret-plans.txt", 1, offline)
+
+	report := repairAll()
+	if report.Checked != 1 || report.Repaired != 0 || report.Failed != 1 {
+		t.Errorf("report %+v, want 1 File checked and failed", report)
+	}
+	if len(report.failures) != 1 {
+		t.Errorf("failures %v, want the one File", report.failures)
+	}
+
+	lastRepair.Lock()
+	oldReport := lastRepair.report
+	lastRepair.report = report
+	lastRepair.Unlock()
+	defer func() {
+		lastRepair.Lock()
+		lastRepair.report = oldReport
+		lastRepair.Unlock()
+	}()
+	w := httptest.NewRecorder()
+	handleRepairReport(w, httptest.NewRequest("GET", "/repair", nil))
+	body := w.Body.String()
+	if strings.Contains(body, owner.username) || strings.Contains(body, "secret-plans") {
+		t.Errorf("repair report %s names the File", body)
+	}
+	var served RepairReport
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || served.Failed != 1 {
+		t.Errorf("served report %s, %v, want 1 failure", body, err)
+	}
+}
+
+func TestRehomePartThrottle(t *testing.T) {
+	owner, offline, spare := Client{username: "owner"}, Client{username: "offline"}, Client{username: "spare"}
+	withRepairStore(t, owner, offline, spare)
+	connectPeer(t, spare, true)
+	fp := saveReplicated(t, owner, "a.txt", 1, offline)
+
+	// 100 bytes sent at 1000 bytes a second takes a tenth of a second
+	*repairRate = 1000
+	start := time.Now()
+	if err := rehomePart(fp, owner, []Client{offline}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("repairing 100 bytes at 1000 bytes/s took %v, want at least 100ms", elapsed)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "flag"
+
+// Default replication factor. When above zero, uploads are stored whole on that many
+// distinct peers instead of being erasure coded. Uploads can override it with "replicas".
+var replicas = flag.Int("replicas", 0, "number of distinct peers to store whole-file replicas on, 0 to erasure code files instead")
+
+// ReplicasFromMetaData gets the replication factor requested for an upload, falling back to the server default
+func ReplicasFromMetaData(metadata FileMeta) int {
+	if metadata.Replicas != nil {
+		return *metadata.Replicas
+	}
+	return *replicas
+}
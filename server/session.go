@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Session is one websocket connection. A Client connected from several devices has one Session per device.
+type Session struct {
+	id   string
+	conn *websocket.Conn
+
+	// Done once the Session closes, cancelling work on its behalf
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// websocket.Conn allows only one concurrent writer, every write goes through writeMu
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	client      Client
+	registered  bool
+	since       time.Time
+	passwordKey []byte
+	version     int    // negotiated protocol version
+	tokenID     string // ID of the session token the Session logged in with or was issued
+	listDir     string // directory the Session's file lists list, see directories.go
+	listAll     bool   // whether file lists include everything under listDir
+
+	// Outstanding part requests sent to the peer, keyed by request ID, and the order they were sent in.
+	// Requests cancelled before a peer without Frames answered them stay in order with no waiter,
+	// so their late bare answers can be told apart from the answers to the requests after them.
+	waiters map[uint64]chan []byte
+	order   []uint64
+
+	// Uploads announced by "file" messages whose FrameFileData hasn't arrived yet, keyed by request ID
+	uploads map[uint64]FileMessage
+}
+
+// Source of request IDs, unique across every Session
+var nextRequestID uint64
+
+// NewSession wraps the websocket conn in a Session with a random ID
+func NewSession(conn *websocket.Conn) *Session {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{id: hex.EncodeToString(id), conn: conn, ctx: ctx, cancel: cancel, since: time.Now(), waiters: map[uint64]chan []byte{}, uploads: map[uint64]FileMessage{}}
+}
+
+// ID returns the Session's unique identifier
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Client returns the Client the Session registered as, and whether it has registered yet
+func (s *Session) Client() (Client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client, s.registered
+}
+
+// PasswordKey returns a copy of the key wrapping the file keys of the Session's Client, nil before registration.
+// Callers get their own copy so forgetPasswordKey can't change it under them.
+func (s *Session) PasswordKey() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.passwordKey...)
+}
+
+// forgetPasswordKey drops the Session's password key and zeroes its copy of it, so nothing more can be
+// sealed or opened through the Session. Copies already handed out by PasswordKey are left alone.
+func (s *Session) forgetPasswordKey() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.passwordKey
+	s.passwordKey = nil
+	for i := range key {
+		key[i] = 0
+	}
+}
+
+// Since returns when the Session registered
+func (s *Session) Since() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.since
+}
+
+// TokenID returns the ID of the session token the Session logged in with or was issued, empty before login
+func (s *Session) TokenID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenID
+}
+
+// Listing returns the directory the Session's file lists list and whether they include everything under it
+func (s *Session) Listing() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listDir, s.listAll
+}
+
+// SetListing picks the directory the Session's file lists list, and whether they include everything under it
+func (s *Session) SetListing(dir string, recursive bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listDir, s.listAll = dir, recursive
+}
+
+// Version returns the protocol version negotiated at registration, 0 before it
+func (s *Session) Version() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// UsesFrames reports whether binary messages on the Session are Frames rather than bare payloads
+func (s *Session) UsesFrames() bool {
+	return s.Version() >= FrameProtocolVersion
+}
+
+// Uptime returns how long the Session has been registered
+func (s *Session) Uptime() time.Duration {
+	return time.Since(s.Since())
+}
+
+// WriteMessage writes a single message to the Session's websocket
+func (s *Session) WriteMessage(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// WriteJSON writes v as a JSON text message to the Session's websocket
+func (s *Session) WriteJSON(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.WriteMessage(websocket.TextMessage, msg)
+}
+
+// WriteJSONWithPayload writes v as a JSON text message followed by payload as a binary message.
+// No other write can come between the two, so the peer always sees them as a pair.
+func (s *Session) WriteJSONWithPayload(v interface{}, payload []byte) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(websocket.BinaryMessage, payload)
+}
+
+// WriteFrame writes f as a binary message to the Session's websocket
+func (s *Session) WriteFrame(f Frame) error {
+	return s.WriteMessage(websocket.BinaryMessage, f.Marshal())
+}
+
+// WritePayload sends f's payload the way the Session's protocol version expects:
+// as a single Frame, or as the legacy JSON header v followed by the bare payload.
+func (s *Session) WritePayload(v interface{}, f Frame) error {
+	if s.UsesFrames() {
+		return s.WriteFrame(f)
+	}
+	return s.WriteJSONWithPayload(v, f.Payload)
+}
+
+// discardPayload drops the bare payload that follows a legacy JSON header we couldn't act on
+func (s *Session) discardPayload() {
+	if !s.UsesFrames() {
+		s.ReadMessage()
+	}
+}
+
+// WriteError answers a message of type inReplyTo with an ErrorMessage describing err
+func (s *Session) WriteError(inReplyTo string, err error) {
+	pe := asProtocolError(err)
+	if werr := s.WriteJSON(NewErrorMessage(pe.Code, inReplyTo, pe.Err)); werr != nil {
+		log.Println("send error message:", werr)
+	}
+}
+
+// ReadMessage reads the next message from the Session's websocket. Only the Session's listen goroutine may call it.
+func (s *Session) ReadMessage() (int, []byte, error) {
+	return s.conn.ReadMessage()
+}
+
+// Context returns a Context that is cancelled when the Session closes
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// Close closes the Session's websocket and cancels its Context
+func (s *Session) Close() error {
+	s.cancel()
+	return s.conn.Close()
+}
+
+// expect registers a new outstanding request, whose response will be delivered on the returned channel
+func (s *Session) expect() (uint64, chan []byte) {
+	id := atomic.AddUint64(&nextRequestID, 1)
+	ch := make(chan []byte, 1)
+	s.mu.Lock()
+	s.waiters[id] = ch
+	s.order = append(s.order, id)
+	s.mu.Unlock()
+	return id, ch
+}
+
+// deliverTo hands the response to request id to its waiter, reporting whether it was still outstanding
+func (s *Session) deliverTo(id uint64, message []byte) bool {
+	ch, ok := s.takeWaiter(id)
+	if !ok {
+		return false
+	}
+	ch <- message
+	return true
+}
+
+// cancelRequest forgets outstanding request id, so a late response to it is dropped
+func (s *Session) cancelRequest(id uint64) {
+	s.mu.Lock()
+	if _, ok := s.waiters[id]; ok && s.version < FrameProtocolVersion {
+		// Keep its place in order until its bare answer arrives, see deliver
+		delete(s.waiters, id)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	s.takeWaiter(id)
+}
+
+// expectUpload remembers the upload announced by msg until its FrameFileData arrives
+func (s *Session) expectUpload(msg FileMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[msg.RequestID] = msg
+}
+
+// takeUpload removes and returns the upload announced with request id
+func (s *Session) takeUpload(id uint64) (FileMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.uploads[id]
+	delete(s.uploads, id)
+	return msg, ok
+}
+
+// takeWaiter removes and returns the channel waiting on request id
+func (s *Session) takeWaiter(id uint64) (chan []byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.waiters[id]
+	delete(s.waiters, id)
+	for i, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return ch, ok
+}
+
+// deliver hands a response without a request ID to the oldest request still waiting for an answer.
+// Peers that don't echo request IDs answer in order, so that is the one it belongs to. If that request
+// was cancelled the response is the late answer to it, and is dropped.
+func (s *Session) deliver(message []byte) bool {
+	s.mu.Lock()
+	if len(s.order) == 0 {
+		s.mu.Unlock()
+		return false
+	}
+	id := s.order[0]
+	s.order = s.order[1:]
+	ch, ok := s.waiters[id]
+	delete(s.waiters, id)
+	s.mu.Unlock()
+	if !ok {
+		log.Println("dropped late answer to cancelled request", id)
+		return true
+	}
+	ch <- message
+	return true
+}
+
+// SessionRegistry tracks every open Session, safe for use from many goroutines
+type SessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+// NewSessionRegistry returns an empty SessionRegistry
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{sessions: map[string]*Session{}}
+}
+
+// Add starts tracking Session s
+func (r *SessionRegistry) Add(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.id] = s
+}
+
+// Remove stops tracking Session s
+func (r *SessionRegistry) Remove(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s.id)
+}
+
+// Register marks Session s as belonging to Client c, whose file keys are wrapped by passwordKey,
+// speaking protocol version and logged in under the session token with tokenID
+func (r *SessionRegistry) Register(s *Session, c Client, passwordKey []byte, version int, tokenID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.client = c
+	s.registered = true
+	s.since = time.Now()
+	s.passwordKey = append([]byte(nil), passwordKey...)
+	s.version = version
+	s.tokenID = tokenID
+}
+
+// Get returns the Session with the given ID
+func (r *SessionRegistry) Get(id string) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// Registered returns every Session that has registered as a Client
+func (r *SessionRegistry) Registered() []*Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var sessions []*Session
+	for _, s := range r.sessions {
+		if _, ok := s.Client(); ok {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// ForClient returns every Session registered as Client c, longest lived first
+func (r *SessionRegistry) ForClient(c Client) []*Session {
+	var sessions []*Session
+	for _, s := range r.Registered() {
+		if cli, _ := s.Client(); cli.username == c.username {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Since().Before(sessions[j].Since())
+	})
+	return sessions
+}
+
+// ForToken returns every Session logged in under the session token with id
+func (r *SessionRegistry) ForToken(id string) []*Session {
+	var sessions []*Session
+	for _, s := range r.Registered() {
+		if s.TokenID() == id {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// First returns Client c's longest lived Session, or nil if c isn't connected
+func (r *SessionRegistry) First(c Client) *Session {
+	if sessions := r.ForClient(c); len(sessions) > 0 {
+		return sessions[0]
+	}
+	return nil
+}
+
+// Clients returns every connected Client once, no matter how many Sessions it has
+func (r *SessionRegistry) Clients() []Client {
+	var clients []Client
+	seen := map[string]bool{}
+	for _, s := range r.Registered() {
+		if cli, _ := s.Client(); !seen[cli.username] {
+			seen[cli.username] = true
+			clients = append(clients, cli)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSessionRegistryConcurrent(t *testing.T) {
+	r := NewSessionRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := Client{username: fmt.Sprintf("client%d", i%4)}
+			for j := 0; j < 50; j++ {
+				s := NewSession(nil)
+				r.Add(s)
+				r.Register(s, c, nil, ProtocolVersion, "token")
+				if len(r.ForClient(c)) == 0 {
+					t.Error("registered session missing from ForClient")
+				}
+				r.First(c)
+				r.Clients()
+				r.ForToken("token")
+				if _, ok := r.Get(s.ID()); !ok {
+					t.Error("added session missing from Get")
+				}
+				r.Remove(s)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(r.Registered()); n != 0 {
+		t.Fatalf("%d sessions left after every one was removed", n)
+	}
+}
+
+func TestBareResponsesAfterCancel(t *testing.T) {
+	s := NewSession(nil)
+	NewSessionRegistry().Register(s, Client{username: "legacy"}, nil, 1, "")
+	first, _ := s.expect()
+	_, second := s.expect()
+	s.cancelRequest(first)
+
+	if !s.deliver([]byte("late answer to the first request")) {
+		t.Fatal("late answer wasn't consumed")
+	}
+	select {
+	case m := <-second:
+		t.Fatalf("second request got %q", m)
+	default:
+	}
+	s.deliver([]byte("second"))
+	if m := <-second; string(m) != "second" {
+		t.Fatalf("second request got %q", m)
+	}
+	if s.deliver([]byte("stray")) {
+		t.Fatal("stray answer delivered with no request outstanding")
+	}
+}
+
+func TestCancelAnsweredRequest(t *testing.T) {
+	s := NewSession(nil)
+	NewSessionRegistry().Register(s, Client{username: "legacy"}, nil, 1, "")
+	id, ch := s.expect()
+	s.deliver([]byte("answer"))
+	<-ch
+	// fetchPart always cancels its request once it is done with it
+	s.cancelRequest(id)
+	_, next := s.expect()
+	s.deliver([]byte("next"))
+	if m := <-next; string(m) != "next" {
+		t.Fatalf("next request got %q", m)
+	}
+}
+
+func TestCancelWithRequestIDs(t *testing.T) {
+	s := NewSession(nil)
+	NewSessionRegistry().Register(s, Client{username: "framed"}, nil, ProtocolVersion, "")
+	id, _ := s.expect()
+	s.cancelRequest(id)
+	if s.deliverTo(id, []byte("late")) {
+		t.Fatal("late answer delivered to a cancelled request")
+	}
+	if len(s.order) != 0 {
+		t.Fatalf("cancelled request left in order: %v", s.order)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"regexp"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Postgres style numbered placeholders
+var dollarPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// NewSQLiteStore opens the SQLite database at path, creating it if needed.
+// Should only be called once per path.
+func NewSQLiteStore(path string) *SQLStore {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		log.Fatalln("database connection:", err)
+	}
+	// SQLite allows one writer at a time, queue writers here instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	// SQLite numbers $N placeholders by first appearance rather than N, ?N keeps N
+	return &SQLStore{db, dialectSQLite, func(query string) string {
+		return dollarPlaceholder.ReplaceAllString(query, "?$1")
+	}}
+}
+
+// sqliteUniqueViolation checks if err is SQLite refusing a row for breaking a uniqueness constraint
+func sqliteUniqueViolation(err error) bool {
+	var liteErr sqlite3.Error
+	return errors.As(err, &liteErr) && (liteErr.ExtendedCode == sqlite3.ErrConstraintUnique || liteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"time"
+)
+
+// Metadata store flags
+var storeKind = flag.String("store", "cockroach", "metadata store to use: cockroach, sqlite or memory")
+var cockroachDSN = flag.String("cockroach-dsn", "postgresql://root@localhost:26257?sslcert=%2Fhome%2Fubuntu%2Fnode1.cert&sslkey=%2Fhome%2Fubuntu%2Fnode1.key&sslmode=verify-full&sslrootcert=%2Fhome%2Fubuntu%2Fca.cert", "connection string of the CockroachDB or Postgres cluster used by -store=cockroach")
+var sqlitePath = flag.String("sqlite-path", "nfinite.db", "database file used by -store=sqlite")
+
+// Errors MetadataStore methods fail with, wrapped with details, for callers to check with errors.Is
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("already exists")
+)
+
+// MetadataStore keeps track of Clients, their Files and FileParts, who holds each part,
+// proof-of-storage Challenges, session tokens, the parts holders still have to delete and directories.
+// Implementations are safe for concurrent use.
+// Methods fail with ErrNotFound when a Client, File or part they need is missing.
+type MetadataStore interface {
+	// Clients
+	CreateClient(c Client) error
+	LookupClient(username string) (Client, error)
+	SetPasswordHash(c Client, passwordHash string) error
+	KeySaltForClient(c Client) ([]byte, error)
+	Clients() ([]Client, error)
+	RecordBadPart(c Client) (int, error)
+	RecordChallengeResult(c Client, passed bool) error
+
+	// Files and their parts
+	SaveUpload(f File, owner Client, parts []PlacedPart) error
+	DoesFileExist(f File, c Client) (bool, error)
+	GetFile(name string, version int, c Client) (File, error)
+	ClientsFiles(prefix string, c Client) ([]File, error)
+	FileVersions(name string, c Client) ([]File, error)
+	RestoreVersion(f File, owner Client) (File, error)
+	AddPartHolders(fp FilePart, storers ...Client) error
+	RemovePartHolder(fp FilePart, holder Client) error // also queues a PendingDeletion for holder
+	FilePartRequestsForFile(f File, owner Client) ([]FilePartRequest, error)
+	StoredBytesByClient() (map[string]int, error)
+	StorageUsage(c Client) (StorageUsage, error)
+	DeleteFile(f File, owner Client) ([]Client, error)
+
+	// Directories and moving Files between them, see directories.go
+	MakeDirectory(path string, owner Client) error
+	RemoveDirectory(path string, owner Client) error
+	Directories(prefix string, owner Client) ([]string, error)
+	Move(from, to string, owner Client) error
+
+	// Parts holders have to be told to delete, see deletion.go
+	PendingDeletions(holder Client) ([]string, error)
+	QueuePendingDeletion(holder Client, partName string) error
+	ClearPendingDeletion(holder Client, partName string) error
+
+	// Proof-of-storage challenges
+	TakeChallengeForHolder(c Client) (Challenge, error)
+
+	// Session tokens
+	InsertSessionToken(st SessionToken) error
+	SessionTokenKey(id string, c Client) ([]byte, error)
+	ActiveSessionTokens(c Client) ([]SessionToken, error)
+	RevokeSessionToken(id string, c Client) error
+	PurgeSessionTokens(now time.Time) (int, error)
+}
+
+// NewMetadataStore opens the MetadataStore named by kind, configured by the store flags
+func NewMetadataStore(kind string) MetadataStore {
+	switch kind {
+	case "cockroach":
+		return NewCockroachStore(*cockroachDSN)
+	case "sqlite":
+		return NewSQLiteStore(*sqlitePath)
+	case "memory":
+		return NewMemoryStore()
+	}
+	log.Fatalln("unknown metadata store", kind)
+	return nil
+}
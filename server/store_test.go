@@ -0,0 +1,600 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests below run against every MetadataStore. CockroachDB is only tested when
+// NFINITE_TEST_COCKROACH_DSN names a cluster, whose nfinite database they write to.
+// Client names are made unique per run, so the tests can rerun against a persistent store.
+
+var storeRunID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+var cockroachTestStore struct {
+	sync.Once
+	store *SQLStore
+	err   error
+}
+
+// forEachStore runs test against a fresh MemoryStore, a fresh SQLite SQLStore and, if configured, CockroachDB
+func forEachStore(t *testing.T, test func(t *testing.T, s MetadataStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		s := NewSQLiteStore(t.TempDir() + "/nfinite.db")
+		defer s.Close()
+		if err := s.Migrate(len(migrations)); err != nil {
+			t.Fatal(err)
+		}
+		test(t, s)
+	})
+	t.Run("cockroach", func(t *testing.T) {
+		dsn := os.Getenv("NFINITE_TEST_COCKROACH_DSN")
+		if dsn == "" {
+			t.Skip("NFINITE_TEST_COCKROACH_DSN not set")
+		}
+		cockroachTestStore.Do(func() {
+			cockroachTestStore.store = NewCockroachStore(dsn)
+			cockroachTestStore.err = cockroachTestStore.store.Migrate(len(migrations))
+		})
+		if cockroachTestStore.err != nil {
+			t.Fatal(cockroachTestStore.err)
+		}
+		test(t, cockroachTestStore.store)
+	})
+}
+
+// storeClients creates a Client in s for each name, made unique to the run and test
+func storeClients(t *testing.T, s MetadataStore, names ...string) []Client {
+	t.Helper()
+	var clients []Client
+	for _, name := range names {
+		c := Client{fmt.Sprintf("%s-%s-%s", name, t.Name(), storeRunID), "hash-" + name}
+		if err := s.CreateClient(c); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// storeFile returns version of a File called name, modified and uploaded at the given seconds
+func storeFile(name string, version int, modified int64) File {
+	return File{FileMetaData: FileMetaData{name, time.Unix(modified, 0)}, wrappedKey: []byte("key of " + name), version: version, uploaded: time.Unix(modified+1, 0)}
+}
+
+// storeParts returns n placed parts of File f of owner, five bytes each, on holders with a Challenge apiece
+func storeParts(f File, owner Client, n int, holders ...Client) []PlacedPart {
+	var placed []PlacedPart
+	for i := 0; i < n; i++ {
+		fp := FilePart{parent: f, index: i, kind: DataShard, coding: Coding{2, 1, 10, 16}, replicas: len(holders), size: 5, checksum: "checksum"}
+		fp.name = fmt.Sprintf("%s/%s/v%d/%d", owner.username, f.name, f.version, i)
+		fp.modified = f.modified
+		placed = append(placed, PlacedPart{fp, holders, []Challenge{{nonce: []byte("nonce"), start: 1, length: 2, answer: "answer"}}})
+	}
+	return placed
+}
+
+func TestStoreClients(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MetadataStore) {
+		clients := storeClients(t, s, "alice", "bob")
+		alice, bob := clients[0], clients[1]
+		missing := Client{username: "missing-" + storeRunID}
+
+		if err := s.CreateClient(alice); !errors.Is(err, ErrConflict) {
+			t.Errorf("creating a taken username gave %v, want ErrConflict", err)
+		}
+		if c, err := s.LookupClient(alice.username); err != nil || c.password != alice.password {
+			t.Errorf("LookupClient = %v, %v", c, err)
+		}
+		if _, err := s.LookupClient(missing.username); !errors.Is(err, ErrNotFound) {
+			t.Errorf("looking up a missing client gave %v, want ErrNotFound", err)
+		}
+		if err := s.SetPasswordHash(alice, "rehashed"); err != nil {
+			t.Fatal(err)
+		}
+		if c, _ := s.LookupClient(alice.username); c.password != "rehashed" {
+			t.Errorf("password hash is %q after SetPasswordHash", c.password)
+		}
+		if err := s.SetPasswordHash(missing, "x"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("rehashing a missing client gave %v, want ErrNotFound", err)
+		}
+
+		salt, err := s.KeySaltForClient(alice)
+		if err != nil || len(salt) == 0 {
+			t.Fatalf("KeySaltForClient = %v, %v", salt, err)
+		}
+		if again, _ := s.KeySaltForClient(alice); string(again) != string(salt) {
+			t.Error("salt changed between calls")
+		}
+
+		all, err := s.Clients()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := 0
+		for _, c := range all {
+			if c.username == alice.username || c.username == bob.username {
+				found++
+			}
+		}
+		if found != 2 {
+			t.Errorf("Clients lists %d of the 2 created", found)
+		}
+
+		for want := 1; want <= 2; want++ {
+			if n, err := s.RecordBadPart(bob); err != nil || n != want {
+				t.Errorf("RecordBadPart = %d, %v, want %d", n, err, want)
+			}
+		}
+		if _, err := s.RecordBadPart(missing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("RecordBadPart of a missing client gave %v, want ErrNotFound", err)
+		}
+		if err := s.RecordChallengeResult(bob, true); err != nil {
+			t.Error(err)
+		}
+		if err := s.RecordChallengeResult(missing, false); !errors.Is(err, ErrNotFound) {
+			t.Errorf("RecordChallengeResult of a missing client gave %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreUploads(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MetadataStore) {
+		clients := storeClients(t, s, "alice", "bob")
+		alice, bob := clients[0], clients[1]
+		f := storeFile("a.txt", 1, 1000)
+
+		if _, err := s.GetFile(f.name, 0, alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetFile before upload gave %v, want ErrNotFound", err)
+		}
+		if _, err := s.FilePartRequestsForFile(f, alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("FilePartRequestsForFile before upload gave %v, want ErrNotFound", err)
+		}
+
+		// An upload with an unknown holder leaves nothing behind
+		unknown := storeParts(f, alice, 1, Client{username: "missing-" + storeRunID})
+		if err := s.SaveUpload(f, alice, unknown); err == nil {
+			t.Error("saved an upload held by a missing client")
+		}
+		if exists, _ := s.DoesFileExist(f, alice); exists {
+			t.Error("failed upload left its File behind")
+		}
+
+		// Parts listed out of order, holders listed twice
+		placed := storeParts(f, alice, 2, bob, bob)
+		placed[0], placed[1] = placed[1], placed[0]
+		if err := s.SaveUpload(f, alice, placed); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveUpload(f, alice, placed); !errors.Is(err, ErrConflict) {
+			t.Errorf("saving the same version twice gave %v, want ErrConflict", err)
+		}
+		if exists, _ := s.DoesFileExist(f, alice); !exists {
+			t.Error("saved File doesn't exist")
+		}
+		if exists, _ := s.DoesFileExist(f, bob); exists {
+			t.Error("File exists for a client that didn't upload it")
+		}
+		g, err := s.GetFile(f.name, 0, alice)
+		if err != nil || g.modified.Unix() != 1000 || string(g.wrappedKey) != string(f.wrappedKey) || g.version != 1 {
+			t.Errorf("GetFile = %+v, %v", g, err)
+		}
+		if files, _ := s.ClientsFiles("", alice); len(files) != 1 {
+			t.Errorf("ClientsFiles lists %d Files, want 1", len(files))
+		}
+
+		reqs, err := s.FilePartRequestsForFile(f, alice)
+		if err != nil || len(reqs) != 2 {
+			t.Fatalf("FilePartRequestsForFile = %v, %v", reqs, err)
+		}
+		for i, req := range reqs {
+			if req.filePart.index != i || len(req.owners) != 1 || req.filePart.coding != placed[1-i].part.coding || req.filePart.checksum != "checksum" {
+				t.Errorf("part request %d is %+v", i, req)
+			}
+		}
+		if stored, _ := s.StoredBytesByClient(); stored[bob.username] != 10 {
+			t.Errorf("bob stores %d bytes, want 10", stored[bob.username])
+		}
+
+		// Every Challenge is handed out once
+		for i := 0; i < 2; i++ {
+			ch, err := s.TakeChallengeForHolder(bob)
+			if err != nil || ch.answer != "answer" {
+				t.Fatalf("TakeChallengeForHolder = %+v, %v", ch, err)
+			}
+		}
+		if _, err := s.TakeChallengeForHolder(bob); !errors.Is(err, ErrNotFound) {
+			t.Errorf("used up challenges gave %v, want ErrNotFound", err)
+		}
+
+		if err := s.RemovePartHolder(reqs[0].filePart, bob); err != nil {
+			t.Fatal(err)
+		}
+		if reqs, _ := s.FilePartRequestsForFile(f, alice); len(reqs[0].owners) != 0 {
+			t.Error("removed holder still listed")
+		}
+		if err := s.AddPartHolders(reqs[0].filePart, bob); err != nil {
+			t.Fatal(err)
+		}
+		if reqs, _ := s.FilePartRequestsForFile(f, alice); len(reqs[0].owners) != 1 {
+			t.Error("added holder not listed")
+		}
+		if err := s.AddPartHolders(reqs[0].filePart, Client{username: "missing-" + storeRunID}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("adding a missing holder gave %v, want ErrNotFound", err)
+		}
+		var missingPart FilePart
+		missingPart.name = "missing-" + storeRunID
+		if err := s.AddPartHolders(missingPart, bob); !errors.Is(err, ErrNotFound) {
+			t.Errorf("adding a holder to a missing part gave %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreVersions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MetadataStore) {
+		clients := storeClients(t, s, "alice", "bob")
+		alice, bob := clients[0], clients[1]
+		v1, v2 := storeFile("a.txt", 1, 1000), storeFile("a.txt", 2, 2000)
+		if err := s.SaveUpload(v1, alice, storeParts(v1, alice, 2, bob)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveUpload(v2, alice, storeParts(v2, alice, 1, bob)); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, _ := s.GetFile("a.txt", 0, alice); g.version != 2 || g.modified.Unix() != 2000 {
+			t.Errorf("current version is %d modified %d, want 2 modified 2000", g.version, g.modified.Unix())
+		}
+		if g, _ := s.GetFile("a.txt", 1, alice); g.version != 1 || g.modified.Unix() != 1000 {
+			t.Errorf("version 1 is %d modified %d", g.version, g.modified.Unix())
+		}
+		if _, err := s.GetFile("a.txt", 9, alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("missing version gave %v, want ErrNotFound", err)
+		}
+		if files, _ := s.ClientsFiles("", alice); len(files) != 1 || files[0].version != 2 {
+			t.Errorf("ClientsFiles = %+v, want only version 2", files)
+		}
+		versions, err := s.FileVersions("a.txt", alice)
+		if err != nil || len(versions) != 2 || versions[0].version != 2 || versions[1].uploaded.Unix() != 1001 {
+			t.Errorf("FileVersions = %+v, %v", versions, err)
+		}
+		if _, err := s.FileVersions("missing.txt", alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("versions of a missing File gave %v, want ErrNotFound", err)
+		}
+
+		// Restoring moves the version to the top, with its parts
+		restored, err := s.RestoreVersion(File{FileMetaData: FileMetaData{name: "a.txt"}, version: 1}, alice)
+		if err != nil || restored.version != 3 {
+			t.Fatalf("RestoreVersion = %+v, %v", restored, err)
+		}
+		if g, _ := s.GetFile("a.txt", 0, alice); g.version != 3 || g.modified.Unix() != 1000 {
+			t.Errorf("current version after restore is %d modified %d", g.version, g.modified.Unix())
+		}
+		if reqs, _ := s.FilePartRequestsForFile(File{FileMetaData: FileMetaData{name: "a.txt"}, version: 3}, alice); len(reqs) != 2 {
+			t.Errorf("restored version has %d parts, want 2", len(reqs))
+		}
+		if _, err := s.RestoreVersion(File{FileMetaData: FileMetaData{name: "a.txt"}, version: 1}, alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("restoring a version twice gave %v, want ErrNotFound", err)
+		}
+
+		// Deleting one version leaves the others
+		holders, err := s.DeleteFile(File{FileMetaData: FileMetaData{name: "a.txt"}, version: 2}, alice)
+		if err != nil || len(holders) != 1 || holders[0].username != bob.username {
+			t.Errorf("DeleteFile = %v, %v", holders, err)
+		}
+		if versions, _ := s.FileVersions("a.txt", alice); len(versions) != 1 || versions[0].version != 3 {
+			t.Errorf("versions left are %+v, want only 3", versions)
+		}
+	})
+}
+
+func TestStorePartNamesUnique(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MetadataStore) {
+		clients := storeClients(t, s, "alice", "bob")
+		alice, bob := clients[0], clients[1]
+		a, b := storeFile("a.txt", 1, 1000), storeFile("b.txt", 1, 1000)
+		if err := s.SaveUpload(a, alice, storeParts(a, alice, 2, bob)); err != nil {
+			t.Fatal(err)
+		}
+		// Another File can't take a part name that is already stored
+		if err := s.SaveUpload(b, alice, storeParts(a, alice, 1, bob)); !errors.Is(err, ErrConflict) {
+			t.Errorf("reusing a part name gave %v, want ErrConflict", err)
+		}
+		if exists, _ := s.DoesFileExist(b, alice); exists {
+			t.Error("upload reusing a part name left its File behind")
+		}
+		if reqs, _ := s.FilePartRequestsForFile(a, alice); len(reqs) != 2 {
+			t.Errorf("File whose part name was reused has %d parts, want 2", len(reqs))
+		}
+	})
+}
+
+func TestStoreDirectories(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MetadataStore) {
+		u := storeClients(t, s, "dirs")[0]
+		put := func(name string) error {
+			f := storeFile(name, 1, 1)
+			return s.SaveUpload(f, u, storeParts(f, u, 1))
+		}
+		for _, name := range []string{"docs/a.txt", "docs/sub/b.txt", "top.txt"} {
+			if err := put(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := put("docs"); !errors.Is(err, ErrConflict) {
+			t.Errorf("a File over a directory gave %v, want ErrConflict", err)
+		}
+		if err := put("top.txt/x"); !errors.Is(err, ErrConflict) {
+			t.Errorf("a File under a File gave %v, want ErrConflict", err)
+		}
+
+		if err := s.MakeDirectory("empty/inner", u); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range []string{"empty/inner", "top.txt", "docs"} {
+			if err := s.MakeDirectory(dir, u); !errors.Is(err, ErrConflict) {
+				t.Errorf("mkdir %s gave %v, want ErrConflict", dir, err)
+			}
+		}
+		if files, _ := s.ClientsFiles("docs/", u); len(files) != 2 {
+			t.Errorf("docs/ holds %d Files, want 2", len(files))
+		}
+		if dirs, _ := s.Directories("empty/", u); len(dirs) != 1 || dirs[0] != "empty/inner" {
+			t.Errorf("Directories(empty/) = %v", dirs)
+		}
+
+		if err := s.Move("docs", "archive/docs", u); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetFile("archive/docs/sub/b.txt", 0, u); err != nil {
+			t.Errorf("moved File: %v", err)
+		}
+		if _, err := s.GetFile("docs/a.txt", 0, u); !errors.Is(err, ErrNotFound) {
+			t.Errorf("File left at its old path: %v", err)
+		}
+		if err := s.Move("empty", "archive", u); !errors.Is(err, ErrConflict) {
+			t.Errorf("moving onto a directory gave %v, want ErrConflict", err)
+		}
+		if err := s.Move("empty", "e2", u); err != nil {
+			t.Fatal(err)
+		}
+		if dirs, _ := s.Directories("", u); len(dirs) != 1 || dirs[0] != "e2/inner" {
+			t.Errorf("directories after the move are %v", dirs)
+		}
+		if err := s.Move("top.txt", "archive/top.txt", u); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Move("missing", "x", u); !errors.Is(err, ErrNotFound) {
+			t.Errorf("moving a missing path gave %v, want ErrNotFound", err)
+		}
+		if files, _ := s.ClientsFiles("archive/", u); len(files) != 3 {
+			t.Errorf("archive/ holds %d Files, want 3", len(files))
+		}
+
+		if err := s.RemoveDirectory("e2", u); !errors.Is(err, ErrConflict) {
+			t.Errorf("removing a non-empty directory gave %v, want ErrConflict", err)
+		}
+		if err := s.RemoveDirectory("e2/inner", u); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RemoveDirectory("e2/inner", u); !errors.Is(err, ErrNotFound) {
+			t.Errorf("removing a directory twice gave %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStorePendingDeletions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MetadataStore) {
+		clients := storeClients(t, s, "alice", "bob", "carol")
+		alice, bob, carol := clients[0], clients[1], clients[2]
+		f := storeFile("d.txt", 1, 5)
+		placed := storeParts(f, alice, 3, bob, carol)
+		if err := s.SaveUpload(f, alice, placed); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.DeleteFile(storeFile("missing.txt", 0, 0), alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleting a missing File gave %v, want ErrNotFound", err)
+		}
+		if _, err := s.DeleteFile(f, bob); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleting another client's File gave %v, want ErrNotFound", err)
+		}
+		holders, err := s.DeleteFile(f, alice)
+		if err != nil || len(holders) != 2 {
+			t.Fatalf("DeleteFile = %v, %v", holders, err)
+		}
+		if _, err := s.FilePartRequestsForFile(f, alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleted File's parts gave %v, want ErrNotFound", err)
+		}
+		if _, err := s.TakeChallengeForHolder(bob); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleted File's challenges gave %v, want ErrNotFound", err)
+		}
+		if stored, _ := s.StoredBytesByClient(); stored[bob.username] != 0 {
+			t.Errorf("bob still stores %d bytes", stored[bob.username])
+		}
+
+		pending, err := s.PendingDeletions(bob)
+		if err != nil || len(pending) != 3 || pending[0] != placed[0].part.name {
+			t.Fatalf("PendingDeletions = %v, %v", pending, err)
+		}
+		if err := s.ClearPendingDeletion(bob, placed[1].part.name); err != nil {
+			t.Fatal(err)
+		}
+		if pending, _ := s.PendingDeletions(bob); len(pending) != 2 {
+			t.Errorf("%d deletions pending after clearing one, want 2", len(pending))
+		}
+
+		// Storing a part again cancels its queued deletion
+		if err := s.SaveUpload(f, alice, placed[:1]); err != nil {
+			t.Fatal(err)
+		}
+		if pending, _ := s.PendingDeletions(bob); len(pending) != 1 || pending[0] != placed[2].part.name {
+			t.Errorf("PendingDeletions after storing again = %v", pending)
+		}
+		if pending, _ := s.PendingDeletions(carol); len(pending) != 2 {
+			t.Errorf("carol has %d deletions pending, want 2", len(pending))
+		}
+
+		// A holder removed by repair has to delete its copy
+		reqs, err := s.FilePartRequestsForFile(f, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RemovePartHolder(reqs[0].filePart, carol); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RemovePartHolder(reqs[0].filePart, carol); err != nil {
+			t.Fatal(err)
+		}
+		if pending, _ := s.PendingDeletions(carol); len(pending) != 3 || pending[2] != placed[0].part.name {
+			t.Errorf("PendingDeletions after removing a holder = %v", pending)
+		}
+
+		// Parts of failed uploads are queued by name, once however often they are queued
+		for i := 0; i < 2; i++ {
+			if err := s.QueuePendingDeletion(alice, "orphan"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if pending, _ := s.PendingDeletions(alice); len(pending) != 1 || pending[0] != "orphan" {
+			t.Errorf("PendingDeletions after queueing = %v", pending)
+		}
+		if err := s.QueuePendingDeletion(Client{username: "missing-" + storeRunID}, "orphan"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("queueing for a missing client gave %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreUsage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MetadataStore) {
+		clients := storeClients(t, s, "alice", "bob")
+		alice, bob := clients[0], clients[1]
+		if u, err := s.StorageUsage(alice); err != nil || u != (StorageUsage{}) {
+			t.Errorf("StorageUsage before uploading = %+v, %v", u, err)
+		}
+
+		// Copies alice keeps of her own parts count as received but not given
+		f := storeFile("q.txt", 1, 1)
+		placed := storeParts(f, alice, 2, bob)
+		placed[1].holders = []Client{bob, alice}
+		if err := s.SaveUpload(f, alice, placed); err != nil {
+			t.Fatal(err)
+		}
+		if u, _ := s.StorageUsage(alice); u != (StorageUsage{given: 0, received: 15}) {
+			t.Errorf("alice's usage is %+v, want 15 bytes received", u)
+		}
+		if u, _ := s.StorageUsage(bob); u != (StorageUsage{given: 10, received: 0}) {
+			t.Errorf("bob's usage is %+v, want 10 bytes given", u)
+		}
+		if _, err := s.StorageUsage(Client{username: "missing-" + storeRunID}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("usage of a missing client gave %v, want ErrNotFound", err)
+		}
+
+		if _, err := s.DeleteFile(f, alice); err != nil {
+			t.Fatal(err)
+		}
+		if u, _ := s.StorageUsage(bob); u != (StorageUsage{}) {
+			t.Errorf("bob's usage after the delete is %+v", u)
+		}
+	})
+}
+
+func TestStoreSessionTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MetadataStore) {
+		clients := storeClients(t, s, "alice", "bob")
+		alice, bob := clients[0], clients[1]
+		now := time.Now()
+		active := SessionToken{"active-" + alice.username, alice, now, now.Add(time.Hour), []byte("active key")}
+		expired := SessionToken{"expired-" + alice.username, alice, now.Add(-2 * time.Hour), now.Add(-time.Hour), []byte("expired key")}
+		for _, st := range []SessionToken{active, expired} {
+			if err := s.InsertSessionToken(st); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.InsertSessionToken(active); !errors.Is(err, ErrConflict) {
+			t.Errorf("inserting a token twice gave %v, want ErrConflict", err)
+		}
+
+		if key, err := s.SessionTokenKey(active.id, alice); err != nil || string(key) != "active key" {
+			t.Errorf("SessionTokenKey = %q, %v", key, err)
+		}
+		if _, err := s.SessionTokenKey(active.id, bob); !errors.Is(err, ErrNotFound) {
+			t.Errorf("another client's token key gave %v, want ErrNotFound", err)
+		}
+		if _, err := s.SessionTokenKey(expired.id, alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expired token key gave %v, want ErrNotFound", err)
+		}
+		if tokens, _ := s.ActiveSessionTokens(alice); len(tokens) != 1 || tokens[0].id != active.id {
+			t.Errorf("ActiveSessionTokens = %+v", tokens)
+		}
+
+		if err := s.RevokeSessionToken(active.id, bob); !errors.Is(err, ErrNotFound) {
+			t.Errorf("revoking another client's token gave %v, want ErrNotFound", err)
+		}
+		if err := s.RevokeSessionToken(active.id, alice); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.SessionTokenKey(active.id, alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("revoked token key gave %v, want ErrNotFound", err)
+		}
+		if tokens, _ := s.ActiveSessionTokens(alice); len(tokens) != 0 {
+			t.Errorf("revoked token still listed: %+v", tokens)
+		}
+
+		// Purging deletes alice's revoked and expired tokens but not bob's active one.
+		// Other tests' tokens may share the store, so only a lower bound is known.
+		kept := SessionToken{"kept-" + bob.username, bob, now, now.Add(time.Hour), []byte("kept key")}
+		if err := s.InsertSessionToken(kept); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := s.PurgeSessionTokens(now); err != nil || n < 2 {
+			t.Errorf("PurgeSessionTokens = %d, %v, want at least 2", n, err)
+		}
+		for _, st := range []SessionToken{active, expired} {
+			if err := s.RevokeSessionToken(st.id, alice); !errors.Is(err, ErrNotFound) {
+				t.Errorf("token %s outlived the purge: %v", st.id, err)
+			}
+		}
+		if key, err := s.SessionTokenKey(kept.id, bob); err != nil || string(key) != "kept key" {
+			t.Errorf("active token after purge: %q, %v", key, err)
+		}
+	})
+}
+
+func TestSQLiteMigrationsRoundTrip(t *testing.T) {
+	s := NewSQLiteStore(t.TempDir() + "/nfinite.db")
+	defer s.Close()
+	if err := s.Migrate(len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	u := storeClients(t, s, "alice")[0]
+	f := storeFile("a.txt", 1, 1)
+	if err := s.SaveUpload(f, u, storeParts(f, u, 2, u)); err != nil {
+		t.Fatal(err)
+	}
+	for v := len(migrations) - 1; v >= 1; v-- {
+		if err := s.Migrate(v); err != nil {
+			t.Fatalf("down to %d: %v", v, err)
+		}
+	}
+	if err := s.Migrate(len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.SchemaVersion(); err != nil || v != len(migrations) {
+		t.Fatalf("SchemaVersion = %d, %v", v, err)
+	}
+	if reqs, err := s.FilePartRequestsForFile(File{FileMetaData: FileMetaData{name: "a.txt"}}, u); err != nil || len(reqs) != 2 {
+		t.Errorf("parts after migrating down and up: %v, %v", reqs, err)
+	}
+	if err := s.Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	A "register" or password "login" message asking to be remembered returns a session token
+	that later connections send in a "login" message instead of the password:
+
+		token:  "nft1." | base64url(AES-256-GCM envelope of the JSON sessionClaims)
+
+	The envelope is sealed with the server's token key, so clients can neither read nor
+	forge tokens. Every token also has a SessionToken row, and is only accepted while that
+	row is neither revoked nor expired.
+
+	The row keeps the owner's password key, which the server otherwise only learns from the
+	password, sealed with the token key, so Files can still be opened after a token login.
+	The key never leaves the server and is deleted when the token is revoked, but until then
+	whoever holds both the database and the token key can unwrap the owner's file keys.
+	Revoked and expired tokens are deleted every -token-purge-interval.
+*/
+
+// Session token flags
+var tokenTTL = flag.Duration("token-ttl", 7*24*time.Hour, "time a session token can be used to log in")
+var tokenPurgeInterval = flag.Duration("token-purge-interval", time.Hour, "time between passes deleting revoked and expired session tokens, 0 to keep them")
+var tokenKeyFile = flag.String("token-key-file", "", "file holding the hex 32 byte key session tokens are sealed with, random at startup if empty so tokens don't outlive the server")
+
+const tokenPrefix = "nft1."
+
+// Key session tokens are sealed with, set by loadTokenKey
+var tokenKey []byte
+
+// SessionToken is a session token issued to a Client, as listed in a "sessions" message
+type SessionToken struct {
+	id      string
+	owner   Client
+	created time.Time
+	expires time.Time
+	key     []byte // owner's password key sealed with the token key, only set when issuing
+}
+
+// sessionClaims is what a session token proves about its holder
+type sessionClaims struct {
+	ID      string `json:"id"`
+	User    string `json:"user"`
+	Expires int64  `json:"exp"`
+}
+
+// loadTokenKey reads the key session tokens are sealed with from tokenKeyFile, or makes a random one
+func loadTokenKey() ([]byte, error) {
+	if *tokenKeyFile == "" {
+		log.Println("No -token-key-file, session tokens won't survive a restart")
+		key := make([]byte, keyLength)
+		_, err := rand.Read(key)
+		return key, err
+	}
+	contents, err := os.ReadFile(*tokenKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != keyLength {
+		return nil, errors.New("token key file must hold 32 hex encoded bytes")
+	}
+	return key, nil
+}
+
+// IssueToken creates a session token for client, recording it so it can be listed and revoked
+func IssueToken(client Client, passwordKey []byte) (string, SessionToken, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", SessionToken{}, err
+	}
+	key, err := seal(tokenKey, passwordKey)
+	if err != nil {
+		return "", SessionToken{}, err
+	}
+	now := time.Now()
+	st := SessionToken{hex.EncodeToString(id), client, now, now.Add(*tokenTTL), key}
+	claims, err := json.Marshal(sessionClaims{st.id, client.username, st.expires.Unix()})
+	if err != nil {
+		return "", SessionToken{}, err
+	}
+	sealed, err := seal(tokenKey, claims)
+	if err != nil {
+		return "", SessionToken{}, err
+	}
+	if err := database.InsertSessionToken(st); err != nil {
+		return "", SessionToken{}, err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(sealed), st, nil
+}
+
+// ParseToken checks a session token presented by username and returns its claims along with the password key kept for it
+func ParseToken(token string, username string) (sessionClaims, []byte, error) {
+	var claims sessionClaims
+	invalid := ProtocolError{ErrCodeUnauthorized, errors.New("invalid or expired session token")}
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return claims, nil, invalid
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, tokenPrefix))
+	if err != nil {
+		return claims, nil, invalid
+	}
+	plain, err := open(tokenKey, sealed)
+	if err != nil {
+		return claims, nil, invalid
+	}
+	if err := json.Unmarshal(plain, &claims); err != nil {
+		return claims, nil, invalid
+	}
+	if claims.User != username || time.Now().After(time.Unix(claims.Expires, 0)) {
+		return claims, nil, invalid
+	}
+	key, err := database.SessionTokenKey(claims.ID, Client{username: username})
+	if errors.Is(err, ErrNotFound) {
+		return claims, nil, invalid
+	} else if err != nil {
+		return claims, nil, err
+	}
+	passwordKey, err := open(tokenKey, key)
+	if err != nil {
+		return claims, nil, invalid
+	}
+	return claims, passwordKey, nil
+}
+
+// Handle a "sessions" message by listing the active session tokens of the Client on Session c
+func handleSessionsRequest(c *Session) error {
+	cli, _ := c.Client()
+	tokens, err := database.ActiveSessionTokens(cli)
+	if err != nil {
+		return err
+	}
+	msg := SessionsMessage{Type: "sessions", Sessions: []SessionInfo{}}
+	for _, st := range tokens {
+		msg.Sessions = append(msg.Sessions, SessionInfo{
+			TokenID:     st.id,
+			Created:     strconv.FormatInt(st.created.Unix(), 10),
+			Expires:     strconv.FormatInt(st.expires.Unix(), 10),
+			Connections: len(sessions.ForToken(st.id)),
+			Current:     st.id == c.TokenID(),
+		})
+	}
+	return c.WriteJSON(msg)
+}
+
+// Handle a "logout" message by revoking a session token of the Client on Session c,
+// the Session's own if none is named, and closing every connection that logged in with it
+// after zeroing the password key it holds
+func handleLogout(msg LogoutMessage, c *Session) error {
+	cli, _ := c.Client()
+	id := msg.TokenID
+	if id == "" {
+		id = c.TokenID()
+	}
+	if id == "" {
+		// Nothing to revoke, the Session only ends
+		log.Println("Client", cli.username, "logged out session", c.ID())
+		if err := c.WriteJSON(LogoutMessage{Type: "loggedOut"}); err != nil {
+			log.Println("logout:", err)
+		}
+		c.forgetPasswordKey()
+		c.Close()
+		return nil
+	}
+	if err := database.RevokeSessionToken(id, cli); errors.Is(err, ErrNotFound) {
+		return ProtocolError{ErrCodeNotFound, errors.New("no session token " + id)}
+	} else if err != nil {
+		return err
+	}
+	log.Println("Client", cli.username, "logged out session token", id)
+	if err := c.WriteJSON(LogoutMessage{"loggedOut", id}); err != nil {
+		log.Println("logout:", err)
+	}
+	for _, s := range sessions.ForToken(id) {
+		s.forgetPasswordKey()
+		s.Close()
+	}
+	return nil
+}
+
+// Deletes the revoked and expired session tokens every tokenPurgeInterval, forever
+func tokenPurgeDaemon() {
+	for range time.Tick(*tokenPurgeInterval) {
+		n, err := database.PurgeSessionTokens(time.Now())
+		if err != nil {
+			log.Println("purge session tokens:", err)
+			continue
+		}
+		if n > 0 {
+			log.Println("Purged", n, "revoked or expired session tokens")
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTokenStore points the store and token key at fresh ones holding Client alice for the test
+func withTokenStore(t *testing.T) Client {
+	t.Helper()
+	oldDatabase, oldKey := database, tokenKey
+	t.Cleanup(func() { database, tokenKey = oldDatabase, oldKey })
+	database = NewMemoryStore()
+	tokenKey = testKey(t)
+	alice := Client{username: "alice"}
+	if err := database.CreateClient(alice); err != nil {
+		t.Fatal(err)
+	}
+	return alice
+}
+
+func TestIssueAndParseToken(t *testing.T) {
+	alice := withTokenStore(t)
+	passwordKey := testKey(t)
+	token, st, err := IssueToken(alice, passwordKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, key, err := ParseToken(token, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ID != st.id || claims.User != "alice" || claims.Expires != st.expires.Unix() {
+		t.Errorf("claims %+v don't match the issued token %+v", claims, st)
+	}
+	if !bytes.Equal(key, passwordKey) {
+		t.Error("parsed token gave a different password key")
+	}
+	if sealed, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, tokenPrefix)); bytes.Contains(sealed, passwordKey) {
+		t.Error("token carries the password key")
+	}
+	tokens, err := database.ActiveSessionTokens(alice)
+	if err != nil || len(tokens) != 1 || tokens[0].id != st.id {
+		t.Fatalf("active tokens %v, %v, want just %s", tokens, err, st.id)
+	}
+}
+
+func TestParseTokenRejects(t *testing.T) {
+	alice := withTokenStore(t)
+	token, _, err := IssueToken(alice, testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.TrimPrefix(token, tokenPrefix)
+	flipped := []byte(body)
+	flipped[len(flipped)/2] ^= 1
+	tests := map[string]struct{ token, user string }{
+		"other user":    {token, "bob"},
+		"no prefix":     {body, "alice"},
+		"not base64":    {tokenPrefix + "!!!", "alice"},
+		"tampered":      {tokenPrefix + string(flipped), "alice"},
+		"empty":         {"", "alice"},
+		"other version": {"nft2." + body, "alice"},
+	}
+	for name, test := range tests {
+		_, key, err := ParseToken(test.token, test.user)
+		var pe ProtocolError
+		if !errors.As(err, &pe) || pe.Code != ErrCodeUnauthorized || key != nil {
+			t.Errorf("%s: ParseToken gave %v, want an %s error", name, err, ErrCodeUnauthorized)
+		}
+	}
+
+	// tokens sealed with another server's key don't parse
+	tokenKey = testKey(t)
+	if _, _, err := ParseToken(token, "alice"); err == nil {
+		t.Error("parsed a token sealed with another key")
+	}
+}
+
+func TestRevokedToken(t *testing.T) {
+	alice := withTokenStore(t)
+	token, st, err := IssueToken(alice, testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.RevokeSessionToken(st.id, Client{username: "bob"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("revoking another client's token gave %v, want ErrNotFound", err)
+	}
+	if err := database.RevokeSessionToken(st.id, alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ParseToken(token, "alice"); err == nil {
+		t.Error("parsed a revoked token")
+	}
+	if _, err := database.SessionTokenKey(st.id, alice); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoked token's key lookup gave %v, want ErrNotFound", err)
+	}
+	if tokens, _ := database.ActiveSessionTokens(alice); len(tokens) != 0 {
+		t.Errorf("revoked token still listed: %v", tokens)
+	}
+	if err := database.RevokeSessionToken("nope", alice); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoking an unknown token gave %v, want ErrNotFound", err)
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	alice := withTokenStore(t)
+	oldTTL := *tokenTTL
+	defer func() { *tokenTTL = oldTTL }()
+	*tokenTTL = -time.Second
+	token, st, err := IssueToken(alice, testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ParseToken(token, "alice"); err == nil {
+		t.Error("parsed an expired token")
+	}
+	if _, err := database.SessionTokenKey(st.id, alice); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired token's key lookup gave %v, want ErrNotFound", err)
+	}
+	if tokens, _ := database.ActiveSessionTokens(alice); len(tokens) != 0 {
+		t.Errorf("expired token still listed: %v", tokens)
+	}
+}
+
+func TestForgetPasswordKey(t *testing.T) {
+	key := testKey(t)
+	want := append([]byte(nil), key...)
+	s := NewSession(nil)
+	NewSessionRegistry().Register(s, Client{username: "alice"}, key, ProtocolVersion, "token")
+	// An upload still sealing with the key it got before logout
+	inFlight := s.PasswordKey()
+	inFlight[0] ^= 1
+	if !bytes.Equal(s.PasswordKey(), want) {
+		t.Error("changing a copy of the password key changed the session's")
+	}
+	inFlight[0] ^= 1
+
+	s.forgetPasswordKey()
+	if s.PasswordKey() != nil {
+		t.Error("session kept its password key")
+	}
+	if !bytes.Equal(inFlight, want) || !bytes.Equal(key, want) {
+		t.Error("forgetting the password key changed a copy handed out")
+	}
+	if _, _, err := SealFile([]byte("data"), s.PasswordKey()); err == nil {
+		t.Error("sealed a file without a password key")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Chunked upload flags. Large Files are uploaded as numbered chunks that are spooled to disk
+// as they arrive, so a dropped connection only costs the chunks that were in flight.
+var uploadChunkSize = flag.Int("upload-chunk-size", 4<<20, "bytes per chunk of a chunked upload")
+var uploadExpiry = flag.Duration("upload-expiry", 24*time.Hour, "time an uncommitted chunked upload stays resumable after its last activity")
+var uploadDir = flag.String("upload-dir", os.TempDir(), "directory chunked uploads are spooled to until they are committed")
+var maxUploadSize = flag.Int64("max-upload-size", 16<<30, "largest file in bytes a client may upload")
+
+// Every open chunked upload reserves its whole size in -upload-dir, so each Client may only have so many open
+var maxOpenUploads = flag.Int("max-open-uploads", 4, "chunked uploads a client may have open at once")
+var maxUploadReserved = flag.Int64("max-upload-reserved", 32<<30, "total bytes a client's open chunked uploads may reserve in -upload-dir")
+
+// UploadSession is a chunked upload in progress. It belongs to a Client rather than a Session,
+// so it can be resumed from a new connection until it expires. It doesn't survive a server restart.
+type UploadSession struct {
+	id        string
+	owner     string // username of the Client uploading
+	msg       FileMessage
+	size      int64
+	chunkSize int
+	spool     *os.File
+
+	// mu guards the fields below and writes to spool, so uploads don't wait on each other's chunks
+	mu       sync.Mutex
+	received []bool
+	expires  time.Time
+	closed   bool // committed or expired, so no longer in uploadSessions
+}
+
+// Chunked uploads in progress keyed by upload id, shared by every Session's listen goroutine.
+// The lock only guards the map, never take it while holding an UploadSession's.
+var uploadSessions = struct {
+	sync.Mutex
+	uploads map[string]*UploadSession
+}{uploads: map[string]*UploadSession{}}
+
+// chunks returns how many chunks the upload is split into
+func (u *UploadSession) chunks() int {
+	return len(u.received)
+}
+
+// chunkLength returns the number of bytes chunk i must hold
+func (u *UploadSession) chunkLength(i int) int {
+	if i == u.chunks()-1 {
+		return int(u.size - int64(i)*int64(u.chunkSize))
+	}
+	return u.chunkSize
+}
+
+// missing returns the indexes of the chunks that haven't arrived yet
+func (u *UploadSession) missing() []int {
+	var m []int
+	for i, ok := range u.received {
+		if !ok {
+			m = append(m, i)
+		}
+	}
+	return m
+}
+
+// status describes the upload for an "uploadStatus" message
+func (u *UploadSession) status() UploadStatusMessage {
+	var received []int
+	for i, ok := range u.received {
+		if ok {
+			received = append(received, i)
+		}
+	}
+	return UploadStatusMessage{"uploadStatus", u.id, u.chunkSize, u.chunks(), received, strconv.FormatInt(u.expires.Unix(), 10)}
+}
+
+// discard closes and removes the upload's spool file
+func (u *UploadSession) discard() {
+	u.spool.Close()
+	if err := os.Remove(u.spool.Name()); err != nil {
+		log.Println("upload", u.id, ": remove spool:", err)
+	}
+}
+
+// Start a chunked upload for the Client on Session c and tell it the upload id and chunk size
+func handleUploadInit(msg UploadInitMessage, c *Session) error {
+	if !c.UsesFrames() {
+		return badMessage("uploadInit: chunked uploads need protocol version %d", FrameProtocolVersion)
+	}
+	if err := checkSealing("uploadInit", msg.FileMeta, c); err != nil {
+		return err
+	}
+	if err := checkUploadSize("uploadInit", msg.Size); err != nil {
+		return err
+	}
+	if msg.Size > *maxUploadReserved {
+		return ProtocolError{ErrCodeQuotaExceeded, fmt.Errorf("uploadInit: %d bytes is over the %d bytes open uploads may reserve", msg.Size, *maxUploadReserved)}
+	}
+	// Every part copy only adds to the size, so there is no use receiving an upload that is already too big
+	cli, _ := c.Client()
+	if err := checkQuota(cli, int(msg.Size)); err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	spool, err := os.Create(filepath.Join(*uploadDir, "nfinite-upload-"+hex.EncodeToString(id)))
+	if err != nil {
+		return err
+	}
+	if err := spool.Truncate(msg.Size); err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return err
+	}
+	chunks := int((msg.Size + int64(*uploadChunkSize) - 1) / int64(*uploadChunkSize))
+	if chunks == 0 {
+		chunks = 1 // An empty File is one empty chunk
+	}
+	u := &UploadSession{
+		id:        hex.EncodeToString(id),
+		owner:     cli.username,
+		msg:       FileMessage{"file", 0, msg.FileMeta},
+		size:      msg.Size,
+		chunkSize: *uploadChunkSize,
+		received:  make([]bool, chunks),
+		spool:     spool,
+		expires:   time.Now().Add(*uploadExpiry),
+	}
+	uploadSessions.Lock()
+	err = addUpload(u)
+	uploadSessions.Unlock()
+	if err != nil {
+		u.discard()
+		return err
+	}
+	log.Println("Client", u.owner, "started chunked upload", u.id, "of", msg.FileMeta.Name, "in", chunks, "chunks")
+	return c.WriteJSON(UploadStartedMessage{"uploadStarted", msg.RequestID, u.id, u.chunkSize, chunks, strconv.FormatInt(u.expires.Unix(), 10)})
+}
+
+// Write a FrameUploadChunk from Session c into its upload's spool file
+func handleUploadChunk(frame Frame, c *Session) error {
+	cli, _ := c.Client()
+	u, err := lockUpload(frame.Name, cli)
+	if err != nil {
+		return err
+	}
+	defer u.mu.Unlock()
+	if frame.Offset%uint64(u.chunkSize) != 0 || frame.Offset/uint64(u.chunkSize) >= uint64(u.chunks()) {
+		return badMessage("upload %s: offset %d isn't the start of a chunk", u.id, frame.Offset)
+	}
+	i := int(frame.Offset / uint64(u.chunkSize))
+	if len(frame.Payload) != u.chunkLength(i) {
+		return badMessage("upload %s: chunk %d must be %d bytes, got %d", u.id, i, u.chunkLength(i), len(frame.Payload))
+	}
+	if _, err := u.spool.WriteAt(frame.Payload, int64(frame.Offset)); err != nil {
+		return err
+	}
+	u.received[i] = true
+	u.expires = time.Now().Add(*uploadExpiry)
+	return nil
+}
+
+// Tell the Client on Session c which chunks of an upload have arrived
+func handleUploadStatus(msg UploadStatusMessage, c *Session) error {
+	cli, _ := c.Client()
+	u, err := lockUpload(msg.UploadID, cli)
+	if err != nil {
+		return err
+	}
+	status := u.status()
+	u.mu.Unlock()
+	return c.WriteJSON(status)
+}
+
+// Finish a chunked upload once every chunk has arrived, storing and sharding it like a whole "file" upload
+func handleUploadCommit(msg UploadCommitMessage, c *Session) error {
+	cli, _ := c.Client()
+	u, err := lockUpload(msg.UploadID, cli)
+	if err != nil {
+		return err
+	}
+	if missing := u.missing(); len(missing) > 0 {
+		u.mu.Unlock()
+		return ProtocolError{ErrCodeConflict, fmt.Errorf("upload %s is missing %d chunks", u.id, len(missing))}
+	}
+	u.closed = true
+	u.mu.Unlock()
+	removeUpload(u)
+	defer u.discard()
+
+	if err := finishFileUpload(u.msg, io.NewSectionReader(u.spool, 0, u.size), u.size, c); err != nil {
+		return err
+	}
+	log.Println("Client", u.owner, "committed chunked upload", u.id)
+	return c.WriteJSON(UploadCommitMessage{"uploadCommitted", u.id})
+}
+
+// checkUploadSize rejects a msgType upload of size bytes if it is bigger than the configured limit
+func checkUploadSize(msgType string, size int64) error {
+	if size > *maxUploadSize {
+		return badMessage("%s: %d bytes is over the %d byte upload limit", msgType, size, *maxUploadSize)
+	}
+	return nil
+}
+
+// addUpload adds u to the uploads in progress unless its owner already has as many open,
+// or as many bytes reserved, as allowed. Callers hold uploadSessions.
+func addUpload(u *UploadSession) error {
+	open, reserved := 0, u.size
+	for _, other := range uploadSessions.uploads {
+		if other.owner == u.owner {
+			open++
+			reserved += other.size
+		}
+	}
+	if open >= *maxOpenUploads {
+		return ProtocolError{ErrCodeQuotaExceeded, fmt.Errorf("uploadInit: %d chunked uploads are already open, commit or let one expire first", open)}
+	}
+	if reserved > *maxUploadReserved {
+		return ProtocolError{ErrCodeQuotaExceeded, fmt.Errorf("uploadInit: open uploads would reserve %d bytes, over the limit of %d", reserved, *maxUploadReserved)}
+	}
+	uploadSessions.uploads[u.id] = u
+	return nil
+}
+
+// removeUpload drops u from the uploads in progress
+func removeUpload(u *UploadSession) {
+	uploadSessions.Lock()
+	delete(uploadSessions.uploads, u.id)
+	uploadSessions.Unlock()
+}
+
+// lockUpload gets the live upload with id owned by cli and locks it. Callers unlock its mu.
+func lockUpload(id string, cli Client) (*UploadSession, error) {
+	uploadSessions.Lock()
+	u, ok := uploadSessions.uploads[id]
+	uploadSessions.Unlock()
+	if ok && u.owner == cli.username {
+		u.mu.Lock()
+		if !u.closed && !time.Now().After(u.expires) {
+			return u, nil
+		}
+		u.mu.Unlock()
+	}
+	return nil, ProtocolError{ErrCodeNotFound, errors.New("no upload " + id)}
+}
+
+// Discards expired chunked uploads every minute, forever
+func uploadDaemon() {
+	for range time.Tick(time.Minute) {
+		expireUploads()
+	}
+}
+
+// Discard every chunked upload that has outlived its expiry
+func expireUploads() {
+	uploadSessions.Lock()
+	uploads := make([]*UploadSession, 0, len(uploadSessions.uploads))
+	for _, u := range uploadSessions.uploads {
+		uploads = append(uploads, u)
+	}
+	uploadSessions.Unlock()
+	for _, u := range uploads {
+		u.mu.Lock()
+		expired := !u.closed && time.Now().After(u.expires)
+		if expired {
+			u.closed = true
+		}
+		u.mu.Unlock()
+		if expired {
+			removeUpload(u)
+			log.Println("Chunked upload", u.id, "from", u.owner, "expired")
+			u.discard()
+		}
+	}
+}
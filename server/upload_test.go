@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testSession gives a Session registered as cli, along with the client end of its connection
+func testSession(t *testing.T, cli Client) (*Session, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := upgradeToWebsocket(w, r); err == nil {
+			conns <- c
+		}
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	s := NewSession(<-conns)
+	t.Cleanup(func() { s.Close() })
+	NewSessionRegistry().Register(s, cli, nil, ProtocolVersion, "")
+	return s, client
+}
+
+// withUploads gives the test its own uploads in progress, spooled to a temporary directory
+// in chunks of chunkSize bytes
+func withUploads(t *testing.T, chunkSize int) {
+	t.Helper()
+	oldUploads, oldDir, oldChunkSize := uploadSessions.uploads, *uploadDir, *uploadChunkSize
+	oldOpen, oldReserved := *maxOpenUploads, *maxUploadReserved
+	t.Cleanup(func() {
+		uploadSessions.uploads, *uploadDir, *uploadChunkSize = oldUploads, oldDir, oldChunkSize
+		*maxOpenUploads, *maxUploadReserved = oldOpen, oldReserved
+	})
+	uploadSessions.uploads = map[string]*UploadSession{}
+	*uploadDir = t.TempDir()
+	*uploadChunkSize = chunkSize
+}
+
+// sealedMeta describes a.txt as uploaded by a client that seals its Files
+func sealedMeta(t *testing.T) FileMeta {
+	t.Helper()
+	wrappedKey, err := sealVersion(clientKeyVersion, testKey(t), testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FileMeta{Name: "a.txt", DateModified: "1000", WrappedKey: base64.StdEncoding.EncodeToString(wrappedKey)}
+}
+
+// startUpload starts a chunked upload of size bytes on s and returns its id
+func startUpload(t *testing.T, s *Session, conn *websocket.Conn, size int64) string {
+	t.Helper()
+	if err := handleUploadInit(UploadInitMessage{"uploadInit", 1, sealedMeta(t), size}, s); err != nil {
+		t.Fatal(err)
+	}
+	var started UploadStartedMessage
+	if err := conn.ReadJSON(&started); err != nil {
+		t.Fatal(err)
+	}
+	return started.UploadID
+}
+
+// uploadStatus asks for the status of upload id on s
+func uploadStatus(t *testing.T, s *Session, conn *websocket.Conn, id string) UploadStatusMessage {
+	t.Helper()
+	if err := handleUploadStatus(UploadStatusMessage{Type: "uploadStatus", UploadID: id}, s); err != nil {
+		t.Fatal(err)
+	}
+	var status UploadStatusMessage
+	if err := conn.ReadJSON(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// chunk makes the Frame carrying payload at offset of upload id
+func chunk(id string, offset uint64, payload string) Frame {
+	return Frame{Type: FrameUploadChunk, Name: id, Offset: offset, Payload: []byte(payload)}
+}
+
+// wantCode checks err is a ProtocolError with code
+func wantCode(t *testing.T, what string, err error, code string) {
+	t.Helper()
+	var pe ProtocolError
+	if !errors.As(err, &pe) || pe.Code != code {
+		t.Errorf("%s gave %v, want a %s error", what, err, code)
+	}
+}
+
+func TestUploadChunkValidation(t *testing.T) {
+	withUploads(t, 4)
+	s, conn := testSession(t, Client{username: "alice"})
+	id := startUpload(t, s, conn, 10) // chunks of 4, 4 and 2 bytes
+
+	for name, f := range map[string]Frame{
+		"offset inside a chunk": chunk(id, 1, "abcd"),
+		"offset past the end":   chunk(id, 12, "ab"),
+		"short chunk":           chunk(id, 0, "abc"),
+		"long last chunk":       chunk(id, 8, "abcd"),
+	} {
+		wantCode(t, name, handleUploadChunk(f, s), ErrCodeBadMessage)
+	}
+	wantCode(t, "unknown upload", handleUploadChunk(chunk("nope", 0, "abcd"), s), ErrCodeNotFound)
+	bob, _ := testSession(t, Client{username: "bob"})
+	wantCode(t, "another client's upload", handleUploadChunk(chunk(id, 0, "abcd"), bob), ErrCodeNotFound)
+
+	if err := handleUploadChunk(chunk(id, 8, "ij"), s); err != nil {
+		t.Fatal(err)
+	}
+	if status := uploadStatus(t, s, conn, id); !reflect.DeepEqual(status.Received, []int{2}) {
+		t.Errorf("received chunks %v, want only 2", status.Received)
+	}
+}
+
+func TestUploadDuplicateChunk(t *testing.T) {
+	withUploads(t, 4)
+	s, conn := testSession(t, Client{username: "alice"})
+	id := startUpload(t, s, conn, 8)
+	// A chunk resent after a dropped connection overwrites the first copy
+	for _, payload := range []string{"xxxx", "abcd"} {
+		if err := handleUploadChunk(chunk(id, 0, payload), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status := uploadStatus(t, s, conn, id); !reflect.DeepEqual(status.Received, []int{0}) {
+		t.Errorf("received chunks %v, want only 0", status.Received)
+	}
+	b, err := os.ReadFile(uploadSessions.uploads[id].spool.Name())
+	if err != nil || !bytes.Equal(b[:4], []byte("abcd")) {
+		t.Errorf("spool holds %q, %v, want the resent chunk", b, err)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	withUploads(t, 4)
+	alice := Client{username: "alice"}
+	s, conn := testSession(t, alice)
+	id := startUpload(t, s, conn, 10)
+	for _, f := range []Frame{chunk(id, 0, "abcd"), chunk(id, 8, "ij")} {
+		if err := handleUploadChunk(f, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// The upload belongs to alice, not the connection that started it
+	again, conn := testSession(t, alice)
+	status := uploadStatus(t, again, conn, id)
+	if status.ChunkSize != 4 || status.Chunks != 3 || !reflect.DeepEqual(status.Received, []int{0, 2}) {
+		t.Errorf("resumed upload status %+v, want chunks 0 and 2 of 3 received", status)
+	}
+	if err := handleUploadChunk(chunk(id, 4, "efgh"), again); err != nil {
+		t.Fatal(err)
+	}
+	if status := uploadStatus(t, again, conn, id); len(status.Received) != 3 {
+		t.Errorf("received chunks %v after resuming, want all 3", status.Received)
+	}
+	bob, _ := testSession(t, Client{username: "bob"})
+	wantCode(t, "another client's status", handleUploadStatus(UploadStatusMessage{Type: "uploadStatus", UploadID: id}, bob), ErrCodeNotFound)
+}
+
+func TestUploadCommitIncomplete(t *testing.T) {
+	withUploads(t, 4)
+	s, conn := testSession(t, Client{username: "alice"})
+	id := startUpload(t, s, conn, 10)
+	if err := handleUploadChunk(chunk(id, 0, "abcd"), s); err != nil {
+		t.Fatal(err)
+	}
+	wantCode(t, "committing with chunks missing", handleUploadCommit(UploadCommitMessage{"uploadCommit", id}, s), ErrCodeConflict)
+	// The upload carries on as before
+	if status := uploadStatus(t, s, conn, id); !reflect.DeepEqual(status.Received, []int{0}) {
+		t.Errorf("received chunks %v after a failed commit, want only 0", status.Received)
+	}
+	wantCode(t, "committing an unknown upload", handleUploadCommit(UploadCommitMessage{"uploadCommit", "nope"}, s), ErrCodeNotFound)
+}
+
+func TestUploadExpiry(t *testing.T) {
+	withUploads(t, 4)
+	s, conn := testSession(t, Client{username: "alice"})
+	id := startUpload(t, s, conn, 10)
+	kept := startUpload(t, s, conn, 10)
+	u := uploadSessions.uploads[id]
+	u.expires = time.Now().Add(-time.Second)
+
+	wantCode(t, "chunk of an expired upload", handleUploadChunk(chunk(id, 0, "abcd"), s), ErrCodeNotFound)
+	wantCode(t, "status of an expired upload", handleUploadStatus(UploadStatusMessage{Type: "uploadStatus", UploadID: id}, s), ErrCodeNotFound)
+	expireUploads()
+	if _, ok := uploadSessions.uploads[id]; ok {
+		t.Error("expired upload wasn't discarded")
+	}
+	if _, err := os.Stat(u.spool.Name()); !os.IsNotExist(err) {
+		t.Errorf("expired upload's spool file is still there: %v", err)
+	}
+	if _, ok := uploadSessions.uploads[kept]; !ok {
+		t.Error("live upload was discarded")
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	withUploads(t, 4)
+	*maxOpenUploads, *maxUploadReserved = 2, 25
+	alice := Client{username: "alice"}
+	s, conn := testSession(t, alice)
+	init := func(size int64) error {
+		return handleUploadInit(UploadInitMessage{"uploadInit", 1, sealedMeta(t), size}, s)
+	}
+
+	wantCode(t, "an upload bigger than the reservation limit", init(26), ErrCodeQuotaExceeded)
+	startUpload(t, s, conn, 10)
+	wantCode(t, "reserving past the limit", init(16), ErrCodeQuotaExceeded)
+	startUpload(t, s, conn, 15)
+	wantCode(t, "opening too many uploads", init(0), ErrCodeQuotaExceeded)
+	if files, _ := os.ReadDir(*uploadDir); len(files) != 2 {
+		t.Errorf("%d spool files left behind, want the 2 open uploads'", len(files))
+	}
+
+	// Other clients have limits of their own
+	bob, bobConn := testSession(t, Client{username: "bob"})
+	startUpload(t, bob, bobConn, 25)
+}
+
+func TestUploadSealing(t *testing.T) {
+	withUploads(t, 4)
+	s, _ := testSession(t, Client{username: "alice"})
+	plain := FileMeta{Name: "a.txt", DateModified: "1000"}
+	wantCode(t, "a plaintext upload", handleUploadInit(UploadInitMessage{"uploadInit", 1, plain, 10}, s), ErrCodeBadMessage)
+	wantCode(t, "a plaintext file", handleFileUpload(FileMessage{"file", 1, plain}, s), ErrCodeBadMessage)
+
+	// Clients from before version 6 leave sealing to the server
+	NewSessionRegistry().Register(s, Client{username: "alice"}, testKey(t), DirectoryProtocolVersion, "")
+	wantCode(t, "a sealed upload from an old client", handleUploadInit(UploadInitMessage{"uploadInit", 1, sealedMeta(t), 10}, s), ErrCodeBadMessage)
+	wantCode(t, "a sealed file from an old client", handleFileUpload(FileMessage{"file", 1, sealedMeta(t)}, s), ErrCodeBadMessage)
+	if len(uploadSessions.uploads) != 0 {
+		t.Errorf("%d uploads started", len(uploadSessions.uploads))
+	}
+}
+
+// storingPeer connects cli as a peer that keeps the parts it is sent and serves them back,
+// and returns the parts it holds
+func storingPeer(t *testing.T, cli Client) *sync.Map {
+	t.Helper()
+	s, conn := testSession(t, cli)
+	sessions.Add(s)
+	sessions.Register(s, cli, nil, ProtocolVersion, "")
+	var parts sync.Map
+	go func() {
+		for {
+			mt, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if mt == websocket.BinaryMessage {
+				if f, err := ParseFrame(b); err == nil && f.Type == FramePart {
+					parts.Store(f.Name, f.Payload)
+					s.deliverTo(f.RequestID, nil)
+				}
+				continue
+			}
+			var msg RequestMessage
+			if json.Unmarshal(b, &msg) == nil && msg.Type == "request" {
+				if part, ok := parts.Load(msg.FileMeta.Name); ok {
+					s.deliverTo(msg.RequestID, part.([]byte))
+				}
+			}
+		}
+	}()
+	return &parts
+}
+
+func TestClientSealedFileRoundTrip(t *testing.T) {
+	alice, peer := Client{username: "alice"}, Client{username: "peer"}
+	withRepairStore(t, alice, peer)
+	parts := storingPeer(t, peer)
+	s, conn := testSession(t, alice)
+
+	wrappingKey := testKey(t)
+	data := bytes.Repeat([]byte("only alice reads this. "), 5000)
+	sealed, wrappedKey, err := SealClientFile(data, wrappingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := 1
+	meta := FileMeta{Name: "a.txt", DateModified: "1000", Replicas: &one, WrappedKey: base64.StdEncoding.EncodeToString(wrappedKey)}
+	wantCode(t, "a file cut short", finishFileUpload(FileMessage{"file", 1, meta}, bytes.NewReader(sealed[:20]), 20, s), ErrCodeBadMessage)
+	if err := finishFileUpload(FileMessage{"file", 1, meta}, bytes.NewReader(sealed), int64(len(sealed)), s); err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer holds the bytes the client sealed, as they were sent
+	var stored []byte
+	parts.Range(func(_, part interface{}) bool {
+		if bytes.Contains(part.([]byte), []byte("only alice")) {
+			t.Error("peer holds plaintext")
+		}
+		stored = append(stored, part.([]byte)...)
+		return true
+	})
+	if len(stored) != len(sealed) {
+		t.Errorf("peer holds %d bytes, want the %d sealed", len(stored), len(sealed))
+	}
+
+	// They come back as they are, with the wrapped key for the client to open them
+	if err := handleFileRequest(context.Background(), RequestMessage{"request", 7, FileMeta{Name: "a.txt"}}, s); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for {
+		mt, b, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt == websocket.BinaryMessage {
+			f, err := ParseFrame(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, f.Payload...)
+			continue
+		}
+		var done DownloadCompleteMessage
+		if err := json.Unmarshal(b, &done); err != nil || done.Type != "downloadComplete" {
+			t.Fatalf("got %s, %v", b, err)
+		}
+		if done.FileMeta.WrappedKey != meta.WrappedKey {
+			t.Errorf("download's wrapped key %q, want the uploaded one", done.FileMeta.WrappedKey)
+		}
+		break
+	}
+	if !bytes.Equal(got, sealed) {
+		t.Fatal("downloaded bytes differ from the sealed upload")
+	}
+	if opened, err := OpenFile(got, wrappedKey, wrappingKey); err != nil || !bytes.Equal(opened, data) {
+		t.Errorf("open download: %v", err)
+	}
+
+	// Clients from before version 6 can't open it
+	NewSessionRegistry().Register(s, alice, testKey(t), DirectoryProtocolVersion, "")
+	wantCode(t, "downloading from an old client", handleFileRequest(context.Background(), RequestMessage{"request", 8, FileMeta{Name: "a.txt"}}, s), ErrCodeUnavailable)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"strconv"
+	"time"
+)
+
+/*
+	Uploading a name a Client already has stores the upload as a new version of that File
+	instead of refusing it. Versions are numbered from 1 and the highest is the current one,
+	which downloads, the file list and deletes use unless a message names another version.
+	Restoring a version renumbers it after the newest, so it becomes current while the
+	versions in between are kept. Two uploads of the same name racing for a version number
+	both deliver their parts, each under its own random part names. The first to be recorded
+	takes the version, the other fails with a conflict error and only its own parts are
+	queued for deletion, leaving the winner's untouched.
+
+	Older versions are kept while they are among the newest -keep-versions versions of their
+	File or were uploaded within -keep-versions-for. The rest are pruned after every upload
+	and restore, and every -version-prune-interval when -keep-versions-for is set, with their
+	parts deleted from holders as if the version had been deleted by its owner.
+*/
+
+var keepVersions = flag.Int("keep-versions", 5, "number of newest versions of a file always kept, 0 to keep every version")
+var keepVersionsFor = flag.Duration("keep-versions-for", 0, "time a version is kept after it is uploaded even when it isn't among the newest -keep-versions, 0 to only keep by count")
+var versionPruneInterval = flag.Duration("version-prune-interval", time.Hour, "time between passes pruning versions that have outlived -keep-versions-for")
+
+// nextVersion gets the version number an upload of File f by owner is stored as
+func nextVersion(f File, owner Client) (int, error) {
+	versions, err := database.FileVersions(f.name, owner)
+	if errors.Is(err, ErrNotFound) {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return versions[0].version + 1, nil
+}
+
+// pruneVersions deletes the versions of owner's File f the retention flags no longer keep
+func pruneVersions(f File, owner Client) {
+	if *keepVersions <= 0 {
+		return
+	}
+	versions, err := database.FileVersions(f.name, owner)
+	if err != nil {
+		log.Println("prune versions:", err)
+		return
+	}
+	for i, v := range versions {
+		if i < *keepVersions || (*keepVersionsFor > 0 && time.Since(v.uploaded) < *keepVersionsFor) {
+			continue
+		}
+		holders, err := database.DeleteFile(v, owner)
+		if err != nil {
+			log.Println("prune versions:", err)
+			continue
+		}
+		log.Println("Pruned version", v.version, "of client", owner.username, "file", v.name)
+		sendHoldersPendingDeletions(holders)
+	}
+}
+
+// Prunes the versions of every stored File every versionPruneInterval, forever
+func versionDaemon() {
+	for range time.Tick(*versionPruneInterval) {
+		owners, err := database.Clients()
+		if err != nil {
+			log.Println("prune versions:", err)
+			continue
+		}
+		for _, owner := range owners {
+			files, err := database.ClientsFiles("", owner)
+			if err != nil {
+				log.Println("prune versions:", err)
+				continue
+			}
+			for _, f := range files {
+				pruneVersions(f, owner)
+			}
+		}
+	}
+}
+
+// Handle a "versions" message by listing every version of the named File of the Client on Session c
+func handleVersions(msg VersionsMessage, c *Session) error {
+	cli, _ := c.Client()
+	versions, err := database.FileVersions(msg.FileMeta.Name, cli)
+	if err != nil {
+		return err
+	}
+	answer := VersionsMessage{Type: "versions", FileMeta: FileMeta{Name: msg.FileMeta.Name}}
+	for i, v := range versions {
+		answer.Versions = append(answer.Versions, VersionInfo{
+			Version:      v.version,
+			LastModified: strconv.FormatInt(v.modified.Unix(), 10),
+			Uploaded:     strconv.FormatInt(v.uploaded.Unix(), 10),
+			Current:      i == 0,
+		})
+	}
+	return c.WriteJSON(answer)
+}
+
+// Handle a "restore" message by making the named version of a File of the Client on Session c the current one
+func handleRestore(msg RestoreMessage, c *Session) error {
+	cli, _ := c.Client()
+	restored, err := database.RestoreVersion(FileFromMetaData(msg.FileMeta), cli)
+	if err != nil {
+		return err
+	}
+	log.Println("Client", cli.username, "restored version", msg.FileMeta.Version, "of file", restored.name, "as version", restored.version)
+	meta := FileMeta{Name: restored.name, LastModified: strconv.FormatInt(restored.modified.Unix(), 10), Version: restored.version}
+	if err := c.WriteJSON(RestoreMessage{"restored", meta}); err != nil {
+		return err
+	}
+	sendUsersFileMetaData(c)
+	pruneVersions(restored, cli)
+	return nil
+}